@@ -0,0 +1,62 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Admin routes (mining blocks on request, closing the node's channels with
+// its keys) need the API token the node writes at startup, sent as
+// "Authorization: Bearer <token>". enableCORS does not allow that header, so
+// a web page in the operator's browser can't send it cross-origin.
+
+// TokenPath is where the node serving the API on port keeps its token.
+func TokenPath(port int) string {
+	return fmt.Sprintf("./data/api_%d.token", port)
+}
+
+// LoadOrCreateToken reads the API token at path, generating one on first use.
+func LoadOrCreateToken(path string) (string, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("empty API token in %s", path)
+		}
+		return token, nil
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read API token: %w", err)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate API token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+	// 0600 = Read/Write for owner only
+	if err := os.WriteFile(path, []byte(token), 0600); err != nil {
+		return "", fmt.Errorf("failed to save API token: %w", err)
+	}
+	return token, nil
+}
+
+// SetToken authorizes a request to an admin route.
+func SetToken(r *http.Request, token string) {
+	r.Header.Set("Authorization", "Bearer "+token)
+}
+
+// requireToken rejects requests that don't carry the node's API token.
+func (s *APIServer) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			http.Error(w, "Missing or invalid API token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,376 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"decentralized-net/blockchain"
+)
+
+// History pagination limits
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// registerExplorerRoutes adds the read-only chain explorer endpoints
+func (s *APIServer) registerExplorerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/chain/tip", s.handleTip)
+	mux.HandleFunc("GET /api/v1/block/{hash}", s.handleBlockByHash)
+	mux.HandleFunc("GET /api/v1/block/height/{height}", s.handleBlockByHeight)
+	mux.HandleFunc("GET /api/v1/tx/{id}", s.handleGetTransaction)
+	mux.HandleFunc("GET /api/v1/address/{address}/balance", s.handleBalance)
+	mux.HandleFunc("GET /api/v1/address/{address}/history", s.handleHistory)
+	mux.HandleFunc("GET /api/v1/mempool", s.handleMempool)
+	mux.HandleFunc("GET /api/v1/escrow/{id}", s.handleEscrow)
+	mux.HandleFunc("GET /api/v1/channel/{id}", s.handleChannel)
+	mux.HandleFunc("GET /api/v1/deal/{id}", s.handleDeal)
+	mux.HandleFunc("GET /api/v1/address/{address}/deals", s.handleAddressDeals)
+	// Used by the frontend's getWalletInfo
+	mux.HandleFunc("GET /api/wallet/{address}", s.handleWalletInfo)
+}
+
+// chainReady writes a 503 and returns false if the node has no chain
+func (s *APIServer) chainReady(w http.ResponseWriter) bool {
+	if s.Node.Chain == nil {
+		http.Error(w, "Blockchain not initialized", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// handleTip handles GET /api/v1/chain/tip
+func (s *APIServer) handleTip(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	height, hash, err := s.Node.Chain.GetTip()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read tip: %v", err), http.StatusInternalServerError)
+		return
+	}
+	pruned, err := s.Node.Chain.PrunedHeight()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read pruned height: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"network": s.Node.Chain.Params.Name,
+		"height":  height,
+		"hash":    hash,
+		"mempool": s.Node.Chain.Mempool.Len(),
+		"pruned":  pruned,
+	})
+}
+
+// handleBlockByHash handles GET /api/v1/block/{hash}
+func (s *APIServer) handleBlockByHash(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+	s.writeBlock(w, r.PathValue("hash"))
+}
+
+// handleBlockByHeight handles GET /api/v1/block/height/{height}
+// Returns the main-chain block at that height.
+func (s *APIServer) handleBlockByHeight(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	height, err := strconv.Atoi(r.PathValue("height"))
+	if err != nil || height < 0 {
+		http.Error(w, "Invalid height", http.StatusBadRequest)
+		return
+	}
+	hash, err := s.Node.Chain.GetBlockHashByHeight(height)
+	if err != nil {
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+	s.writeBlock(w, hash)
+}
+
+// writeBlock responds with a block and its position relative to the tip.
+// Blocks on a side branch report main_chain false and no confirmations.
+func (s *APIServer) writeBlock(w http.ResponseWriter, hash string) {
+	block, err := s.Node.Chain.GetBlock(hash)
+	if errors.Is(err, blockchain.ErrPruned) {
+		http.Error(w, "Block body pruned", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+
+	confirmations := 0
+	mainHash, err := s.Node.Chain.GetBlockHashByHeight(block.Index)
+	mainChain := err == nil && mainHash == block.Hash
+	if mainChain {
+		if tipHeight, _, err := s.Node.Chain.GetTip(); err == nil {
+			confirmations = tipHeight - block.Index + 1
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"block":         block,
+		"main_chain":    mainChain,
+		"confirmations": confirmations,
+	})
+}
+
+// handleGetTransaction handles GET /api/v1/tx/{id}
+// Looks in the chain first, then in the mempool.
+func (s *APIServer) handleGetTransaction(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	id := r.PathValue("id")
+	tx, err := s.Node.Chain.FindTransaction(id)
+	if err != nil {
+		pending := s.Node.Chain.Mempool.Get(id)
+		if pending == nil {
+			http.Error(w, "Transaction not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":      "pending",
+			"transaction": pending,
+		})
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":      "confirmed",
+		"transaction": tx,
+	}
+	if blockHash, err := s.Node.Chain.GetTransactionBlockHash(id); err == nil {
+		response["block_hash"] = blockHash
+		if header, err := s.Node.Chain.GetHeader(blockHash); err == nil {
+			response["height"] = header.Index
+			if tipHeight, _, err := s.Node.Chain.GetTip(); err == nil {
+				response["confirmations"] = tipHeight - header.Index + 1
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleBalance handles GET /api/v1/address/{address}/balance
+func (s *APIServer) handleBalance(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	address := r.PathValue("address")
+	acc, err := s.Node.Chain.GetAccount(address)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read account: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address":    address,
+		"balance":    acc.Balance,
+		"immature":   acc.Immature,
+		"nonce":      acc.Nonce,
+		"next_nonce": s.Node.Chain.NextNonce(address),
+	})
+}
+
+// handleHistory handles GET /api/v1/address/{address}/history?offset=N&limit=N
+// Returns confirmed transactions to or from the address, newest first. With
+// from_height and/or to_height it returns that block range oldest first
+// (for statements).
+func (s *APIServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	offset, limit := 0, defaultHistoryLimit
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	fromHeight, toHeight := 0, -1
+	for name, dst := range map[string]*int{"from_height": &fromHeight, "to_height": &toHeight} {
+		if v := r.URL.Query().Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+
+	address := r.PathValue("address")
+	var history []blockchain.AddressTx
+	var err error
+	if r.URL.Query().Has("from_height") || r.URL.Query().Has("to_height") {
+		if toHeight < 0 {
+			toHeight, _, err = s.Node.Chain.GetTip()
+		}
+		if err == nil {
+			history, err = s.Node.Chain.GetAddressHistoryRange(address, fromHeight, toHeight, offset, limit)
+		}
+	} else {
+		history, err = s.Node.Chain.GetAddressHistory(address, offset, limit)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address":      address,
+		"offset":       offset,
+		"limit":        limit,
+		"transactions": history,
+	})
+}
+
+// handleMempool handles GET /api/v1/mempool
+// Returns pending transactions in the order a miner would include them.
+func (s *APIServer) handleMempool(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	txs := s.Node.Chain.Mempool.Transactions()
+	if txs == nil {
+		txs = []*blockchain.Transaction{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":        len(txs),
+		"transactions": txs,
+	})
+}
+
+// handleEscrow handles GET /api/v1/escrow/{id}
+// Returns an open escrow by the ID of its lock transaction.
+func (s *APIServer) handleEscrow(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	escrow, err := s.Node.Chain.GetEscrow(r.PathValue("id"))
+	if errors.Is(err, blockchain.ErrNoEscrow) {
+		http.Error(w, "No open escrow with that ID", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read escrow: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(escrow)
+}
+
+// handleChannel handles GET /api/v1/channel/{id}
+// Returns an open payment channel by the ID of its open transaction.
+func (s *APIServer) handleChannel(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	channel, err := s.Node.Chain.GetChannel(r.PathValue("id"))
+	if errors.Is(err, blockchain.ErrNoChannel) {
+		http.Error(w, "No open channel with that ID", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read channel: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channel)
+}
+
+// handleDeal handles GET /api/v1/deal/{id}
+// Returns an active storage deal by the ID of its deal transaction.
+func (s *APIServer) handleDeal(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	deal, err := s.Node.Chain.GetDeal(r.PathValue("id"))
+	if errors.Is(err, blockchain.ErrNoDeal) {
+		http.Error(w, "No active deal with that ID", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read deal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deal)
+}
+
+// handleAddressDeals handles GET /api/v1/address/{address}/deals
+// Returns the active storage deals the address is client or provider of.
+func (s *APIServer) handleAddressDeals(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	address := r.PathValue("address")
+	deals, err := s.Node.Chain.GetDeals(address)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read deals: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address": address,
+		"count":   len(deals),
+		"deals":   deals,
+	})
+}
+
+// handleWalletInfo handles GET /api/wallet/{address}
+func (s *APIServer) handleWalletInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.chainReady(w) {
+		return
+	}
+
+	address := r.PathValue("address")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address": address,
+		"balance": s.Node.Chain.GetBalance(address),
+	})
+}
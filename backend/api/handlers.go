@@ -117,6 +117,7 @@ func (s *APIServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"status":    "online",
 		"nodeId":    s.Node.Host.ID().String(),
+		"address":   s.Node.Address,
 		"peers":     len(peers),
 		"timestamp": time.Now().Unix(),
 	}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -20,8 +21,22 @@ type APIServer struct {
 	Node  *p2p.Node
 	Vault storage.VaultInterface
 	VM    *compute.VM
+
+	// MinerAddress receives rewards for blocks mined via /api/v1/generate
+	// when the request names no address.
+	MinerAddress string
+
+	// AllowGenerate serves /api/v1/generate on networks that don't mine on
+	// demand. Without it the endpoint only works on regtest.
+	AllowGenerate bool
+
+	// Token authorizes the admin routes (see requireToken).
+	Token string
 }
 
+// MaxGenerateBlocks caps the number of blocks one generate request may mine.
+const MaxGenerateBlocks = 1000
+
 // JobRequest represents a compute job submission
 type JobRequest struct {
 	WasmBase64 string `json:"wasm_base64"` // For simplicity in MVP, or multipart? Let's use multipart for files usually, but JSON for small stuff.
@@ -30,11 +45,14 @@ type JobRequest struct {
 }
 
 // StartAPIServer starts the HTTP gateway
-func StartAPIServer(node *p2p.Node, vault storage.VaultInterface, vm *compute.VM, port int) {
+func StartAPIServer(node *p2p.Node, vault storage.VaultInterface, vm *compute.VM, minerAddress string, port int, allowGenerate bool, token string) {
 	server := &APIServer{
-		Node:  node,
-		Vault: vault,
-		VM:    vm,
+		Node:          node,
+		Vault:         vault,
+		VM:            vm,
+		MinerAddress:  minerAddress,
+		AllowGenerate: allowGenerate,
+		Token:         token,
 	}
 
 	mux := http.NewServeMux()
@@ -42,6 +60,11 @@ func StartAPIServer(node *p2p.Node, vault storage.VaultInterface, vm *compute.VM
 	mux.HandleFunc("/api/jobs/submit", server.handleJobSubmit)
 	mux.HandleFunc("/api/v1/upload", server.handleUpload)
 	mux.HandleFunc("/api/v1/transaction", server.handleTransaction)
+	mux.HandleFunc("GET /api/v1/nonce/{address}", server.handleNonce)
+	mux.HandleFunc("GET /api/v1/proof/{txid}", server.handleProof)
+	mux.HandleFunc("POST /api/v1/generate", server.requireToken(server.handleGenerate))
+	mux.HandleFunc("POST /api/v1/channel/{id}/close", server.requireToken(server.handleChannelClose))
+	server.registerExplorerRoutes(mux)
 	mux.HandleFunc("/api/health", server.handleHealth)
 
 	// Apply CORS
@@ -58,7 +81,8 @@ func StartAPIServer(node *p2p.Node, vault storage.VaultInterface, vm *compute.VM
 	}()
 }
 
-// enableCORS adds CORS headers to allow frontend requests
+// enableCORS adds CORS headers to allow frontend requests. Authorization is
+// deliberately not an allowed header (see requireToken).
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -243,9 +267,135 @@ func (s *APIServer) handleTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Gossip it so whichever miner finds the next block can include it
+	if err := s.Node.BroadcastTransaction(&tx); err != nil {
+		log.Printf("[API] Failed to broadcast transaction %s: %v", tx.ID, err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"status": "success",
 		"tx_id":  tx.ID,
 	})
 }
+
+// handleNonce handles GET /api/v1/nonce/{address}
+// Returns the nonce the address must use for its next transaction.
+func (s *APIServer) handleNonce(w http.ResponseWriter, r *http.Request) {
+	if s.Node.Chain == nil {
+		http.Error(w, "Blockchain not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	address := r.PathValue("address")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address": address,
+		"nonce":   s.Node.Chain.NextNonce(address),
+	})
+}
+
+// handleProof handles GET /api/v1/proof/{txid}
+// Returns a Merkle inclusion proof and the header of the block containing the
+// transaction, so light clients can verify it without the full block.
+func (s *APIServer) handleProof(w http.ResponseWriter, r *http.Request) {
+	if s.Node.Chain == nil {
+		http.Error(w, "Blockchain not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	proof, header, err := s.Node.Chain.GetMerkleProof(r.PathValue("txid"))
+	if err != nil {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"proof":  proof,
+		"header": header,
+	})
+}
+
+// GenerateRequest asks the node to mine blocks immediately
+type GenerateRequest struct {
+	Blocks  int    `json:"blocks"`
+	Address string `json:"address"` // Reward address (defaults to the node's wallet)
+}
+
+// handleGenerate handles POST /api/v1/generate
+// Mines the requested number of blocks on top of the current tip, including
+// pending transactions, and broadcasts each one. Used to script tests, so
+// it is refused unless the network mines on demand or AllowGenerate is set.
+func (s *APIServer) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	if s.Node.Chain == nil {
+		http.Error(w, "Blockchain not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	if !s.Node.Chain.Params.MineOnDemand && !s.AllowGenerate {
+		http.Error(w, fmt.Sprintf("generate is disabled on %s (start the node with --allow-generate)", s.Node.Chain.Params.Name), http.StatusForbidden)
+		return
+	}
+
+	var req GenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Blocks <= 0 || req.Blocks > MaxGenerateBlocks {
+		http.Error(w, fmt.Sprintf("blocks must be between 1 and %d", MaxGenerateBlocks), http.StatusBadRequest)
+		return
+	}
+	if req.Address == "" {
+		req.Address = s.MinerAddress
+	}
+
+	hashes := make([]string, 0, req.Blocks)
+	height := 0
+	for i := 0; i < req.Blocks; i++ {
+		// Stop early if the client went away
+		if r.Context().Err() != nil {
+			return
+		}
+		block := s.Node.Chain.AddBlock(req.Address)
+		if err := s.Node.BroadcastBlock(block); err != nil {
+			log.Printf("[API] Failed to broadcast block %s: %v", block.Hash, err)
+		}
+		hashes = append(hashes, block.Hash)
+		height = block.Index
+	}
+	log.Printf("[API] Generated %d blocks to %s (height %d)", len(hashes), req.Address, height)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"height": height,
+		"blocks": hashes,
+	})
+}
+
+// handleChannelClose handles POST /api/v1/channel/{id}/close
+// Closes a payment channel that pays this node with the latest update it
+// accepted. The payer closes its side with a signed transaction instead.
+func (s *APIServer) handleChannelClose(w http.ResponseWriter, r *http.Request) {
+	if s.Node.Chain == nil {
+		http.Error(w, "Blockchain not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	tx, err := s.Node.CloseChannel(r.PathValue("id"))
+	if errors.Is(err, blockchain.ErrNoChannel) {
+		http.Error(w, "No open channel with that ID", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to close channel: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"tx_id":  tx.ID,
+	})
+}
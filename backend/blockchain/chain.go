@@ -2,34 +2,48 @@ package blockchain
 
 import (
 	"decentralized-net/wallet"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
 )
 
-const (
-	// Configuration for Testnet (Faster) vs Mainnet
-	dbFile      = "./data/blockchain_%s" // %s = NodePort or ID
-	genesisData = "Decentralized Net Genesis"
-)
+// MaxBlockTransactions caps how many mempool transactions a mined block takes.
+const MaxBlockTransactions = 1000
+
+// CoinbaseSender is the From address used by block reward transactions.
+const CoinbaseSender = "SYSTEM"
+
+// ErrBlockKnown is returned by ProcessBlock when the block is already stored.
+var ErrBlockKnown = errors.New("block already known")
 
-// Difficulty is configurable.
-// Testnet: 2 (Fast). Mainnet: 4 (Secure).
-var Difficulty = 2
+// ErrTxKnown is returned by AddTransaction when the transaction is already
+// pending or confirmed.
+var ErrTxKnown = errors.New("transaction already known")
 
 type Blockchain struct {
 	LastHash string
 	Database *badger.DB
-	Mempool  []*Transaction
+	Mempool  *Mempool
+	Params   *NetworkParams
+	// PruneDepth, if set, is how many recent block bodies to keep (at least
+	// MinPruneDepth); older ones are dropped as the chain grows, see prune.go.
+	PruneDepth int
+
+	// mu serializes writers (mining loop, gossip listener, HTTP handlers)
+	mu sync.Mutex
 }
 
-// InitBlockchain creates a new chain with Genesis block if none exists
-func InitBlockchain(nodeID string, minerAddress string) *Blockchain {
-	path := fmt.Sprintf(dbFile, nodeID)
+// InitBlockchain opens the node's chain for the given network, creating it
+// from the network's Genesis block if none exists
+func InitBlockchain(params *NetworkParams, nodeID string) *Blockchain {
+	path := params.ChainPath(nodeID)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		os.MkdirAll(path, 0700)
 	}
@@ -49,23 +63,24 @@ func InitBlockchain(nodeID string, minerAddress string) *Blockchain {
 		if _, err := txn.Get([]byte("lh")); err == badger.ErrKeyNotFound {
 			log.Println("No blockchain found. Creating Genesis Block...")
 
-			// Create Genesis Transaction
-			cbtx := &Transaction{
-				From:      "SYSTEM",
-				To:        minerAddress,
-				Amount:    1000000, // 1 Million Coins Premine
-				Timestamp: 0,
-				ID:        "GENESIS_COINBASE",
-			}
-
-			genesis := NewGenesisBlock(cbtx)
-			// Mine it (even Genesis needs valid hash structure)
-			MineBlock(genesis)
+			genesis := params.GenesisBlock()
 
 			err = txn.Set([]byte(genesis.Hash), genesis.Serialize())
 			if err != nil {
 				log.Panic(err)
 			}
+			err = txn.Set([]byte(headerPrefix+genesis.Hash), genesis.BlockHeader.Serialize())
+			if err != nil {
+				log.Panic(err)
+			}
+			err = txn.Set([]byte(workPrefix+genesis.Hash), []byte(blockWork(genesis.Bits).String()))
+			if err != nil {
+				log.Panic(err)
+			}
+			err = txn.Set(heightKey(0), []byte(genesis.Hash))
+			if err != nil {
+				log.Panic(err)
+			}
 			err = txn.Set([]byte("lh"), []byte(genesis.Hash))
 			lastHash = genesis.Hash
 			log.Printf("Genesis Block Created! Hash: %s", genesis.Hash)
@@ -86,176 +101,605 @@ func InitBlockchain(nodeID string, minerAddress string) *Blockchain {
 		log.Panic(err)
 	}
 
-	return &Blockchain{lastHash, db, []*Transaction{}}
+	bc := &Blockchain{LastHash: lastHash, Database: db, Mempool: NewMempool(), Params: params}
+	if err := bc.ensureChainIndex(); err != nil {
+		log.Panic(err)
+	}
+	if err := bc.ensureState(); err != nil {
+		bc.failStartup(err)
+	}
+	if err := bc.ensureAddressIndex(); err != nil {
+		bc.failStartup(err)
+	}
+	return bc
 }
 
 // AddTransaction verifies and adds a tx to the mempool
 func (bc *Blockchain) AddTransaction(tx *Transaction) error {
-	if !bc.VerifyTransaction(tx) {
-		return fmt.Errorf("invalid transaction signature")
+	if tx.From == CoinbaseSender {
+		return fmt.Errorf("coinbase transactions cannot be submitted")
 	}
 
-	// Basic balance check
-	balance := bc.GetBalance(tx.From)
-	if balance < tx.Amount {
-		return fmt.Errorf("insufficient funds")
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if bc.Mempool.Has(tx.ID) {
+		return fmt.Errorf("%w: %s is in the mempool", ErrTxKnown, tx.ID)
 	}
 
-	bc.Mempool = append(bc.Mempool, tx)
-	return nil
+	// Check against the sender's pending txs so nonces stay sequential and
+	// balance covers everything queued. A tx reusing a pending nonce replaces
+	// it, so the later pending txs must still be affordable afterwards.
+	height, err := bc.nextHeight()
+	if err != nil {
+		return err
+	}
+	ctx := newTxContext(height)
+	var after []*Transaction
+	for _, pending := range bc.Mempool.SenderTransactions(tx.From) {
+		switch {
+		case pending.Nonce < tx.Nonce:
+			ctx.apply(pending)
+		case pending.Nonce > tx.Nonce:
+			after = append(after, pending)
+		}
+	}
+	if err := bc.checkTransaction(tx, ctx); err != nil {
+		return err
+	}
+	for _, pending := range after {
+		if bc.GetBalance(tx.From)-ctx.spent[tx.From] < pending.cost() {
+			return fmt.Errorf("%w: pending tx %s would become unaffordable", ErrTxConflict, pending.ID)
+		}
+		ctx.apply(pending)
+	}
+
+	return bc.Mempool.Add(tx)
 }
 
-// VerifyTransaction verifies the signature of the transaction
+// VerifyTransaction checks that the ID matches the contents, that the
+// attached public key (or multisig script) belongs to the sender and that it
+// signed the ID
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	return tx.Signature != ""
+	if tx.PublicKey == "" || tx.CalculateHash() != tx.ID {
+		return false
+	}
+	if wallet.IsMultisigScript(tx.PublicKey) {
+		return verifyMultisig(tx)
+	}
+	if tx.Signature == "" || len(tx.Signatures) > 0 {
+		return false
+	}
+
+	pub, err := wallet.DecodePublicKey(tx.PublicKey)
+	if err != nil {
+		return false
+	}
+	if wallet.PublicKeyToAddress(pub) != tx.From {
+		return false
+	}
+
+	digest, err := hex.DecodeString(tx.ID)
+	if err != nil {
+		return false
+	}
+	return wallet.VerifySignature(pub, digest, tx.Signature)
+}
+
+// verifyMultisig checks a transaction from a multisig address: the script
+// must hash to From and at least M of its keys must have signed the ID.
+func verifyMultisig(tx *Transaction) bool {
+	script, err := wallet.DecodeMultisigScript(tx.PublicKey)
+	if err != nil || script.Address() != tx.From || tx.Signature != "" {
+		return false
+	}
+	digest, err := hex.DecodeString(tx.ID)
+	if err != nil {
+		return false
+	}
+	return script.Verify(digest, tx.Signatures) == nil
 }
 
 // CreateTransaction creates a new signed transaction
-func (bc *Blockchain) CreateTransaction(from, to string, amount int, w *wallet.Wallet) (*Transaction, error) {
+func (bc *Blockchain) CreateTransaction(from, to string, amount, fee int, w *wallet.Wallet) (*Transaction, error) {
+	return bc.CreateTypedTransaction(from, to, amount, fee, TxTransfer, nil, w)
+}
+
+// CreateTypedTransaction creates a new signed transaction of the given type
+func (bc *Blockchain) CreateTypedTransaction(from, to string, amount, fee int, txType TxType, payload []byte, w *wallet.Wallet) (*Transaction, error) {
 	tx := &Transaction{
-		From: from, To: to, Amount: amount, Timestamp: time.Now().Unix(),
+		From: from, To: to, Amount: amount, Fee: fee, Nonce: bc.NextNonce(from), Timestamp: time.Now().Unix(),
+		Type: txType, Payload: payload,
 	}
-	tx.ID = tx.CalculateHash()
-	// Sign
-	sig, err := w.Sign([]byte(tx.ID))
-	if err != nil {
+	if err := tx.Sign(w); err != nil {
 		return nil, err
 	}
-	tx.Signature = sig
-
 	return tx, nil
 }
 
 // MineBlock performs the PoW (Moved from Miner.go for simplicity in this struct)
 func MineBlock(b *Block) {
-	target := strings.Repeat("0", Difficulty)
-	for {
-		if strings.HasPrefix(b.Hash, target) {
-			break
-		}
+	mineBlock(b, nil)
+}
+
+// mineBlock searches for a nonce that meets the block's target. stale is
+// polled periodically; if it reports true, mining is abandoned and false is
+// returned.
+func mineBlock(b *Block, stale func() bool) bool {
+	b.Hash = b.CalculateHash()
+	for !meetsTarget(b.Hash, b.Bits) {
 		b.Nonce++
+		if stale != nil && b.Nonce%4096 == 0 && stale() {
+			return false
+		}
 		b.Hash = b.CalculateHash()
 	}
+	return true
 }
 
-// AddBlock mines and adds a new block
-func (bc *Blockchain) AddBlock(txs []*Transaction) *Block {
-	var lastHash string
-	var lastHeight int
-
-	// Incorporate Mempool
-	txs = append(txs, bc.Mempool...)
-
-	err := bc.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
+// AddBlock mines and adds a new block paying the reward to minerAddress.
+// The lock is released while hashing so peer blocks can still be processed;
+// if one moves the tip, mining starts over on the new tip.
+func (bc *Blockchain) AddBlock(minerAddress string) *Block {
+	for {
+		bc.mu.Lock()
+		newBlock, err := bc.newBlockTemplate(minerAddress)
+		bc.mu.Unlock()
 		if err != nil {
-			return err
+			log.Panic(err)
 		}
-		err = item.Value(func(val []byte) error {
-			lastHash = string(val)
-			return nil
-		})
 
-		// Get last block to find height
-		itemBlock, err := txn.Get([]byte(lastHash))
+		// Proof of Work
+		stale := func() bool {
+			bc.mu.Lock()
+			defer bc.mu.Unlock()
+			return bc.LastHash != newBlock.PrevHash
+		}
+		if !mineBlock(newBlock, stale) {
+			continue
+		}
+
+		// Our own block goes through the same checks as a peer's block
+		bc.mu.Lock()
+		err = bc.processBlock(newBlock)
+		bc.mu.Unlock()
 		if err != nil {
-			return err
+			log.Panic(err)
 		}
-		err = itemBlock.Value(func(val []byte) error {
-			lastBlock := DeserializeBlock(val)
-			lastHeight = lastBlock.Index
-			return nil
-		})
+		return newBlock
+	}
+}
+
+// newBlockTemplate builds an unmined block on the current tip with the
+// expected target and a coinbase collecting the fees. Callers must hold bc.mu.
+func (bc *Blockchain) newBlockTemplate(minerAddress string) (*Block, error) {
+	lastBlock, err := bc.GetHeader(bc.LastHash)
+	if err != nil {
+		return nil, err
+	}
+	bits, err := bc.nextBits(lastBlock)
+	if err != nil {
+		return nil, err
+	}
+	mtp, err := bc.medianTimePast(lastBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	// Incorporate Mempool (only the txs that are still valid on top of the tip)
+	height := lastBlock.Index + 1
+	selected := bc.selectTransactions(bc.Mempool.Transactions(), height)
+	fees := 0
+	for _, tx := range selected {
+		fees += tx.Fee
+	}
+	coinbase := NewCoinbaseTx(minerAddress, bc.Params.Subsidy(height)+fees, height)
+	txs := append([]*Transaction{coinbase}, selected...)
+
+	newBlock := NewBlock(txs, lastBlock.Hash, height, bits)
+	if newBlock.Timestamp <= mtp {
+		newBlock.Timestamp = mtp + 1
+	}
+	return newBlock, nil
+}
+
+// CheckHeader verifies a header's hash and Proof of Work. These checks need
+// no chain context, so sync runs them before downloading the block body.
+func CheckHeader(h *BlockHeader, params *NetworkParams) error {
+	if h.CalculateHash() != h.Hash {
+		return fmt.Errorf("block hash mismatch for %s", h.Hash)
+	}
+	target := CompactToBig(h.Bits)
+	if target.Sign() <= 0 || target.Cmp(params.PowLimit) > 0 {
+		return fmt.Errorf("block %s has an out-of-range target %08x", h.Hash, h.Bits)
+	}
+	if !meetsTarget(h.Hash, h.Bits) {
+		return fmt.Errorf("block %s does not meet its target %08x", h.Hash, h.Bits)
+	}
+	return nil
+}
+
+// ProcessBlock validates a block received from a peer and stores it. If the
+// block's chain carries more cumulative work than ours, the chain is
+// reorganized onto it; otherwise it is kept as a side branch.
+func (bc *Blockchain) ProcessBlock(b *Block) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.processBlock(b)
+}
+
+// processBlock is ProcessBlock without locking; callers must hold bc.mu.
+func (bc *Blockchain) processBlock(b *Block) error {
+	// 1. Hash integrity and Proof of Work (before using b.Hash as a DB key)
+	if err := CheckHeader(&b.BlockHeader, bc.Params); err != nil {
+		return err
+	}
+
+	// 2. Size limit, and transactions must match the header's Merkle root
+	// without repeats, so the body stored under b.Hash is the miner's
+	if size := len(b.Serialize()); size > MaxBlockSize {
+		return fmt.Errorf("block %s is too large (%d bytes)", b.Hash, size)
+	}
+	if err := CheckMerkleRoot(b); err != nil {
+		return err
+	}
 
+	// 3. Duplicate?
+	if bc.HasBlock(b.Hash) {
+		return ErrBlockKnown
+	}
+
+	// 4. Linkage: the parent must be known (on any branch) and valid
+	parent, err := bc.GetHeader(b.PrevHash)
+	if err != nil {
+		return fmt.Errorf("block %s: %w (%s)", b.Hash, ErrOrphanBlock, b.PrevHash)
+	}
+	if bc.isInvalid(parent.Hash) {
+		bc.markInvalid([]*Block{b})
+		return fmt.Errorf("block %s builds on invalid block %s", b.Hash, parent.Hash)
+	}
+
+	// 5. Height continuity
+	if b.Index != parent.Index+1 {
+		return fmt.Errorf("invalid block index %d, expected %d", b.Index, parent.Index+1)
+	}
+
+	// 6. Target and timestamp must follow the retarget rules for this branch
+	if err := bc.checkHeaderContext(&b.BlockHeader, parent); err != nil {
+		return err
+	}
+
+	// 7. Store with its cumulative work
+	parentWork, err := bc.getWork(parent.Hash)
+	if err != nil {
+		return err
+	}
+	work := new(big.Int).Add(parentWork, blockWork(b.Bits))
+	if err := bc.storeBlock(b, work); err != nil {
+		return err
+	}
+
+	// 8. Fork choice: switch only to strictly heavier chains
+	tipWork, err := bc.getWork(bc.LastHash)
+	if err != nil {
+		return err
+	}
+	if work.Cmp(tipWork) <= 0 {
+		log.Printf("[Blockchain] Stored side-branch block #%d %s", b.Index, b.Hash)
 		return nil
-	})
+	}
+	if err := bc.reorganize(b); err != nil {
+		return err
+	}
+	bc.pruneAfterConnect()
+	return nil
+}
+
+// txContext tracks the effect of transactions earlier in the same block (or
+// already queued in the mempool) on top of the confirmed chain state.
+type txContext struct {
+	height  int             // Height of the block the transactions go in
+	spent   map[string]int  // Amount + fees spent per sender
+	nonces  map[string]int  // Next expected nonce per sender
+	seen    map[string]bool // Tx IDs already included
+	settled map[string]bool // Escrows claimed or refunded, channels closed or settled, deals proven or slashed
+	claimed map[string]int  // Coins claimed per storage deal
+}
+
+func newTxContext(height int) *txContext {
+	return &txContext{
+		height:  height,
+		spent:   make(map[string]int),
+		nonces:  make(map[string]int),
+		seen:    make(map[string]bool),
+		settled: make(map[string]bool),
+		claimed: make(map[string]int),
+	}
+}
+
+// apply records a transaction as included.
+func (c *txContext) apply(tx *Transaction) {
+	c.spent[tx.From] += tx.cost()
+	c.nonces[tx.From] = tx.Nonce + 1
+	c.seen[tx.ID] = true
+	if lockID := settledEscrow(tx); lockID != "" {
+		c.settled[lockID] = true
+	}
+	if channelID := closedChannel(tx); channelID != "" {
+		c.settled[channelID] = true
+	}
+	if dealID := settledDeal(tx); dealID != "" {
+		c.settled[dealID] = true
+	}
+	if dealID := claimedDeal(tx); dealID != "" {
+		c.claimed[dealID] += tx.Amount
+	}
+}
+
+// nextHeight returns the height of the block that would extend the tip.
+// Callers hold bc.mu.
+func (bc *Blockchain) nextHeight() (int, error) {
+	tip, err := bc.GetHeader(bc.LastHash)
 	if err != nil {
-		log.Panic(err)
+		return 0, err
+	}
+	return tip.Index + 1, nil
+}
+
+// validateBlockTransactions checks every transaction in the block against the
+// state at the parent block (which must be our current tip).
+func (bc *Blockchain) validateBlockTransactions(b *Block) error {
+	if err := bc.checkCoinbase(b); err != nil {
+		return err
 	}
 
-	newBlock := NewBlock(txs, lastHash, lastHeight+1)
+	ctx := newTxContext(b.Index)
+	fees := 0
+	for i, tx := range b.Transactions {
+		if ctx.seen[tx.ID] || bc.hasTransaction(tx.ID) {
+			return fmt.Errorf("duplicate transaction %s", tx.ID)
+		}
+		if i == 0 {
+			ctx.seen[tx.ID] = true
+			continue
+		}
+		if err := bc.checkTransaction(tx, ctx); err != nil {
+			return fmt.Errorf("tx %s: %w", tx.ID, err)
+		}
+		fees += tx.Fee
+	}
 
-	// Proof of Work
-	// fmt.Println("⛏️  Mining new block...")
-	MineBlock(newBlock)
-	// fmt.Printf("💎 Block Mined! Hash: %s\n", newBlock.Hash)
+	// The miner may claim exactly the subsidy plus the fees it collected
+	subsidy := bc.Params.Subsidy(b.Index)
+	if reward := b.Transactions[0].Amount; reward != subsidy+fees {
+		return fmt.Errorf("coinbase pays %d, expected subsidy %d + fees %d", reward, subsidy, fees)
+	}
+	return nil
+}
 
-	err = bc.Database.Update(func(txn *badger.Txn) error {
-		// Save Block
-		err := txn.Set([]byte(newBlock.Hash), newBlock.Serialize())
-		if err != nil {
-			return err
+// checkCoinbase enforces the coinbase layout: exactly one reward transaction,
+// first in the block, committing to the block height through its nonce.
+func (bc *Blockchain) checkCoinbase(b *Block) error {
+	if len(b.Transactions) == 0 || b.Transactions[0].From != CoinbaseSender {
+		return fmt.Errorf("block %d does not start with a coinbase", b.Index)
+	}
+	for _, tx := range b.Transactions[1:] {
+		if tx.From == CoinbaseSender {
+			return fmt.Errorf("block %d has more than one coinbase", b.Index)
 		}
+	}
 
-		// Save Last Hash
-		err = txn.Set([]byte("lh"), []byte(newBlock.Hash))
-		bc.LastHash = newBlock.Hash
-
-		// INDEX TRANSACTIONS (Fast Lookup)
-		// Store: "tx_ID" -> SerializedTx (or BlockHash, but Tx is better for quick verification)
-		// For MVP, knowing it exists and amount is enough.
-		for _, tx := range newBlock.Transactions {
-			// simplified serialization for index or just store partial info?
-			// Let's store full BlockHash for reference or just trust validation?
-			// Actually, we need to read the Tx to check Amount/To.
-			// Let's crudely serialize the Tx or rely on finding it.
-			// Storing "tx_<ID>" -> BlockHash allows us to find the block, then find the tx.
-			// OR simpler: "tx_<ID>" -> "Amount:To" string?
-			// Let's go robust: Store the Tx itself? We don't have Tx.Serialize() separate yet.
-			// Let's just index "tx_<ID>" -> "Block_<Hash>"
-			// And implementation of FindTransaction will fetch Block -> find Tx.
-			key := []byte("tx_" + tx.ID)
-			// fmt.Printf("[DEBUG] Indexing Transaction: %s -> Block: %s\n", string(key), newBlock.Hash)
-			err = txn.Set(key, []byte(newBlock.Hash))
-			if err != nil {
-				return err
-			}
+	cb := b.Transactions[0]
+	if cb.Nonce != b.Index || cb.Fee != 0 || cb.isTyped() || cb.ID != cb.CalculateHash() {
+		return fmt.Errorf("malformed coinbase %s in block %d", cb.ID, b.Index)
+	}
+	return nil
+}
+
+// checkTransaction validates a single transfer on top of ctx, and records it
+// in ctx on success.
+func (bc *Blockchain) checkTransaction(tx *Transaction, ctx *txContext) error {
+	if tx.Amount <= 0 {
+		return fmt.Errorf("invalid amount %d", tx.Amount)
+	}
+	if tx.Fee < 0 {
+		return fmt.Errorf("invalid fee %d", tx.Fee)
+	}
+	if err := checkTxType(tx); err != nil {
+		return err
+	}
+	if size := len(tx.Serialize()); size > MaxTxSize {
+		return fmt.Errorf("transaction too large (%d bytes)", size)
+	}
+	if !bc.VerifyTransaction(tx) {
+		return fmt.Errorf("invalid transaction signature")
+	}
+
+	// Replay protection: already confirmed, or not the next nonce in sequence
+	if ctx.seen[tx.ID] || bc.hasTransaction(tx.ID) {
+		return fmt.Errorf("%w: %s is confirmed", ErrTxKnown, tx.ID)
+	}
+	expected, ok := ctx.nonces[tx.From]
+	if !ok {
+		expected = bc.GetNonce(tx.From)
+	}
+	if tx.Nonce != expected {
+		return fmt.Errorf("invalid nonce %d, expected %d", tx.Nonce, expected)
+	}
+
+	if err := bc.checkTxContext(tx, ctx); err != nil {
+		return err
+	}
+	if bc.GetBalance(tx.From)-ctx.spent[tx.From] < tx.cost() {
+		return fmt.Errorf("insufficient funds")
+	}
+	ctx.apply(tx)
+	return nil
+}
+
+// selectTransactions returns the subset of candidates that can be mined
+// together on top of the current tip, taken in the given order (the
+// mempool's fee order) up to MaxBlockTransactions and MaxBlockSize.
+func (bc *Blockchain) selectTransactions(candidates []*Transaction, height int) []*Transaction {
+	var selected []*Transaction
+	ctx := newTxContext(height)
+	size := 1 << 10 // Room for the header and coinbase
+	for _, tx := range candidates {
+		if len(selected) >= MaxBlockTransactions {
+			break
+		}
+		txSize := len(tx.Serialize()) + 4
+		if size+txSize > MaxBlockSize {
+			continue
+		}
+		if err := bc.checkTransaction(tx, ctx); err != nil {
+			log.Printf("[Blockchain] Skipping mempool tx %s: %v", tx.ID, err)
+			continue
+		}
+		selected = append(selected, tx)
+		size += txSize
+	}
+	return selected
+}
+
+// HasBlock reports whether a block is stored (on any branch). Pruned blocks
+// count: their header is still stored.
+func (bc *Blockchain) HasBlock(hash string) bool {
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(hash))
+		if err == badger.ErrKeyNotFound {
+			_, err = txn.Get([]byte(headerPrefix + hash))
 		}
 		return err
 	})
+	return err == nil
+}
+
+// GetTip returns the height and hash of the active chain tip.
+func (bc *Blockchain) GetTip() (int, string, error) {
+	bc.mu.Lock()
+	hash := bc.LastHash
+	bc.mu.Unlock()
+
+	tip, err := bc.GetBlock(hash)
 	if err != nil {
-		log.Panic(err)
+		return 0, "", err
 	}
+	return tip.Index, tip.Hash, nil
+}
 
-	// Clear Mempool
-	bc.Mempool = []*Transaction{}
-
-	return newBlock
+// GetWork returns the cumulative Proof of Work of the chain ending at hash.
+func (bc *Blockchain) GetWork(hash string) (*big.Int, error) {
+	return bc.getWork(hash)
 }
 
-// FindTransaction finds a transaction by ID (requires indexing in AddBlock)
-func (bc *Blockchain) FindTransaction(ID string) (Transaction, error) {
-	var blockHash string
-	var tx Transaction
+// hasTransaction reports whether a tx ID is already in the tx_ index.
+func (bc *Blockchain) hasTransaction(id string) bool {
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("tx_" + id))
+		return err
+	})
+	return err == nil
+}
 
+// GetHeader loads a block header by hash
+func (bc *Blockchain) GetHeader(hash string) (*BlockHeader, error) {
+	var header *BlockHeader
 	err := bc.Database.View(func(txn *badger.Txn) error {
-		key := []byte("tx_" + ID)
-		// fmt.Printf("[DEBUG] Looking up Transaction Key: %s\n", string(key))
-		item, err := txn.Get(key)
+		item, err := txn.Get([]byte(headerPrefix + hash))
 		if err != nil {
 			return err
 		}
 		return item.Value(func(val []byte) error {
-			blockHash = string(val)
-			return nil
+			header, err = DeserializeHeader(val)
+			return err
 		})
 	})
+	if err == badger.ErrKeyNotFound {
+		// Stored before headers were split out
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		return &block.BlockHeader, nil
+	}
+	return header, err
+}
+
+// GetMerkleProof returns an inclusion proof for a confirmed transaction,
+// together with the header of the block that contains it.
+func (bc *Blockchain) GetMerkleProof(txID string) (*MerkleProof, *BlockHeader, error) {
+	blockHash, err := bc.GetTransactionBlockHash(txID)
 	if err != nil {
-		return tx, err
+		return nil, nil, err
 	}
 
-	// Now load the block
+	block, err := bc.GetBlock(blockHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, tx := range block.Transactions {
+		if tx.ID == txID {
+			proof, err := NewMerkleProof(block.Transactions, i)
+			if err != nil {
+				return nil, nil, err
+			}
+			return proof, &block.BlockHeader, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("transaction not found in block index")
+}
+
+// GetBlock loads a block by hash. It returns ErrPruned for a block whose
+// body was pruned.
+func (bc *Blockchain) GetBlock(hash string) (*Block, error) {
 	var block *Block
-	err = bc.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(blockHash))
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(hash))
+		if err == badger.ErrKeyNotFound {
+			if _, herr := txn.Get([]byte(headerPrefix + hash)); herr == nil {
+				return fmt.Errorf("%w: %s", ErrPruned, hash)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			block, err = DeserializeBlock(val)
+			return err
+		})
+	})
+	return block, err
+}
+
+// GetTransactionBlockHash returns the hash of the main-chain block that
+// confirmed a transaction (from the tx_ index).
+func (bc *Blockchain) GetTransactionBlockHash(ID string) (string, error) {
+	var blockHash string
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("tx_" + ID))
 		if err != nil {
 			return err
 		}
 		return item.Value(func(val []byte) error {
-			block = DeserializeBlock(val)
+			blockHash = string(val)
 			return nil
 		})
 	})
+	return blockHash, err
+}
+
+// FindTransaction finds a transaction by ID (requires indexing in AddBlock)
+func (bc *Blockchain) FindTransaction(ID string) (Transaction, error) {
+	var tx Transaction
+
+	blockHash, err := bc.GetTransactionBlockHash(ID)
+	if err != nil {
+		return tx, err
+	}
+
+	// Now load the block
+	block, err := bc.GetBlock(blockHash)
 	if err != nil {
 		return tx, err
 	}
@@ -289,8 +733,8 @@ func (i *Iterator) Next() *Block {
 			return err
 		}
 		err = item.Value(func(val []byte) error {
-			block = DeserializeBlock(val)
-			return nil
+			block, err = DeserializeBlock(val)
+			return err
 		})
 		return err
 	})
@@ -311,31 +755,41 @@ func (bc *Blockchain) GetAddress() string {
 	return ""
 }
 
-// GetBalance replays all transactions to find unspent outputs (Account Model flavor)
+// GetBalance returns the spendable balance of an address (from the account-state
+// table). Immature coinbase rewards are not included.
 func (bc *Blockchain) GetBalance(address string) int {
-	balance := 0
-	iter := bc.Iterator()
+	acc, err := bc.GetAccount(address)
+	if err != nil {
+		log.Printf("[Blockchain] Failed to read account %s: %v", address, err)
+		return 0
+	}
+	return acc.Balance
+}
 
-	for {
-		block := iter.Next()
-		if block == nil {
-			break
-		}
+// GetNonce returns the number of transactions the address has sent on the
+// active chain, which is the nonce its next transaction must carry.
+func (bc *Blockchain) GetNonce(address string) int {
+	acc, err := bc.GetAccount(address)
+	if err != nil {
+		log.Printf("[Blockchain] Failed to read account %s: %v", address, err)
+		return 0
+	}
+	return acc.Nonce
+}
 
-		for _, tx := range block.Transactions {
-			if tx.To == address {
-				balance += tx.Amount
-			}
-			if tx.From == address {
-				balance -= tx.Amount
-			}
-		}
+// NextNonce returns the nonce for a new transaction from address, counting
+// transactions still waiting in the mempool.
+func (bc *Blockchain) NextNonce(address string) int {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 
-		if block.PrevHash == "" || block.PrevHash == "0" {
-			break
+	nonce := bc.GetNonce(address)
+	for _, tx := range bc.Mempool.SenderTransactions(address) {
+		if tx.Nonce >= nonce {
+			nonce = tx.Nonce + 1
 		}
 	}
-	return balance
+	return nonce
 }
 
 // Close closes the underlying DB
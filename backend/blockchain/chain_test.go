@@ -0,0 +1,617 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+// testParams returns testnet rules writing to a fresh temp directory, with
+// the premine paid to premineTo.
+func testParams(t *testing.T, premineTo string) *NetworkParams {
+	t.Helper()
+	p := *TestNetParams
+	p.DataDir = t.TempDir()
+	p.GenesisAddress = premineTo
+	p.GenesisPremine = 1000000
+	p.CoinbaseMaturity = 100
+	return &p
+}
+
+// openChain opens a chain on testParams and closes it when the test ends.
+func openChain(t *testing.T, premineTo string) *Blockchain {
+	t.Helper()
+	return openNode(t, testParams(t, premineTo), "test")
+}
+
+// openNode opens the chain of nodeID, so tests can run several nodes on
+// the same params.
+func openNode(t *testing.T, params *NetworkParams, nodeID string) *Blockchain {
+	t.Helper()
+	bc := InitBlockchain(params, nodeID)
+	t.Cleanup(func() { bc.Database.Close() })
+	return bc
+}
+
+// reopen closes bc and opens the same database again.
+func reopen(t *testing.T, bc *Blockchain) *Blockchain {
+	t.Helper()
+	bc.Close()
+	return openNode(t, bc.Params, "test")
+}
+
+func tipBlock(t *testing.T, bc *Blockchain) *Block {
+	t.Helper()
+	b, err := bc.GetBlock(bc.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func immature(t *testing.T, bc *Blockchain, address string) int {
+	t.Helper()
+	acc, err := bc.GetAccount(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc.Immature
+}
+
+// withCoinbase prepends a coinbase paying "miner" the subsidy and the fees.
+func withCoinbase(bc *Blockchain, height int, txs ...*Transaction) []*Transaction {
+	fees := 0
+	for _, tx := range txs {
+		fees += tx.Fee
+	}
+	return append([]*Transaction{NewCoinbaseTx("miner", bc.Params.Subsidy(height)+fees, height)}, txs...)
+}
+
+// mineOn mines a block on prev without connecting it, so tests can build
+// side branches.
+func mineOn(t *testing.T, bc *Blockchain, prev *Block, txs ...*Transaction) *Block {
+	t.Helper()
+	bits, err := bc.nextBits(&prev.BlockHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBlock(withCoinbase(bc, prev.Index+1, txs...), prev.Hash, prev.Index+1, bits)
+	if b.Timestamp <= prev.Timestamp {
+		b.Timestamp = prev.Timestamp + 1
+	}
+	MineBlock(b)
+	return b
+}
+
+// transfer returns a transaction from w's address signed by w.
+func transfer(t *testing.T, w *wallet.Wallet, to string, amount, nonce int) *Transaction {
+	t.Helper()
+	tx := &Transaction{From: w.Address(), To: to, Amount: amount, Nonce: nonce, Timestamp: 1767225600}
+	if err := tx.Sign(w); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestGenesisIsDeterministic(t *testing.T) {
+	for _, p := range []*NetworkParams{MainNetParams, TestNetParams, RegTestParams} {
+		a, b := p.GenesisBlock(), p.GenesisBlock()
+		if a.Hash != b.Hash {
+			t.Errorf("%s: genesis hash differs between calls", p.Name)
+		}
+		if err := CheckHeader(&a.BlockHeader, p); err != nil {
+			t.Errorf("%s: %v", p.Name, err)
+		}
+		if got, err := ParamsByName(p.Name); err != nil || got != p {
+			t.Errorf("ParamsByName(%q) = %v, %v", p.Name, got, err)
+		}
+	}
+	if _, err := ParamsByName("other"); err == nil {
+		t.Error("unknown network accepted")
+	}
+
+	// Networks never share a database or protocol names
+	if MainNetParams.ChainPath("1") == TestNetParams.ChainPath("1") {
+		t.Error("networks share a database path")
+	}
+	for _, proto := range []func(*NetworkParams) string{
+		(*NetworkParams).SyncProtocol, (*NetworkParams).ComputeProtocol, (*NetworkParams).ChannelProtocol,
+		(*NetworkParams).DealProtocol, (*NetworkParams).ProofProtocol,
+	} {
+		if proto(MainNetParams) == proto(TestNetParams) || proto(TestNetParams) == proto(RegTestParams) {
+			t.Errorf("networks share protocol %s", proto(MainNetParams))
+		}
+	}
+}
+
+func TestRegTestPremine(t *testing.T) {
+	p := *RegTestParams
+	p.DataDir = t.TempDir()
+	bc := openNode(t, &p, "premine")
+
+	w := wallet.FromSeed(RegTestGenesisSeed)
+	if got := bc.GetBalance(w.Address()); got != 1000000 {
+		t.Fatalf("premine balance = %d, want 1000000", got)
+	}
+	tx, err := bc.CreateTransaction(w.Address(), "bob", 5, 1, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("miner")
+	if got := bc.GetBalance("bob"); got != 5 {
+		t.Fatalf("bob = %d, want 5", got)
+	}
+}
+
+func TestProcessBlock(t *testing.T) {
+	alice := wallet.NewWallet()
+	bc := openChain(t, alice.Address())
+	genesis := tipBlock(t, bc)
+
+	mined := func(prevHash string, index int, txs ...*Transaction) *Block {
+		b := NewBlock(withCoinbase(bc, index, txs...), prevHash, index, bc.Params.GenesisBits)
+		b.Timestamp = genesis.Timestamp + 1
+		MineBlock(b)
+		return b
+	}
+	unmined := NewBlock(withCoinbase(bc, 1), genesis.Hash, 1, bc.Params.GenesisBits)
+	unmined.Timestamp = genesis.Timestamp + 1
+	unmined.Hash = unmined.CalculateHash()
+	for meetsTarget(unmined.Hash, unmined.Bits) {
+		unmined.Nonce++
+		unmined.Hash = unmined.CalculateHash()
+	}
+	tampered := mined(genesis.Hash, 1, transfer(t, alice, "bob", 5, 0))
+	tampered.Transactions[1] = transfer(t, alice, "bob", 6, 0)
+	overpaid := mined(genesis.Hash, 1)
+	overpaid.Transactions[0] = NewCoinbaseTx("miner", bc.Params.Subsidy(1)+1, 1)
+	overpaid.MerkleRoot = ComputeMerkleRoot(overpaid.Transactions)
+	MineBlock(overpaid)
+
+	tests := []struct {
+		name  string
+		block *Block
+	}{
+		{"hash mismatch", tampered},
+		{"not on the tip", mined("unknown", 1)},
+		{"wrong index", mined(genesis.Hash, 2)},
+		{"insufficient work", unmined},
+		{"overspend", mined(genesis.Hash, 1, transfer(t, alice, "bob", 600000, 0), transfer(t, alice, "carol", 600000, 1))},
+		{"zero amount", mined(genesis.Hash, 1, transfer(t, alice, "bob", 0, 0))},
+		{"coinbase overpaid", overpaid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := bc.ProcessBlock(tt.block); err == nil {
+				t.Fatal("block accepted")
+			}
+			if bc.LastHash != genesis.Hash {
+				t.Fatal("tip moved")
+			}
+		})
+	}
+
+	b := mined(genesis.Hash, 1, transfer(t, alice, "bob", 400000, 0), transfer(t, alice, "carol", 600000, 1))
+	if err := bc.ProcessBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.ProcessBlock(b); !errors.Is(err, ErrBlockKnown) {
+		t.Fatalf("resubmitted block: got %v, want ErrBlockKnown", err)
+	}
+	if bc.LastHash != b.Hash || bc.GetBalance("bob") != 400000 || bc.GetBalance(alice.Address()) != 0 {
+		t.Fatal("block not applied")
+	}
+	if tx, err := bc.FindTransaction(b.Transactions[2].ID); err != nil || tx.To != "carol" {
+		t.Fatalf("transaction not indexed: %v", err)
+	}
+}
+
+func TestVerifyTransaction(t *testing.T) {
+	alice, mallory := wallet.NewWallet(), wallet.NewWallet()
+	bc := &Blockchain{}
+
+	malloryKey, _ := mallory.PublicKeyHex()
+	tests := []struct {
+		name   string
+		tamper func(tx *Transaction)
+		want   bool
+	}{
+		{"signed by the sender", func(tx *Transaction) {}, true},
+		{"unsigned", func(tx *Transaction) { tx.Signature = "" }, false},
+		{"no public key", func(tx *Transaction) { tx.PublicKey = "" }, false},
+		{"amount changed after signing", func(tx *Transaction) { tx.Amount++ }, false},
+		{"amount and ID changed after signing", func(tx *Transaction) {
+			tx.Amount++
+			tx.ID = tx.CalculateHash()
+		}, false},
+		{"someone else's key", func(tx *Transaction) { tx.PublicKey = malloryKey }, false},
+		{"signature from another tx", func(tx *Transaction) {
+			tx.Signature = transfer(t, alice, "bob", 5, 1).Signature
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := transfer(t, alice, "bob", 5, 0)
+			tt.tamper(tx)
+			if got := bc.VerifyTransaction(tx); got != tt.want {
+				t.Fatalf("VerifyTransaction = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Signing a transaction from someone else's address doesn't help
+	stolen := &Transaction{From: alice.Address(), To: "mallory", Amount: 5}
+	if err := stolen.Sign(mallory); err != nil {
+		t.Fatal(err)
+	}
+	if bc.VerifyTransaction(stolen) {
+		t.Fatal("transaction signed by another wallet accepted")
+	}
+}
+
+func TestAddBlockSkipsInvalidMempoolTransactions(t *testing.T) {
+	alice := wallet.NewWallet()
+	bc := openChain(t, alice.Address())
+	// Added directly, past AddTransaction's balance check
+	bc.Mempool.Add(transfer(t, alice, "bob", 700000, 0))
+	bc.Mempool.Add(transfer(t, alice, "carol", 700000, 1))
+	b := bc.AddBlock("miner")
+	if len(b.Transactions) != 2 || bc.Mempool.Len() != 1 {
+		t.Fatalf("mined %d transactions, %d left pending", len(b.Transactions), bc.Mempool.Len())
+	}
+	if bc.GetBalance("bob") != 700000 {
+		t.Fatal("mined transaction not applied")
+	}
+}
+
+func TestReorgToHeavierBranch(t *testing.T) {
+	alice := wallet.NewWallet()
+	bc := openChain(t, alice.Address())
+	genesis := tipBlock(t, bc)
+	toBob, toDave := transfer(t, alice, "bob", 10, 0), transfer(t, alice, "dave", 5, 1)
+	for _, tx := range []*Transaction{toBob, toDave} {
+		if err := bc.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a1 := bc.AddBlock("miner")
+
+	toCarol := transfer(t, alice, "carol", 20, 0)
+	b1 := mineOn(t, bc, genesis, toCarol)
+	if err := bc.ProcessBlock(b1); err != nil {
+		t.Fatal(err)
+	}
+	if h, hash, _ := bc.GetTip(); h != 1 || hash != a1.Hash {
+		t.Fatal("switched to a branch with equal work")
+	}
+	if !bc.HasBlock(b1.Hash) {
+		t.Fatal("side-branch block not stored")
+	}
+	b2 := mineOn(t, bc, b1)
+	if err := bc.ProcessBlock(b2); err != nil {
+		t.Fatal(err)
+	}
+	if bc.LastHash != b2.Hash {
+		t.Fatal("did not reorganize onto the heavier branch")
+	}
+	workA, errA := bc.GetWork(a1.Hash)
+	workB, errB := bc.GetWork(b2.Hash)
+	if errA != nil || errB != nil || workB.Cmp(workA) <= 0 {
+		t.Fatalf("work: a1 %v (%v), b2 %v (%v)", workA, errA, workB, errB)
+	}
+	if h, _ := bc.GetBlockHashByHeight(1); h != b1.Hash {
+		t.Fatal("height index not moved to the new branch")
+	}
+	if bc.GetBalance("bob") != 0 || bc.GetBalance("carol") != 20 {
+		t.Fatal("balances do not follow the new branch")
+	}
+	if _, err := bc.FindTransaction(toBob.ID); err == nil {
+		t.Fatal("disconnected transaction still indexed")
+	}
+	// toBob lost its nonce to toCarol; toDave can still be mined
+	if bc.Mempool.Len() != 1 || !bc.Mempool.Has(toDave.ID) {
+		t.Fatal("disconnected transactions not returned to the mempool")
+	}
+
+	// The old branch becomes active again once it is heavier
+	a2 := mineOn(t, bc, a1)
+	a3 := mineOn(t, bc, a2)
+	for _, b := range []*Block{a2, a3} {
+		if err := bc.ProcessBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bc.LastHash != a3.Hash || bc.GetBalance("bob") != 10 || bc.GetBalance("carol") != 0 {
+		t.Fatal("did not reorganize back")
+	}
+}
+
+func TestInvalidBranchIsMarked(t *testing.T) {
+	alice := wallet.NewWallet()
+	bc := openChain(t, alice.Address())
+	genesis := tipBlock(t, bc)
+	a1 := bc.AddBlock("miner")
+
+	// The overspend is only found when the branch is connected
+	c1 := mineOn(t, bc, genesis, transfer(t, alice, "bob", 2000000, 0))
+	c2 := mineOn(t, bc, c1)
+	if err := bc.ProcessBlock(c1); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.ProcessBlock(c2); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("got %v, want ErrInvalidBlock", err)
+	}
+	if bc.LastHash != a1.Hash {
+		t.Fatal("tip left the valid chain")
+	}
+	if !bc.isInvalid(c1.Hash) || !bc.isInvalid(c2.Hash) {
+		t.Fatal("invalid branch not marked")
+	}
+	if err := bc.ProcessBlock(mineOn(t, bc, c2)); err == nil {
+		t.Fatal("block on an invalid branch accepted")
+	}
+	if bc.GetBalance(alice.Address()) != 1000000 {
+		t.Fatal("failed reorg changed balances")
+	}
+}
+
+func TestTamperedSignatureDoesNotBlacklistBlock(t *testing.T) {
+	alice := wallet.NewWallet()
+	bc := openChain(t, alice.Address())
+	tx := transfer(t, alice, "bob", 10, 0)
+	b := mineOn(t, bc, tipBlock(t, bc), tx)
+
+	// A relay corrupting the signature changes the Merkle root, so the
+	// block is rejected without its hash being marked invalid
+	relayed, err := DeserializeBlock(b.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed.Transactions[1].Signature = "00|00"
+	if relayed.Transactions[1].ID != tx.ID {
+		t.Fatal("signature changed the transaction ID")
+	}
+	if err := bc.ProcessBlock(relayed); err == nil {
+		t.Fatal("block with a corrupted signature accepted")
+	}
+	if bc.isInvalid(b.Hash) {
+		t.Fatal("valid block hash blacklisted")
+	}
+	if err := bc.ProcessBlock(b); err != nil {
+		t.Fatalf("original block rejected: %v", err)
+	}
+}
+
+func TestMutatedBlockIsNotStored(t *testing.T) {
+	alice := wallet.NewWallet()
+	bc := openChain(t, alice.Address())
+	b := mineOn(t, bc, tipBlock(t, bc), transfer(t, alice, "bob", 10, 0), transfer(t, alice, "bob", 10, 1))
+
+	// Repeating the odd last transaction keeps the Merkle root and so the
+	// hash; the copy fails validation, but the miner's block must not
+	relayed, err := DeserializeBlock(b.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed.Transactions = append(relayed.Transactions, relayed.Transactions[2])
+	if ComputeMerkleRoot(relayed.Transactions) != b.MerkleRoot {
+		t.Fatal("repeating the last transaction changed the Merkle root")
+	}
+	if err := bc.ProcessBlock(relayed); err == nil {
+		t.Fatal("mutated block accepted")
+	}
+	if bc.HasBlock(b.Hash) || bc.isInvalid(b.Hash) {
+		t.Fatal("mutated body stored or its hash blacklisted")
+	}
+	if err := bc.ProcessBlock(b); err != nil {
+		t.Fatalf("original block rejected: %v", err)
+	}
+	if bc.LastHash != b.Hash {
+		t.Fatal("original block not connected")
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	alice := wallet.NewWallet()
+	bc := openChain(t, alice.Address())
+	genesis := tipBlock(t, bc)
+
+	tx0 := transfer(t, alice, "bob", 10, 0)
+	if err := bc.AddTransaction(tx0); err != nil {
+		t.Fatal(err)
+	}
+	if n := bc.NextNonce(alice.Address()); n != 1 {
+		t.Fatalf("NextNonce = %d, want 1", n)
+	}
+	rejected := []struct {
+		name string
+		tx   *Transaction
+		want error // nil means any error
+	}{
+		{"already pending", tx0, ErrTxKnown},
+		{"nonce reused", transfer(t, alice, "carol", 10, 0), nil},
+		{"nonce gap", transfer(t, alice, "bob", 10, 2), nil},
+	}
+	for _, tt := range rejected {
+		err := bc.AddTransaction(tt.tx)
+		if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	b1 := bc.AddBlock("miner")
+	if len(b1.Transactions) != 2 || bc.GetNonce(alice.Address()) != 1 {
+		t.Fatal("transaction not mined")
+	}
+	if err := bc.AddTransaction(tx0); !errors.Is(err, ErrTxKnown) {
+		t.Fatalf("confirmed transaction: got %v, want ErrTxKnown", err)
+	}
+
+	// A block replaying the confirmed transaction is rejected
+	if err := bc.ProcessBlock(mineOn(t, bc, b1, tx0)); err == nil {
+		t.Fatal("block replaying a confirmed transaction accepted")
+	}
+	// So is one that includes the same transaction twice
+	if err := bc.ProcessBlock(mineOn(t, bc, b1, transfer(t, alice, "bob", 1, 1), transfer(t, alice, "bob", 1, 1))); err == nil {
+		t.Fatal("block with a duplicate transaction accepted")
+	}
+	// On a branch without it, the same transaction is valid again
+	x1 := mineOn(t, bc, genesis)
+	x2 := mineOn(t, bc, x1, tx0)
+	for _, b := range []*Block{x1, x2} {
+		if err := bc.ProcessBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bc.LastHash != x2.Hash {
+		t.Fatal("branch re-including the transaction not followed")
+	}
+}
+
+func TestAccountEncoding(t *testing.T) {
+	for _, acc := range []AccountState{{}, {Balance: 1000000, Nonce: 3}, {Balance: -5, Nonce: 1 << 40, Immature: 50}} {
+		got, err := decodeAccount(encodeAccount(acc))
+		if err != nil || got != acc {
+			t.Errorf("round trip of %+v: got %+v, %v", acc, got, err)
+		}
+	}
+	for _, data := range [][]byte{nil, {0x80}, encodeAccount(AccountState{Balance: 1})[:1], {0x02, 0x02, 0x80}} {
+		if _, err := decodeAccount(data); err == nil {
+			t.Errorf("decoded corrupt account %x", data)
+		}
+	}
+	// Entries written before maturity tracking have no immature balance
+	if got, err := decodeAccount([]byte{0x04, 0x02}); err != nil || got != (AccountState{Balance: 2, Nonce: 1}) {
+		t.Errorf("old entry decoded as %+v, %v", got, err)
+	}
+}
+
+func TestAccountStateFollowsReorgs(t *testing.T) {
+	alice := wallet.NewWallet()
+	bc := openChain(t, alice.Address())
+	genesis := tipBlock(t, bc)
+	a1 := mineOn(t, bc, genesis, transfer(t, alice, "bob", 10, 0), transfer(t, alice, "carol", 5, 1))
+	if err := bc.ProcessBlock(a1); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]AccountState{
+		alice.Address(): {Balance: 1000000 - 15, Nonce: 2},
+		"bob":           {Balance: 10},
+		"carol":         {Balance: 5},
+	}
+	check := func(when string) {
+		t.Helper()
+		for addr, acc := range want {
+			if got, err := bc.GetAccount(addr); err != nil || got != acc {
+				t.Fatalf("%s: account %s = %+v, want %+v (%v)", when, addr, got, acc, err)
+			}
+		}
+	}
+	check("after connect")
+
+	// Reorg onto a branch that only pays carol
+	b1 := mineOn(t, bc, genesis, transfer(t, alice, "carol", 7, 0))
+	b2 := mineOn(t, bc, b1)
+	for _, b := range []*Block{b1, b2} {
+		if err := bc.ProcessBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want = map[string]AccountState{
+		alice.Address(): {Balance: 1000000 - 7, Nonce: 1},
+		"bob":           {},
+		"carol":         {Balance: 7},
+	}
+	check("after reorg")
+
+	if err := bc.ReindexState(); err != nil {
+		t.Fatal(err)
+	}
+	check("after reindex")
+
+	bc = reopen(t, bc)
+	check("after reopen")
+}
+
+func TestCoinbaseMaturityAndHalving(t *testing.T) {
+	bc := openChain(t, "genesis")
+	params := *bc.Params
+	params.HalvingInterval = 4
+	params.CoinbaseMaturity = 3
+	bc.Params = &params
+	for i := 1; i <= 9; i++ {
+		bc.AddBlock("m")
+	}
+
+	// Rewards: #1-3 pay 50, #4-7 pay 25, #8-9 pay 12; #1-6 have matured
+	want := AccountState{Balance: 50*3 + 25*3, Immature: 25 + 12 + 12}
+	acc, err := bc.GetAccount("m")
+	if err != nil || acc != want {
+		t.Fatalf("account = %+v (%v), want %+v", acc, err, want)
+	}
+	if err := bc.ReindexState(); err != nil {
+		t.Fatal(err)
+	}
+	if acc, _ := bc.GetAccount("m"); acc != want {
+		t.Fatalf("after reindex = %+v, want %+v", acc, want)
+	}
+
+	// Replacing #8-9 with three blocks to "miner" also undoes maturities
+	h7, _ := bc.GetBlockHashByHeight(7)
+	prev, _ := bc.GetBlock(h7)
+	for i := 0; i < 3; i++ {
+		next := mineOn(t, bc, prev)
+		if err := bc.ProcessBlock(next); err != nil {
+			t.Fatal(err)
+		}
+		prev = next
+	}
+	acc, _ = bc.GetAccount("m")
+	if acc.Balance != 250 || acc.Immature != 0 || immature(t, bc, "miner") != 12+12+12 {
+		t.Fatalf("after reorg m = %+v, miner immature = %d", acc, immature(t, bc, "miner"))
+	}
+
+	// Immature rewards can't be spent
+	w := wallet.NewWallet()
+	bc.AddBlock(w.Address())
+	tx, err := bc.CreateTransaction(w.Address(), "x", 1, 0, w)
+	if err == nil {
+		err = bc.AddTransaction(tx)
+	}
+	if err == nil {
+		t.Fatal("spent an immature reward")
+	}
+}
+
+func TestCoinbaseRules(t *testing.T) {
+	bc := openChain(t, "genesis")
+	tip := tipBlock(t, bc)
+
+	tests := []struct {
+		name  string
+		build func(b *Block)
+	}{
+		{"no coinbase", func(b *Block) { b.Transactions = b.Transactions[1:] }},
+		{"wrong height nonce", func(b *Block) { b.Transactions[0] = NewCoinbaseTx("m", bc.Params.Subsidy(1), 7) }},
+		{"two coinbases", func(b *Block) { b.Transactions = append(b.Transactions, NewCoinbaseTx("n", 0, 1)) }},
+		{"coinbase with a fee", func(b *Block) {
+			b.Transactions[0].Fee = 1
+			b.Transactions[0].ID = b.Transactions[0].CalculateHash()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := mineOn(t, bc, tip)
+			tt.build(b)
+			b.MerkleRoot = ComputeMerkleRoot(b.Transactions)
+			MineBlock(b)
+			if err := bc.ProcessBlock(b); err == nil {
+				t.Fatal("block accepted")
+			}
+		})
+	}
+}
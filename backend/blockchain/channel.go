@@ -0,0 +1,456 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"decentralized-net/wallet"
+)
+
+// Unidirectional payment channels. A TxChannelOpen locks Amount from the
+// payer (From) for the payee (To). The payer then pays off-chain by signing
+// ChannelUpdates with a growing cumulative Paid, and the payee keeps the
+// latest one. The channel is closed on-chain with a TxChannelClose:
+//
+//   - from the payee, carrying its latest update: pays out at once.
+//   - from the payer: starts the dispute window, during which the payee can
+//     still close with a higher update. Once it has passed, a
+//     TxChannelSettle pays out what the payer's close claimed.
+//
+// Close and settle transactions send to themselves and carry the channel
+// deposit as Amount, like escrow claims; the payout goes to both parties.
+//
+// Open channels are part of the account state:
+//
+//	"chan_<openTxID>" -> Channel
+//
+// Payees keep the latest update they accepted as node-local bookkeeping:
+//
+//	"chanpay_<openTxID>" -> ChannelUpdate
+const (
+	channelPrefix        = "chan_"
+	channelPaymentPrefix = "chanpay_"
+)
+
+// MaxDisputeWindow caps the dispute window of a channel, in blocks.
+const MaxDisputeWindow = 10000
+
+// ErrNoChannel is returned when a channel doesn't exist or was already settled.
+var ErrNoChannel = errors.New("no open channel")
+
+// Channel is an open payment channel, keyed by the ID of its open transaction.
+type Channel struct {
+	ID            string
+	From          string // Payer, who signs updates
+	To            string // Payee, who holds them
+	PublicKey     string // Payer key that signs updates
+	Deposit       int
+	DisputeWindow int // Blocks the payee has to answer a payer close
+	Paid          int // Claimed by the payer's close
+	CloseHeight   int // Height of the payer's close, 0 while open
+}
+
+// Closing reports whether the payer has started a unilateral close.
+func (ch *Channel) Closing() bool {
+	return ch.CloseHeight > 0
+}
+
+// ChannelUpdate is an off-chain payment: the payer's signature over the
+// cumulative amount paid to the payee so far.
+type ChannelUpdate struct {
+	ChannelID string
+	Paid      int
+	Signature string
+}
+
+// ChannelUpdateHash is what the payer signs for an update.
+func ChannelUpdateHash(channelID string, paid int) []byte {
+	e := &encoder{}
+	e.putString("channel-update")
+	e.putString(channelID)
+	e.putInt(paid)
+	hash := sha256.Sum256(e.buf)
+	return hash[:]
+}
+
+// SignChannelUpdate signs a payment of paid coins in total over a channel.
+func SignChannelUpdate(channelID string, paid int, w *wallet.Wallet) (*ChannelUpdate, error) {
+	sig, err := w.Sign(ChannelUpdateHash(channelID, paid))
+	if err != nil {
+		return nil, err
+	}
+	return &ChannelUpdate{ChannelID: channelID, Paid: paid, Signature: sig}, nil
+}
+
+// VerifyUpdate checks that u is an update of this channel the payer signed
+// and that the deposit covers it. A zero update needs no signature.
+func (ch *Channel) VerifyUpdate(u *ChannelUpdate) error {
+	if u.ChannelID != ch.ID {
+		return fmt.Errorf("update is for channel %s, not %s", u.ChannelID, ch.ID)
+	}
+	if u.Paid < 0 || u.Paid > ch.Deposit {
+		return fmt.Errorf("update pays %d out of a %d deposit", u.Paid, ch.Deposit)
+	}
+	if u.Paid == 0 {
+		return nil
+	}
+	pub, err := wallet.DecodePublicKey(ch.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !wallet.VerifySignature(pub, ChannelUpdateHash(ch.ID, u.Paid), u.Signature) {
+		return fmt.Errorf("invalid update signature for channel %s", ch.ID)
+	}
+	return nil
+}
+
+// ChannelOpenPayload builds the payload of a TxChannelOpen.
+func ChannelOpenPayload(disputeWindow int) []byte {
+	e := &encoder{}
+	e.putInt(disputeWindow)
+	return e.buf
+}
+
+// ChannelClosePayload builds the payload of a TxChannelClose.
+func ChannelClosePayload(u *ChannelUpdate) []byte {
+	e := &encoder{}
+	e.putString(u.ChannelID)
+	e.putInt(u.Paid)
+	e.putString(u.Signature)
+	return e.buf
+}
+
+// ChannelSettlePayload builds the payload of a TxChannelSettle.
+func ChannelSettlePayload(channelID string) []byte {
+	e := &encoder{}
+	e.putString(channelID)
+	return e.buf
+}
+
+func decodeOpenPayload(payload []byte) (disputeWindow int, err error) {
+	d := &decoder{data: payload}
+	disputeWindow = d.readInt("dispute window")
+	return disputeWindow, d.finish("open payload")
+}
+
+func decodeClosePayload(payload []byte) (*ChannelUpdate, error) {
+	d := &decoder{data: payload}
+	u := &ChannelUpdate{
+		ChannelID: d.readString("channel id"),
+		Paid:      d.readInt("paid"),
+		Signature: d.readString("signature"),
+	}
+	return u, d.finish("close payload")
+}
+
+func decodeSettlePayload(payload []byte) (channelID string, err error) {
+	d := &decoder{data: payload}
+	channelID = d.readString("channel id")
+	return channelID, d.finish("settle payload")
+}
+
+// closedChannel returns the channel a close or settle acts on.
+func closedChannel(tx *Transaction) string {
+	switch tx.Type {
+	case TxChannelClose:
+		u, _ := decodeClosePayload(tx.Payload)
+		return u.ChannelID
+	case TxChannelSettle:
+		channelID, _ := decodeSettlePayload(tx.Payload)
+		return channelID
+	}
+	return ""
+}
+
+// checkChannelPayload validates the stateless parts of a channel transaction.
+func checkChannelPayload(tx *Transaction) error {
+	switch tx.Type {
+	case TxChannelOpen:
+		window, err := decodeOpenPayload(tx.Payload)
+		if err != nil {
+			return err
+		}
+		if window < 1 || window > MaxDisputeWindow {
+			return fmt.Errorf("dispute window must be 1 to %d blocks, got %d", MaxDisputeWindow, window)
+		}
+		if tx.To == "" || tx.To == tx.From {
+			return fmt.Errorf("channel must pay another address")
+		}
+		// Updates are checked against a single payer key
+		if wallet.IsMultisigScript(tx.PublicKey) {
+			return fmt.Errorf("multisig addresses can't open channels")
+		}
+		return nil
+	case TxChannelClose:
+		u, err := decodeClosePayload(tx.Payload)
+		if err != nil {
+			return err
+		}
+		if u.Paid < 0 {
+			return fmt.Errorf("invalid channel payment %d", u.Paid)
+		}
+	case TxChannelSettle:
+		if _, err := decodeSettlePayload(tx.Payload); err != nil {
+			return err
+		}
+	}
+	if tx.To != tx.From {
+		return fmt.Errorf("channel %s must pay its sender", tx.Type)
+	}
+	return nil
+}
+
+// checkChannelContext validates a channel transaction against the channels
+// open at the tip and those already closed or settled in ctx.
+func (bc *Blockchain) checkChannelContext(tx *Transaction, ctx *txContext) error {
+	if tx.Type == TxChannelOpen {
+		return nil
+	}
+
+	channelID := closedChannel(tx)
+	if ctx.settled[channelID] {
+		return fmt.Errorf("channel %s was already closed in this block", channelID)
+	}
+	ch, err := bc.GetChannel(channelID)
+	if err != nil {
+		return err
+	}
+	if tx.Amount != ch.Deposit {
+		return fmt.Errorf("channel %s holds %d, not %d", channelID, ch.Deposit, tx.Amount)
+	}
+	if tx.From != ch.From && tx.From != ch.To {
+		return fmt.Errorf("%s is not a party to channel %s", tx.From, channelID)
+	}
+
+	switch tx.Type {
+	case TxChannelClose:
+		u, _ := decodeClosePayload(tx.Payload)
+		if err := ch.VerifyUpdate(u); err != nil {
+			return err
+		}
+		if tx.From == ch.From && ch.Closing() {
+			return fmt.Errorf("channel %s is already closing", channelID)
+		}
+	case TxChannelSettle:
+		if !ch.Closing() {
+			return fmt.Errorf("channel %s has not been closed", channelID)
+		}
+		if end := ch.CloseHeight + ch.DisputeWindow; ctx.height < end {
+			return fmt.Errorf("channel %s is in its dispute window until height %d", channelID, end)
+		}
+	}
+	return nil
+}
+
+func encodeChannel(ch *Channel) []byte {
+	e := &encoder{}
+	e.putString(ch.From)
+	e.putString(ch.To)
+	e.putString(ch.PublicKey)
+	e.putInt(ch.Deposit)
+	e.putInt(ch.DisputeWindow)
+	e.putInt(ch.Paid)
+	e.putInt(ch.CloseHeight)
+	return e.buf
+}
+
+func decodeChannel(id string, data []byte) (*Channel, error) {
+	d := &decoder{data: data}
+	ch := &Channel{
+		ID:            id,
+		From:          d.readString("from"),
+		To:            d.readString("to"),
+		PublicKey:     d.readString("public key"),
+		Deposit:       d.readInt("deposit"),
+		DisputeWindow: d.readInt("dispute window"),
+		Paid:          d.readInt("paid"),
+		CloseHeight:   d.readInt("close height"),
+	}
+	if err := d.finish("channel"); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// applyChannel opens, closes or settles the channel of a connected
+// transaction at height. The sender has already been charged tx.cost().
+func (st *stateTxn) applyChannel(tx *Transaction, height int) error {
+	if tx.Type == TxChannelOpen {
+		window, err := decodeOpenPayload(tx.Payload)
+		if err != nil {
+			return err
+		}
+		ch := &Channel{From: tx.From, To: tx.To, PublicKey: tx.PublicKey, Deposit: tx.Amount, DisputeWindow: window}
+		return st.set([]byte(channelPrefix+tx.ID), encodeChannel(ch))
+	}
+
+	channelID := closedChannel(tx)
+	key := []byte(channelPrefix + channelID)
+	val, err := st.get(key)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return fmt.Errorf("%w: %s", ErrNoChannel, channelID)
+	}
+	ch, err := decodeChannel(channelID, val)
+	if err != nil {
+		return err
+	}
+
+	if tx.Type == TxChannelClose {
+		u, err := decodeClosePayload(tx.Payload)
+		if err != nil {
+			return err
+		}
+		if tx.From == ch.From {
+			// Unilateral close: wait out the dispute window
+			ch.Paid = u.Paid
+			ch.CloseHeight = height
+			return st.set(key, encodeChannel(ch))
+		}
+		// The payee's close is final; it can only raise what the payer claimed
+		ch.Paid = max(ch.Paid, u.Paid)
+	}
+
+	if err := st.del(key); err != nil {
+		return err
+	}
+	if err := st.credit(ch.To, ch.Paid); err != nil {
+		return err
+	}
+	return st.credit(ch.From, ch.Deposit-ch.Paid)
+}
+
+// GetChannel returns an open channel by the ID of its open transaction.
+func (bc *Blockchain) GetChannel(channelID string) (*Channel, error) {
+	var ch *Channel
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(channelPrefix + channelID))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w: %s", ErrNoChannel, channelID)
+		}
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		ch, err = decodeChannel(channelID, val)
+		return err
+	})
+	return ch, err
+}
+
+// AcceptChannelPayment checks that u pays at least minIncrement more than the
+// last update accepted over an open channel to payee whose dispute window is
+// at least minWindow blocks, and stores it as the latest. It returns the
+// increment. The check and the store happen in one Badger transaction.
+func (bc *Blockchain) AcceptChannelPayment(u *ChannelUpdate, payee string, minIncrement, minWindow int) (int, error) {
+	ch, err := bc.GetChannel(u.ChannelID)
+	if err != nil {
+		return 0, err
+	}
+	if ch.To != payee {
+		return 0, fmt.Errorf("channel %s pays %s, not this worker", ch.ID, ch.To)
+	}
+	if ch.Closing() {
+		return 0, fmt.Errorf("channel %s is closing", ch.ID)
+	}
+	if ch.DisputeWindow < minWindow {
+		return 0, fmt.Errorf("channel %s has a %d-block dispute window, need %d", ch.ID, ch.DisputeWindow, minWindow)
+	}
+	if err := ch.VerifyUpdate(u); err != nil {
+		return 0, err
+	}
+
+	increment := 0
+	err = bc.Database.Update(func(txn *badger.Txn) error {
+		key := []byte(channelPaymentPrefix + u.ChannelID)
+		previous := 0
+		item, err := txn.Get(key)
+		switch {
+		case err == nil:
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			last, err := decodeChannelUpdate(val)
+			if err != nil {
+				return err
+			}
+			previous = last.Paid
+		case err != badger.ErrKeyNotFound:
+			return err
+		}
+
+		increment = u.Paid - previous
+		if increment < minIncrement {
+			return fmt.Errorf("update to %d pays %d on top of %d, need %d", u.Paid, increment, previous, minIncrement)
+		}
+		return txn.Set(key, encodeChannelUpdate(u))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return increment, nil
+}
+
+// ChannelPayments returns the latest update this node accepted on every
+// channel it was paid through, for closing them.
+func (bc *Blockchain) ChannelPayments() ([]*ChannelUpdate, error) {
+	var updates []*ChannelUpdate
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(channelPaymentPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			u, err := decodeChannelUpdate(val)
+			if err != nil {
+				return err
+			}
+			updates = append(updates, u)
+		}
+		return nil
+	})
+	return updates, err
+}
+
+// LatestChannelPayment returns the latest update this node accepted on a channel.
+func (bc *Blockchain) LatestChannelPayment(channelID string) (*ChannelUpdate, error) {
+	var u *ChannelUpdate
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(channelPaymentPrefix + channelID))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("no payment received over channel %s", channelID)
+		}
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		u, err = decodeChannelUpdate(val)
+		return err
+	})
+	return u, err
+}
+
+func encodeChannelUpdate(u *ChannelUpdate) []byte {
+	return ChannelClosePayload(u)
+}
+
+func decodeChannelUpdate(data []byte) (*ChannelUpdate, error) {
+	return decodeClosePayload(data)
+}
@@ -0,0 +1,125 @@
+package blockchain
+
+import (
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func TestChannelPayments(t *testing.T) {
+	payer, payee := wallet.NewWallet(), wallet.NewWallet()
+	bc := openChain(t, payer.Address())
+
+	open, err := bc.CreateTypedTransaction(payer.Address(), payee.Address(), 100, 1, TxChannelOpen, ChannelOpenPayload(3), payer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(open); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #1
+	ch, err := bc.GetChannel(open.ID)
+	if err != nil || ch.Deposit != 100 || ch.Closing() {
+		t.Fatalf("channel = %+v, %v", ch, err)
+	}
+
+	u5, _ := SignChannelUpdate(open.ID, 5, payer)
+	if inc, err := bc.AcceptChannelPayment(u5, payee.Address(), 5, 3); err != nil || inc != 5 {
+		t.Fatalf("first update: %d, %v", inc, err)
+	}
+
+	forged, _ := SignChannelUpdate(open.ID, 50, payee)
+	over, _ := SignChannelUpdate(open.ID, 101, payer)
+	rejected := []struct {
+		name   string
+		update *ChannelUpdate
+		window int
+	}{
+		{"replayed update", u5, 3},
+		{"closing window too short", u5, 4},
+		{"signed by the payee", forged, 3},
+		{"more than the deposit", over, 3},
+	}
+	for _, tt := range rejected {
+		if _, err := bc.AcceptChannelPayment(tt.update, payee.Address(), 5, tt.window); err == nil {
+			t.Errorf("%s accepted", tt.name)
+		}
+	}
+
+	u30, _ := SignChannelUpdate(open.ID, 30, payer)
+	if _, err := bc.AcceptChannelPayment(u30, payee.Address(), 5, 3); err != nil {
+		t.Fatal(err)
+	}
+	if latest, _ := bc.LatestChannelPayment(open.ID); latest.Paid != 30 {
+		t.Fatalf("latest update pays %d, want 30", latest.Paid)
+	}
+
+	typed := func(w *wallet.Wallet, amount int, typ TxType, payload []byte) *Transaction {
+		t.Helper()
+		tx, err := bc.CreateTypedTransaction(w.Address(), w.Address(), amount, 0, typ, payload, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	// The payer closes with a stale update...
+	if err := bc.AddTransaction(typed(payer, 100, TxChannelClose, ChannelClosePayload(u5))); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #2
+	ch, _ = bc.GetChannel(open.ID)
+	if !ch.Closing() || ch.Paid != 5 || ch.CloseHeight != 2 {
+		t.Fatalf("closing channel = %+v", ch)
+	}
+	if err := bc.AddTransaction(typed(payer, 100, TxChannelSettle, ChannelSettlePayload(open.ID))); err == nil {
+		t.Fatal("settled before the window passed")
+	}
+	if err := bc.AddTransaction(typed(payer, 100, TxChannelClose, ChannelClosePayload(u30))); err == nil {
+		t.Fatal("payer closed twice")
+	}
+
+	// ...and the payee disputes with the latest one, which pays out at once
+	before := bc.GetBalance(payer.Address())
+	if err := bc.AddTransaction(typed(payee, 100, TxChannelClose, ChannelClosePayload(u30))); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #3
+	if bc.GetBalance(payee.Address()) != 30 || bc.GetBalance(payer.Address()) != before+70 {
+		t.Fatal("dispute did not pay out the latest update")
+	}
+	if _, err := bc.GetChannel(open.ID); err == nil {
+		t.Fatal("channel still open")
+	}
+
+	// An uncontested close settles after the window
+	open2, _ := bc.CreateTypedTransaction(payer.Address(), payee.Address(), 50, 0, TxChannelOpen, ChannelOpenPayload(2), payer)
+	if err := bc.AddTransaction(open2); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #4
+	if err := bc.AddTransaction(typed(payer, 50, TxChannelClose, ChannelClosePayload(&ChannelUpdate{ChannelID: open2.ID}))); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #5: closing, settles from #7
+	bc.AddBlock("m") // #6
+	if err := bc.AddTransaction(typed(payer, 50, TxChannelSettle, ChannelSettlePayload(open2.ID))); err != nil {
+		t.Fatal(err)
+	}
+	before = bc.GetBalance(payer.Address())
+	bc.AddBlock("m") // #7
+	if bc.GetBalance(payer.Address()) != before+50 {
+		t.Fatal("settle did not refund the deposit")
+	}
+
+	if err := bc.ReindexState(); err != nil {
+		t.Fatal(err)
+	}
+	if bc.GetBalance(payee.Address()) != 30 || bc.GetBalance(payer.Address()) != before+50 {
+		t.Fatal("replayed state differs")
+	}
+	self, _ := bc.CreateTypedTransaction(payer.Address(), payer.Address(), 5, 0, TxChannelOpen, ChannelOpenPayload(2), payer)
+	if err := bc.AddTransaction(self); err == nil {
+		t.Fatal("channel to oneself accepted")
+	}
+}
@@ -0,0 +1,477 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"decentralized-net/wallet"
+)
+
+// Storage deals. A TxStorageDeal records that the provider (To) keeps a
+// shard for the client (From) for Duration blocks, and escrows the price
+// (Amount) for it. The provider signs the terms when it accepts the shard,
+// so a deal can't be put on a provider that never agreed to it.
+//
+// The deal runs in proof periods of DealProofPeriod blocks from its height,
+// each worth its share of the price. A TxStorageProof answering a period's
+// challenge (see storageproof.go) releases that share to the provider, who
+// takes it with TxDealClaim transactions (sent to itself, Amount being the
+// coins claimed). A period that passes without a proof is missed: a
+// TxDealSlash from the client, or the provider's next proof, refunds its
+// share to the client. Proofs and slashes carry the deal price as Amount,
+// like channel closes. A deal is removed once every period is settled and
+// everything it released has been claimed.
+//
+// Active deals are part of the account state:
+//
+//	"deal_<dealTxID>" -> StorageDeal
+const dealPrefix = "deal_"
+
+// MaxDealDuration caps the length of a storage deal, in blocks.
+const MaxDealDuration = 1000000
+
+// ErrNoDeal is returned when a deal doesn't exist or was fully paid out.
+var ErrNoDeal = errors.New("no active storage deal")
+
+// DealProposal is the terms of a storage deal, signed by the provider.
+type DealProposal struct {
+	Client    string
+	Provider  string
+	ShardKey  string
+	ShardRoot []byte // Merkle root of the shard's chunks, see ShardRoot
+	Size      int    // Shard size in bytes
+	Duration  int    // Blocks the provider keeps the shard for
+	Price     int    // Total paid over Duration
+}
+
+// Hash is what the provider signs to accept a proposal.
+func (p *DealProposal) Hash() []byte {
+	e := &encoder{}
+	e.putString("storage-deal")
+	e.putString(p.Client)
+	e.putString(p.Provider)
+	e.putString(p.ShardKey)
+	e.putBytes(p.ShardRoot)
+	e.putInt(p.Size)
+	e.putInt(p.Duration)
+	e.putInt(p.Price)
+	hash := sha256.Sum256(e.buf)
+	return hash[:]
+}
+
+// StorageDeal is an active deal, keyed by the ID of its deal transaction.
+type StorageDeal struct {
+	ID        string
+	Client    string
+	Provider  string
+	ShardKey  string
+	ShardRoot []byte
+	Size      int
+	Start     int // Height of the deal transaction
+	Duration  int
+	Price     int
+	Proven    int // Periods proven
+	Missed    int // Periods refunded to the client for lack of a proof
+	Earned    int // Released to the provider by its proofs
+	Claimed   int // Paid out to the provider so far
+}
+
+// End is the height at which the deal's term ends.
+func (d *StorageDeal) End() int {
+	return d.Start + d.Duration
+}
+
+// Periods returns the number of proof periods of the deal.
+func (d *StorageDeal) Periods() int {
+	return (d.Duration + DealProofPeriod - 1) / DealProofPeriod
+}
+
+// Settled returns the number of periods already proven or missed; the next
+// period to settle has this index.
+func (d *StorageDeal) Settled() int {
+	return d.Proven + d.Missed
+}
+
+// ChallengeHeight is the block whose hash picks the chunk of a period.
+func (d *StorageDeal) ChallengeHeight(period int) int {
+	return d.Start + period*DealProofPeriod
+}
+
+// PeriodAt returns the period a proof in a block at height answers: the
+// blocks after a period's ChallengeHeight, up to the next one.
+func (d *StorageDeal) PeriodAt(height int) int {
+	if height <= d.Start {
+		return -1
+	}
+	return (height - d.Start - 1) / DealProofPeriod
+}
+
+// PeriodShare returns the part of the price a period is worth.
+func (d *StorageDeal) PeriodShare(period int) int {
+	paidThrough := func(p int) int {
+		return d.Price * min(p*DealProofPeriod, d.Duration) / d.Duration
+	}
+	return paidThrough(period+1) - paidThrough(period)
+}
+
+// Claimable returns what the provider's proofs released and it hasn't claimed.
+func (d *StorageDeal) Claimable() int {
+	return d.Earned - d.Claimed
+}
+
+// done reports whether nothing is left to prove, refund or claim.
+func (d *StorageDeal) done() bool {
+	return d.Settled() >= d.Periods() && d.Claimed >= d.Earned
+}
+
+// StorageDealPayload builds the payload of a TxStorageDeal from a proposal
+// and the provider's hex public key and signature of its Hash.
+func StorageDealPayload(p *DealProposal, providerKey, providerSig string) []byte {
+	e := &encoder{}
+	e.putString(p.ShardKey)
+	e.putBytes(p.ShardRoot)
+	e.putInt(p.Size)
+	e.putInt(p.Duration)
+	e.putString(providerKey)
+	e.putString(providerSig)
+	return e.buf
+}
+
+// DealClaimPayload builds the payload of a TxDealClaim.
+func DealClaimPayload(dealID string) []byte {
+	e := &encoder{}
+	e.putString(dealID)
+	return e.buf
+}
+
+// decodeDealPayload returns the proposal a deal transaction carries, with
+// the provider's key and signature.
+func decodeDealPayload(tx *Transaction) (p *DealProposal, providerKey, providerSig string, err error) {
+	d := &decoder{data: tx.Payload}
+	p = &DealProposal{
+		Client:    tx.From,
+		Provider:  tx.To,
+		ShardKey:  d.readString("shard key"),
+		ShardRoot: d.readBytes(maxFieldLen, "shard root"),
+		Size:      d.readInt("size"),
+		Duration:  d.readInt("duration"),
+		Price:     tx.Amount,
+	}
+	providerKey = d.readString("provider key")
+	providerSig = d.readString("provider signature")
+	return p, providerKey, providerSig, d.finish("deal payload")
+}
+
+func decodeDealClaimPayload(payload []byte) (dealID string, err error) {
+	d := &decoder{data: payload}
+	dealID = d.readString("deal id")
+	return dealID, d.finish("deal claim payload")
+}
+
+// claimedDeal returns the deal a TxDealClaim pays out of.
+func claimedDeal(tx *Transaction) string {
+	if tx.Type != TxDealClaim {
+		return ""
+	}
+	dealID, _ := decodeDealClaimPayload(tx.Payload)
+	return dealID
+}
+
+// settledDeal returns the deal a TxStorageProof or TxDealSlash settles
+// periods of.
+func settledDeal(tx *Transaction) string {
+	switch tx.Type {
+	case TxStorageProof:
+		dealID, _, _, _ := decodeStorageProofPayload(tx.Payload)
+		return dealID
+	case TxDealSlash:
+		dealID, _ := decodeDealSlashPayload(tx.Payload)
+		return dealID
+	}
+	return ""
+}
+
+// checkDealPayload validates the stateless parts of a deal transaction,
+// including the provider's acceptance of the terms.
+func checkDealPayload(tx *Transaction) error {
+	switch tx.Type {
+	case TxDealClaim:
+		if _, err := decodeDealClaimPayload(tx.Payload); err != nil {
+			return err
+		}
+	case TxStorageProof:
+		if _, _, _, err := decodeStorageProofPayload(tx.Payload); err != nil {
+			return err
+		}
+	case TxDealSlash:
+		if _, err := decodeDealSlashPayload(tx.Payload); err != nil {
+			return err
+		}
+	}
+	if tx.Type != TxStorageDeal {
+		if tx.To != tx.From {
+			return fmt.Errorf("%s must pay its sender", tx.Type)
+		}
+		return nil
+	}
+
+	p, providerKey, providerSig, err := decodeDealPayload(tx)
+	if err != nil {
+		return err
+	}
+	if p.ShardKey == "" || len(p.ShardRoot) != sha256.Size {
+		return fmt.Errorf("deal needs a shard key and a %d-byte shard root", sha256.Size)
+	}
+	if p.Size <= 0 {
+		return fmt.Errorf("invalid shard size %d", p.Size)
+	}
+	if p.Duration < 1 || p.Duration > MaxDealDuration {
+		return fmt.Errorf("deal duration must be 1 to %d blocks, got %d", MaxDealDuration, p.Duration)
+	}
+	if tx.To == "" || tx.To == tx.From {
+		return fmt.Errorf("deal must be with another address")
+	}
+
+	pub, err := wallet.DecodePublicKey(providerKey)
+	if err != nil {
+		return err
+	}
+	if wallet.PublicKeyToAddress(pub) != tx.To {
+		return fmt.Errorf("provider key does not match %s", tx.To)
+	}
+	if !wallet.VerifySignature(pub, p.Hash(), providerSig) {
+		return fmt.Errorf("provider did not sign the deal terms")
+	}
+	return nil
+}
+
+// checkDealContext validates a claim, proof or slash against the deals
+// active at the tip and the claims and settlements earlier in ctx.
+func (bc *Blockchain) checkDealContext(tx *Transaction, ctx *txContext) error {
+	if tx.Type == TxStorageDeal {
+		return nil
+	}
+
+	if tx.Type == TxDealClaim {
+		dealID := claimedDeal(tx)
+		deal, err := bc.GetDeal(dealID)
+		if err != nil {
+			return err
+		}
+		if tx.From != deal.Provider {
+			return fmt.Errorf("only %s can claim deal %s", deal.Provider, dealID)
+		}
+		if available := deal.Claimable() - ctx.claimed[dealID]; tx.Amount > available {
+			return fmt.Errorf("deal %s has released %d unclaimed coins, not %d", dealID, available, tx.Amount)
+		}
+		return nil
+	}
+
+	dealID := settledDeal(tx)
+	if ctx.settled[dealID] {
+		return fmt.Errorf("deal %s was already settled in this block", dealID)
+	}
+	deal, err := bc.GetDeal(dealID)
+	if err != nil {
+		return err
+	}
+	if tx.Amount != deal.Price {
+		return fmt.Errorf("deal %s is for %d, not %d", dealID, deal.Price, tx.Amount)
+	}
+	current := deal.PeriodAt(ctx.height)
+
+	if tx.Type == TxDealSlash {
+		if tx.From != deal.Client {
+			return fmt.Errorf("only %s can slash deal %s", deal.Client, dealID)
+		}
+		if min(current, deal.Periods()) <= deal.Settled() {
+			return fmt.Errorf("deal %s has no missed proofs", dealID)
+		}
+		return nil
+	}
+
+	_, period, proof, _ := decodeStorageProofPayload(tx.Payload)
+	if tx.From != deal.Provider {
+		return fmt.Errorf("only %s can prove deal %s", deal.Provider, dealID)
+	}
+	if period != current || period >= deal.Periods() {
+		return fmt.Errorf("deal %s takes proofs for period %d at height %d, not %d", dealID, current, ctx.height, period)
+	}
+	if period < deal.Settled() {
+		return fmt.Errorf("deal %s period %d is already proven", dealID, period)
+	}
+	seed, err := bc.GetBlockHashByHeight(deal.ChallengeHeight(period))
+	if err != nil {
+		return err
+	}
+	if want := ChallengeIndex(seed, dealID, period, ShardChunkCount(deal.Size)); proof.Index != want {
+		return fmt.Errorf("deal %s period %d challenges chunk %d, not %d", dealID, period, want, proof.Index)
+	}
+	if !proof.Verify(deal.ShardRoot, deal.Size) {
+		return fmt.Errorf("invalid storage proof for deal %s", dealID)
+	}
+	return nil
+}
+
+func encodeDeal(deal *StorageDeal) []byte {
+	e := &encoder{}
+	e.putString(deal.Client)
+	e.putString(deal.Provider)
+	e.putString(deal.ShardKey)
+	e.putBytes(deal.ShardRoot)
+	e.putInt(deal.Size)
+	e.putInt(deal.Start)
+	e.putInt(deal.Duration)
+	e.putInt(deal.Price)
+	e.putInt(deal.Proven)
+	e.putInt(deal.Missed)
+	e.putInt(deal.Earned)
+	e.putInt(deal.Claimed)
+	return e.buf
+}
+
+func decodeDeal(id string, data []byte) (*StorageDeal, error) {
+	d := &decoder{data: data}
+	deal := &StorageDeal{
+		ID:        id,
+		Client:    d.readString("client"),
+		Provider:  d.readString("provider"),
+		ShardKey:  d.readString("shard key"),
+		ShardRoot: d.readBytes(maxFieldLen, "shard root"),
+		Size:      d.readInt("size"),
+		Start:     d.readInt("start"),
+		Duration:  d.readInt("duration"),
+		Price:     d.readInt("price"),
+		Proven:    d.readInt("proven"),
+		Missed:    d.readInt("missed"),
+		Earned:    d.readInt("earned"),
+		Claimed:   d.readInt("claimed"),
+	}
+	if err := d.finish("deal"); err != nil {
+		return nil, err
+	}
+	return deal, nil
+}
+
+// applyDeal records a deal connected at height, or applies a claim, proof
+// or slash to it. The sender has already been charged tx.cost().
+func (st *stateTxn) applyDeal(tx *Transaction, height int) error {
+	if tx.Type == TxStorageDeal {
+		p, _, _, err := decodeDealPayload(tx)
+		if err != nil {
+			return err
+		}
+		deal := &StorageDeal{
+			Client: p.Client, Provider: p.Provider, ShardKey: p.ShardKey, ShardRoot: p.ShardRoot,
+			Size: p.Size, Start: height, Duration: p.Duration, Price: p.Price,
+		}
+		return st.set([]byte(dealPrefix+tx.ID), encodeDeal(deal))
+	}
+
+	var dealID string
+	switch tx.Type {
+	case TxDealClaim:
+		dealID = claimedDeal(tx)
+	case TxStorageProof, TxDealSlash:
+		dealID = settledDeal(tx)
+	default:
+		return fmt.Errorf("%s transaction does not apply to a deal", tx.Type)
+	}
+	key := []byte(dealPrefix + dealID)
+	val, err := st.get(key)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return fmt.Errorf("%w: %s", ErrNoDeal, dealID)
+	}
+	deal, err := decodeDeal(dealID, val)
+	if err != nil {
+		return err
+	}
+
+	// Periods up to the current one (or up to the proven one) that got no
+	// proof are refunded to the client
+	current := min(deal.PeriodAt(height), deal.Periods())
+	refund := 0
+	switch tx.Type {
+	case TxDealClaim:
+		deal.Claimed += tx.Amount
+		if err := st.credit(tx.To, tx.Amount); err != nil {
+			return err
+		}
+	case TxStorageProof:
+		for ; deal.Settled() < current; deal.Missed++ {
+			refund += deal.PeriodShare(deal.Settled())
+		}
+		deal.Earned += deal.PeriodShare(current)
+		deal.Proven++
+	case TxDealSlash:
+		for ; deal.Settled() < current; deal.Missed++ {
+			refund += deal.PeriodShare(deal.Settled())
+		}
+	}
+	if refund > 0 {
+		if err := st.credit(deal.Client, refund); err != nil {
+			return err
+		}
+	}
+
+	if deal.done() {
+		return st.del(key)
+	}
+	return st.set(key, encodeDeal(deal))
+}
+
+// GetDeal returns an active storage deal by the ID of its deal transaction.
+func (bc *Blockchain) GetDeal(dealID string) (*StorageDeal, error) {
+	var deal *StorageDeal
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(dealPrefix + dealID))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w: %s", ErrNoDeal, dealID)
+		}
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		deal, err = decodeDeal(dealID, val)
+		return err
+	})
+	return deal, err
+}
+
+// GetDeals returns the active storage deals an address is the client or
+// provider of.
+func (bc *Blockchain) GetDeals(address string) ([]*StorageDeal, error) {
+	deals := []*StorageDeal{}
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(dealPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			id := string(it.Item().Key()[len(dealPrefix):])
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			deal, err := decodeDeal(id, val)
+			if err != nil {
+				return err
+			}
+			if deal.Client == address || deal.Provider == address {
+				deals = append(deals, deal)
+			}
+		}
+		return nil
+	})
+	return deals, err
+}
@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func TestStorageDealLifecycle(t *testing.T) {
+	client, prov := wallet.NewWallet(), wallet.NewWallet()
+	bc := openChain(t, client.Address())
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	typed := func(w *wallet.Wallet, amount int, typ TxType, payload []byte) *Transaction {
+		t.Helper()
+		tx, err := bc.CreateTypedTransaction(w.Address(), w.Address(), amount, 0, typ, payload, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	p := &DealProposal{Client: client.Address(), Provider: prov.Address(), ShardKey: "f-shard-0", ShardRoot: ShardRoot(data), Size: len(data), Duration: 50, Price: 100}
+	pk, _ := prov.PublicKeyHex()
+	sig, _ := prov.Sign(p.Hash())
+	deal, err := bc.CreateTypedTransaction(client.Address(), prov.Address(), 100, 0, TxStorageDeal, StorageDealPayload(p, pk, sig), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _ := client.Sign(p.Hash())
+	bad, _ := bc.CreateTypedTransaction(client.Address(), prov.Address(), 100, 0, TxStorageDeal, StorageDealPayload(p, pk, forged), client)
+	if err := bc.AddTransaction(bad); err == nil {
+		t.Fatal("deal not signed by the provider accepted")
+	}
+	if err := bc.AddTransaction(deal); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #1
+	d, err := bc.GetDeal(deal.ID)
+	if err != nil || d.Start != 1 || d.Periods() != 3 || d.PeriodShare(2) != 20 {
+		t.Fatalf("deal = %+v, %v", d, err)
+	}
+
+	challenge := func(period int) int {
+		seed, _ := bc.GetBlockHashByHeight(d.ChallengeHeight(period))
+		return ChallengeIndex(seed, deal.ID, period, ShardChunkCount(len(data)))
+	}
+	proof := func(index int) *StorageProof {
+		t.Helper()
+		pr, err := NewStorageProof(data, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pr
+	}
+	proofTx := func(period int, pr *StorageProof) *Transaction {
+		return typed(prov, 100, TxStorageProof, StorageProofPayload(deal.ID, period, pr))
+	}
+
+	idx := challenge(0)
+	tampered := proof(idx)
+	tampered.Chunk = append([]byte(nil), tampered.Chunk...)
+	tampered.Chunk[0] ^= 1
+	rejected := []struct {
+		name string
+		tx   *Transaction
+	}{
+		{"wrong chunk", proofTx(0, proof((idx+1)%4))},
+		{"wrong period", proofTx(1, proof(idx))},
+		{"tampered chunk", proofTx(0, tampered)},
+	}
+	for _, tt := range rejected {
+		if err := bc.AddTransaction(tt.tx); err == nil {
+			t.Errorf("%s accepted", tt.name)
+		}
+	}
+	if err := bc.AddTransaction(proofTx(0, proof(idx))); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(proofTx(0, proof(idx))); err == nil {
+		t.Fatal("period proven twice")
+	}
+	bc.AddBlock("m") // #2
+	d, _ = bc.GetDeal(deal.ID)
+	if d.Proven != 1 || d.Claimable() != 40 {
+		t.Fatalf("deal after proof = %+v", d)
+	}
+
+	if err := bc.AddTransaction(typed(prov, 41, TxDealClaim, DealClaimPayload(deal.ID))); err == nil {
+		t.Fatal("claimed more than was proven")
+	}
+	if err := bc.AddTransaction(typed(prov, 40, TxDealClaim, DealClaimPayload(deal.ID))); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(typed(client, 100, TxDealSlash, DealSlashPayload(deal.ID))); err == nil {
+		t.Fatal("slashed before a period was missed")
+	}
+	bc.AddBlock("m") // #3
+	if got := bc.GetBalance(prov.Address()); got != 40 {
+		t.Fatalf("provider balance = %d, want 40", got)
+	}
+
+	// Period 1 passes unproven and the client takes its share back
+	for h, _, _ := bc.GetTip(); h < 41; h, _, _ = bc.GetTip() {
+		bc.AddBlock("m")
+	}
+	before := bc.GetBalance(client.Address())
+	if err := bc.AddTransaction(typed(client, 100, TxDealSlash, DealSlashPayload(deal.ID))); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #42
+	d, _ = bc.GetDeal(deal.ID)
+	if d.Missed != 1 || bc.GetBalance(client.Address()) < before+40 {
+		t.Fatalf("deal after slash = %+v, client got %d", d, bc.GetBalance(client.Address())-before)
+	}
+
+	// Proving and claiming the last period closes the deal
+	if err := bc.AddTransaction(proofTx(2, proof(challenge(2)))); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m")
+	if err := bc.AddTransaction(typed(prov, 20, TxDealClaim, DealClaimPayload(deal.ID))); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m")
+	if got := bc.GetBalance(prov.Address()); got != 60 {
+		t.Fatalf("provider balance = %d, want 60", got)
+	}
+	if _, err := bc.GetDeal(deal.ID); err == nil {
+		t.Fatal("finished deal not removed")
+	}
+
+	if err := bc.ReindexState(); err != nil || bc.GetBalance(prov.Address()) != 60 {
+		t.Fatalf("replayed state differs: %v", err)
+	}
+}
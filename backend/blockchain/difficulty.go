@@ -0,0 +1,156 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// Difficulty retargeting. Every RetargetInterval blocks (see NetworkParams)
+// the target is scaled by how long the last interval actually took versus
+// TargetBlockTime, so the block rate stays steady as miners join or leave.
+const (
+	// maxRetargetFactor bounds a single adjustment to x4 easier or harder.
+	maxRetargetFactor = 4
+	// medianTimeSpan is the number of ancestors used for median-time-past.
+	medianTimeSpan = 11
+	// MaxFutureBlockTime is how far ahead of our clock a block may be stamped.
+	MaxFutureBlockTime = 2 * time.Hour
+)
+
+// CompactToBig expands a compact target. The top byte is the length of the
+// number in bytes and the low three bytes are its most significant bytes.
+func CompactToBig(bits uint32) *big.Int {
+	mantissa := big.NewInt(int64(bits & 0x007fffff))
+	exponent := uint(bits >> 24)
+	if exponent <= 3 {
+		return mantissa.Rsh(mantissa, 8*(3-exponent))
+	}
+	return mantissa.Lsh(mantissa, 8*(exponent-3))
+}
+
+// BigToCompact packs a target into its compact form (the inverse of
+// CompactToBig, dropping precision below the top three bytes).
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() <= 0 {
+		return 0
+	}
+	exponent := uint((n.BitLen() + 7) / 8)
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(n.Uint64() << (8 * (3 - exponent)))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(n, 8*(exponent-3)).Uint64())
+	}
+	// Keep 0x00800000 clear so the mantissa always reads as positive
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	return uint32(exponent<<24) | mantissa
+}
+
+// blockWork returns the expected number of hashes needed to mine a block
+// with the given target: 2^256 / (target + 1).
+func blockWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// meetsTarget reports whether a hex block hash is at or below the target.
+func meetsTarget(hash string, bits uint32) bool {
+	value, ok := new(big.Int).SetString(hash, 16)
+	return ok && value.Cmp(CompactToBig(bits)) <= 0
+}
+
+// nextBits returns the target a block built on parent must carry.
+func (bc *Blockchain) nextBits(parent *BlockHeader) (uint32, error) {
+	interval := bc.Params.RetargetInterval
+	if interval == 0 || (parent.Index+1)%interval != 0 {
+		return parent.Bits, nil
+	}
+
+	// Walk back over the last interval along parent's own branch
+	first := parent
+	blocks := 0
+	for blocks < interval && first.Index > 0 {
+		prev, err := bc.GetHeader(first.PrevHash)
+		if err != nil {
+			return 0, fmt.Errorf("missing ancestor of %s for retarget: %w", first.Hash, err)
+		}
+		first = prev
+		blocks++
+	}
+
+	// With RetargetInterval 1 the block after genesis has no span to
+	// measure; keep the target rather than divide by zero
+	expected := int64(blocks) * int64(bc.Params.TargetBlockTime/time.Second)
+	if expected <= 0 {
+		return parent.Bits, nil
+	}
+	actual := parent.Timestamp - first.Timestamp
+	if actual < expected/maxRetargetFactor {
+		actual = expected / maxRetargetFactor
+	}
+	if actual > expected*maxRetargetFactor {
+		actual = expected * maxRetargetFactor
+	}
+
+	target := CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(bc.Params.PowLimit) > 0 {
+		target.Set(bc.Params.PowLimit)
+	}
+	return BigToCompact(target), nil
+}
+
+// medianTimePast returns the median timestamp of parent and its ancestors
+// (up to medianTimeSpan blocks). New blocks must be stamped after it, which
+// stops a miner from dragging timestamps back to make mining easier.
+func (bc *Blockchain) medianTimePast(parent *BlockHeader) (int64, error) {
+	times := make([]int64, 0, medianTimeSpan)
+	hdr := parent
+	for len(times) < medianTimeSpan {
+		times = append(times, hdr.Timestamp)
+		if hdr.Index == 0 {
+			break
+		}
+		prev, err := bc.GetHeader(hdr.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		hdr = prev
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2], nil
+}
+
+// checkHeaderContext verifies the target and timestamp a header must have on
+// top of its parent.
+func (bc *Blockchain) checkHeaderContext(h, parent *BlockHeader) error {
+	bits, err := bc.nextBits(parent)
+	if err != nil {
+		return err
+	}
+	if h.Bits != bits {
+		return fmt.Errorf("block %s has target %08x, expected %08x", h.Hash, h.Bits, bits)
+	}
+
+	mtp, err := bc.medianTimePast(parent)
+	if err != nil {
+		return err
+	}
+	if h.Timestamp <= mtp {
+		return fmt.Errorf("block %s timestamp %d is not after median time %d", h.Hash, h.Timestamp, mtp)
+	}
+	if h.Timestamp > time.Now().Add(MaxFutureBlockTime).Unix() {
+		return fmt.Errorf("block %s timestamp %d is too far in the future", h.Hash, h.Timestamp)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	tests := []struct {
+		bits uint32
+		want *big.Int
+	}{
+		{0x1d00ffff, new(big.Int).Lsh(big.NewInt(0xffff), 8*(0x1d-3))},
+		{0x2000ffff, new(big.Int).Lsh(big.NewInt(0xffff), 8*(0x20-3))},
+		{0x03123456, big.NewInt(0x123456)},
+		{0x02123400, big.NewInt(0x1234)},
+		{0x01120000, big.NewInt(0x12)},
+	}
+	for _, tt := range tests {
+		got := CompactToBig(tt.bits)
+		if got.Cmp(tt.want) != 0 {
+			t.Errorf("CompactToBig(%08x) = %x, want %x", tt.bits, got, tt.want)
+		}
+		if back := BigToCompact(got); back != tt.bits {
+			t.Errorf("BigToCompact(CompactToBig(%08x)) = %08x", tt.bits, back)
+		}
+	}
+}
+
+func TestBigToCompact(t *testing.T) {
+	tests := []struct {
+		n    *big.Int
+		want uint32
+	}{
+		{big.NewInt(0), 0},
+		{big.NewInt(-5), 0},
+		{big.NewInt(0x12), 0x01120000},
+		// 0x80 would set the sign bit, so the exponent grows instead
+		{big.NewInt(0x80), 0x02008000},
+		{big.NewInt(0x123456), 0x03123456},
+		// Precision below the top three bytes is dropped
+		{big.NewInt(0x12345678), 0x04123456},
+	}
+	for _, tt := range tests {
+		if got := BigToCompact(tt.n); got != tt.want {
+			t.Errorf("BigToCompact(%x) = %08x, want %08x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBlockWork(t *testing.T) {
+	// A target of 2^255 - 1 takes two hashes on average
+	if got := blockWork(BigToCompact(pow2(255))); got.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("blockWork(2^255-1) = %s, want 2", got)
+	}
+	easy, hard := blockWork(BigToCompact(pow2(252))), blockWork(BigToCompact(pow2(248)))
+	if hard.Cmp(new(big.Int).Mul(easy, big.NewInt(16))) != 0 {
+		t.Fatalf("work at 2^248 = %s, want 16 x %s", hard, easy)
+	}
+	if got := blockWork(0); got.Sign() != 0 {
+		t.Fatalf("blockWork(0) = %s, want 0", got)
+	}
+}
+
+func TestCheckHeaderTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		bits uint32
+	}{
+		{"zero target", 0},
+		{"easier than the limit", BigToCompact(pow2(253))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBlock(nil, "prev", 1, tt.bits)
+			b.Hash = b.CalculateHash()
+			if err := CheckHeader(&b.BlockHeader, TestNetParams); err == nil {
+				t.Fatal("header accepted")
+			}
+		})
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	if p := testParams(t, ""); p.RetargetInterval != 10 || p.TargetBlockTime != 10*time.Second {
+		t.Fatal("test assumes a 10 block, 10s retarget")
+	}
+	tests := []struct {
+		name    string
+		spacing int64 // seconds between blocks; the target is 10s
+		span    int64 // the 90s expected span, as clamped by nextBits
+	}{
+		{"on time", 10, 90},
+		{"twice as slow", 20, 180},
+		{"twice as fast", 5, 45},
+		{"clamped easier", 100, 90 * 4},
+		{"clamped harder", 1, 90 / 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := openChain(t, "genesis")
+
+			// Blocks #1-9 keep the genesis target; #10 is retargeted
+			// over the 9 intervals since genesis
+			genesis := tipBlock(t, bc)
+			prev := genesis
+			for i := 1; i <= 9; i++ {
+				b := NewBlock(withCoinbase(bc, i), prev.Hash, i, prev.Bits)
+				b.Timestamp = genesis.Timestamp + int64(i)*tt.spacing
+				MineBlock(b)
+				if err := bc.ProcessBlock(b); err != nil {
+					t.Fatal(err)
+				}
+				prev = b
+			}
+
+			got, err := bc.nextBits(&prev.BlockHeader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := CompactToBig(bc.Params.GenesisBits)
+			want.Mul(want, big.NewInt(tt.span))
+			want.Div(want, big.NewInt(90))
+			if want.Cmp(bc.Params.PowLimit) > 0 {
+				want.Set(bc.Params.PowLimit)
+			}
+			if got != BigToCompact(want) {
+				t.Fatalf("bits = %08x, want %08x", got, BigToCompact(want))
+			}
+
+			// A block keeping the old target is rejected
+			if got != prev.Bits {
+				b := NewBlock(withCoinbase(bc, 10), prev.Hash, 10, prev.Bits)
+				b.Timestamp = prev.Timestamp + tt.spacing
+				MineBlock(b)
+				if err := bc.ProcessBlock(b); err == nil {
+					t.Fatal("block with a stale target accepted")
+				}
+			}
+		})
+	}
+}
+
+func TestTimestampRules(t *testing.T) {
+	bc := openChain(t, "genesis")
+	tip := tipBlock(t, bc)
+
+	tests := []struct {
+		name      string
+		timestamp int64
+		ok        bool
+	}{
+		{"after median", tip.Timestamp + 1, true},
+		{"at median", tip.Timestamp, false},
+		{"before median", tip.Timestamp - 100, false},
+		{"far future", time.Now().Add(MaxFutureBlockTime + time.Minute).Unix(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBlock(nil, tip.Hash, 1, tip.Bits)
+			b.Timestamp = tt.timestamp
+			MineBlock(b)
+			err := bc.checkHeaderContext(&b.BlockHeader, &tip.BlockHeader)
+			if (err == nil) != tt.ok {
+				t.Fatalf("checkHeaderContext = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRetargetEveryBlock(t *testing.T) {
+	params := testParams(t, "")
+	params.RetargetInterval = 1
+	bc := openNode(t, params, "test")
+
+	// Block #1 has no interval behind it; later ones retarget over one
+	prev := tipBlock(t, bc)
+	for i := 1; i <= 3; i++ {
+		b := mineOn(t, bc, prev)
+		if err := bc.ProcessBlock(b); err != nil {
+			t.Fatalf("block #%d: %v", i, err)
+		}
+		if i == 1 && b.Bits != prev.Bits {
+			t.Fatalf("first block bits = %08x, want genesis %08x", b.Bits, prev.Bits)
+		}
+		prev = b
+	}
+}
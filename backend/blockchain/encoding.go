@@ -0,0 +1,319 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"decentralized-net/wallet"
+)
+
+// Wire format. Every encoding starts with EncodingVersion. Integers are
+// fixed-width big-endian and strings are a uint32 length followed by the
+// bytes, so each value has exactly one encoding and hashes are stable.
+//
+//	Transaction: [Version] [From] [To] [Amount] [Fee] [Nonce] [Timestamp] [PublicKey] [Signature] [Signatures]
+//	Header:      [Version] [Index] [Timestamp] [PrevHash] [MerkleRoot] [Bits (4)] [Nonce]
+//	Block:       [Header] [TxCount (4)] TxCount x ([TxLen (4)] [Transaction])
+//
+// Transactions with a Type other than TxTransfer (or with a Payload) use
+// TypedTxVersion instead, which adds [Type (1)] [Payload] after Timestamp.
+// Plain transfers keep the original layout so their IDs never change.
+//
+// [Signatures] is only present for multisig senders: [Count (4)] Count x
+// [Signature]. Like the other signature fields it is not covered by the ID,
+// but the block's Merkle root covers the full encoding, signatures included.
+//
+// IDs and hashes are not encoded; they are recomputed when decoding.
+const (
+	EncodingVersion byte = 1
+	TypedTxVersion  byte = 2
+)
+
+// Size limits enforced when decoding untrusted data.
+const (
+	// MaxBlockSize caps the encoded size of a block.
+	MaxBlockSize = 1 << 20
+	// MaxTxSize caps the encoded size of a transaction.
+	MaxTxSize = 4 << 10
+	// maxFieldLen caps any single string field (addresses, keys, hashes).
+	maxFieldLen = 1 << 10
+	// MaxPayloadSize caps a transaction's type-specific payload.
+	MaxPayloadSize = 2 << 10
+	// maxPublicKeyLen caps a public key field, which may hold a multisig script.
+	maxPublicKeyLen = 2 << 10
+)
+
+// ErrMalformed is returned when bytes are not a valid encoding.
+var ErrMalformed = errors.New("malformed encoding")
+
+// encoder appends canonical values to a buffer.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) putByte(v byte)     { e.buf = append(e.buf, v) }
+func (e *encoder) putUint32(v uint32) { e.buf = binary.BigEndian.AppendUint32(e.buf, v) }
+func (e *encoder) putInt64(v int64)   { e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v)) }
+func (e *encoder) putInt(v int)       { e.putInt64(int64(v)) }
+func (e *encoder) putString(v string) { e.putBytes([]byte(v)) }
+
+func (e *encoder) putBytes(v []byte) {
+	e.putUint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// decoder reads canonical values. The first error sticks and later reads
+// return zero values, so callers check err once at the end.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrMalformed, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) take(n int, what string) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.fail("truncated %s", what)
+		return nil
+	}
+	out := d.data[:n]
+	d.data = d.data[n:]
+	return out
+}
+
+func (d *decoder) readByte(what string) byte {
+	b := d.take(1, what)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) readUint32(what string) uint32 {
+	b := d.take(4, what)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) readInt64(what string) int64 {
+	b := d.take(8, what)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *decoder) readInt(what string) int {
+	return int(d.readInt64(what))
+}
+
+func (d *decoder) readBytes(maxLen uint32, what string) []byte {
+	n := d.readUint32(what)
+	if d.err == nil && n > maxLen {
+		d.fail("%s too long (%d bytes)", what, n)
+		return nil
+	}
+	return d.take(int(n), what)
+}
+
+func (d *decoder) readString(what string) string {
+	return string(d.readBytes(maxFieldLen, what))
+}
+
+func (d *decoder) readVersion(what string) {
+	if v := d.readByte(what + " version"); d.err == nil && v != EncodingVersion {
+		d.fail("unsupported %s version %d", what, v)
+	}
+}
+
+// isTyped reports whether the transaction needs the typed encoding.
+func (tx *Transaction) isTyped() bool {
+	return tx.Type != TxTransfer || len(tx.Payload) > 0
+}
+
+// finish reports the first error, or trailing bytes after a complete value.
+func (d *decoder) finish(what string) error {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("%d trailing bytes after %s", len(d.data), what)
+	}
+	return d.err
+}
+
+// signingBytes is the part of a transaction covered by its ID (and so by
+// the signature). The public key is bound separately through the address.
+func (tx *Transaction) signingBytes() []byte {
+	e := &encoder{}
+	if tx.isTyped() {
+		e.putByte(TypedTxVersion)
+	} else {
+		e.putByte(EncodingVersion)
+	}
+	e.putString(tx.From)
+	e.putString(tx.To)
+	e.putInt(tx.Amount)
+	e.putInt(tx.Fee)
+	e.putInt(tx.Nonce)
+	e.putInt64(tx.Timestamp)
+	if tx.isTyped() {
+		e.putByte(byte(tx.Type))
+		e.putBytes(tx.Payload)
+	}
+	return e.buf
+}
+
+// Serialize converts the transaction to its canonical bytes
+func (tx *Transaction) Serialize() []byte {
+	e := &encoder{buf: tx.signingBytes()}
+	e.putString(tx.PublicKey)
+	e.putString(tx.Signature)
+	if len(tx.Signatures) > 0 {
+		e.putUint32(uint32(len(tx.Signatures)))
+		for _, sig := range tx.Signatures {
+			e.putString(sig)
+		}
+	}
+	return e.buf
+}
+
+// DeserializeTransaction decodes canonical bytes into a Transaction and
+// recomputes its ID.
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	if len(data) > MaxTxSize {
+		return nil, fmt.Errorf("%w: transaction too large (%d bytes)", ErrMalformed, len(data))
+	}
+	d := &decoder{data: data}
+	tx := decodeTransaction(d)
+	if err := d.finish("transaction"); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func decodeTransaction(d *decoder) *Transaction {
+	version := d.readByte("transaction version")
+	if d.err == nil && version != EncodingVersion && version != TypedTxVersion {
+		d.fail("unsupported transaction version %d", version)
+	}
+	tx := &Transaction{
+		From:      d.readString("from"),
+		To:        d.readString("to"),
+		Amount:    d.readInt("amount"),
+		Fee:       d.readInt("fee"),
+		Nonce:     d.readInt("nonce"),
+		Timestamp: d.readInt64("timestamp"),
+	}
+	if version == TypedTxVersion {
+		tx.Type = TxType(d.readByte("type"))
+		if payload := d.readBytes(MaxPayloadSize, "payload"); len(payload) > 0 {
+			tx.Payload = append([]byte(nil), payload...)
+		}
+		// A plain transfer in the typed layout would have a second encoding
+		if d.err == nil && !tx.isTyped() {
+			d.fail("untyped transaction in typed encoding")
+		}
+	}
+	tx.PublicKey = string(d.readBytes(maxPublicKeyLen, "public key"))
+	tx.Signature = d.readString("signature")
+	if d.err == nil && len(d.data) > 0 {
+		count := d.readUint32("signature count")
+		// An empty list is encoded by omitting it
+		if d.err == nil && (count == 0 || count > wallet.MaxMultisigKeys) {
+			d.fail("invalid signature count %d", count)
+		}
+		for i := uint32(0); i < count && d.err == nil; i++ {
+			tx.Signatures = append(tx.Signatures, d.readString("signature"))
+		}
+	}
+	tx.ID = tx.CalculateHash()
+	return tx
+}
+
+// Serialize converts the header to its canonical bytes (without Hash)
+func (h *BlockHeader) Serialize() []byte {
+	e := &encoder{}
+	e.putByte(EncodingVersion)
+	e.putInt(h.Index)
+	e.putInt64(h.Timestamp)
+	e.putString(h.PrevHash)
+	e.putString(h.MerkleRoot)
+	e.putUint32(h.Bits)
+	e.putInt(h.Nonce)
+	return e.buf
+}
+
+// DeserializeHeader decodes canonical bytes into a BlockHeader and
+// recomputes its hash.
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+	d := &decoder{data: data}
+	h := decodeHeader(d)
+	if err := d.finish("header"); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func decodeHeader(d *decoder) *BlockHeader {
+	d.readVersion("header")
+	h := &BlockHeader{
+		Index:      d.readInt("index"),
+		Timestamp:  d.readInt64("timestamp"),
+		PrevHash:   d.readString("prev hash"),
+		MerkleRoot: d.readString("merkle root"),
+		Bits:       d.readUint32("bits"),
+		Nonce:      d.readInt("nonce"),
+	}
+	h.Hash = h.CalculateHash()
+	return h
+}
+
+// Serialize converts the block to its canonical bytes
+func (b *Block) Serialize() []byte {
+	e := &encoder{buf: b.BlockHeader.Serialize()}
+	e.putUint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.putBytes(tx.Serialize())
+	}
+	return e.buf
+}
+
+// DeserializeBlock decodes canonical bytes into a Block, recomputing the
+// block hash and every transaction ID.
+func DeserializeBlock(data []byte) (*Block, error) {
+	if len(data) > MaxBlockSize {
+		return nil, fmt.Errorf("%w: block too large (%d bytes)", ErrMalformed, len(data))
+	}
+	d := &decoder{data: data}
+	header := decodeHeader(d)
+	count := d.readUint32("tx count")
+	// Each transaction takes at least its 4-byte length prefix
+	if d.err == nil && int(count) > len(d.data)/4 {
+		d.fail("tx count %d exceeds block size", count)
+	}
+
+	block := &Block{BlockHeader: *header}
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		txData := d.readBytes(MaxTxSize, "transaction")
+		if d.err != nil {
+			break
+		}
+		tx, err := DeserializeTransaction(txData)
+		if err != nil {
+			return nil, fmt.Errorf("tx %d: %w", i, err)
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+	if err := d.finish("block"); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
@@ -0,0 +1,173 @@
+package blockchain
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func signedTx(t *testing.T, w *wallet.Wallet, typ TxType, payload []byte) *Transaction {
+	t.Helper()
+	tx := &Transaction{From: w.Address(), To: "bob", Amount: 5, Fee: 1, Nonce: 3, Timestamp: 1767225600, Type: typ, Payload: payload}
+	if err := tx.Sign(w); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestTransactionRoundTrip(t *testing.T) {
+	w := wallet.NewWallet()
+	signers := []*wallet.Wallet{wallet.NewWallet(), wallet.NewWallet(), wallet.NewWallet()}
+	var keys []string
+	for _, s := range signers {
+		key, _ := s.PublicKeyHex()
+		keys = append(keys, key)
+	}
+	script, err := wallet.NewMultisigScript(2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multisig := &Transaction{From: script.Address(), To: "bob", Amount: 5, Nonce: 1, Timestamp: 1767225600}
+	for _, s := range signers[:2] {
+		if err := multisig.SignMultisig(script, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		tx   *Transaction
+	}{
+		{"transfer", signedTx(t, w, TxTransfer, nil)},
+		{"typed", signedTx(t, w, TxJobPayment, []byte("job hash"))},
+		{"coinbase", NewCoinbaseTx("miner", 50, 7)},
+		{"multisig", multisig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DeserializeTransaction(tt.tx.Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.tx) {
+				t.Fatalf("round trip:\n got %+v\nwant %+v", got, tt.tx)
+			}
+		})
+	}
+}
+
+func testBlock(t *testing.T) *Block {
+	t.Helper()
+	tx := &Transaction{From: "alice", To: "bob", Amount: 5, Fee: 1, Timestamp: 1767225600, PublicKey: "key", Signature: "sig"}
+	tx.ID = tx.CalculateHash()
+	b := NewBlock([]*Transaction{NewCoinbaseTx("m", 51, 1), tx}, "abc", 1, TestNetParams.GenesisBits)
+	MineBlock(b)
+	return b
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	b := testBlock(t)
+	got, err := DeserializeBlock(b.Serialize())
+	if err != nil || !reflect.DeepEqual(got, b) {
+		t.Fatalf("block round trip: %v", err)
+	}
+	hdr, err := DeserializeHeader(b.BlockHeader.Serialize())
+	if err != nil || *hdr != b.BlockHeader {
+		t.Fatalf("header round trip: %v", err)
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	data := testBlock(t).Serialize()
+
+	for i := 0; i < len(data); i++ {
+		if _, err := DeserializeBlock(data[:i]); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("truncated at %d: got %v, want ErrMalformed", i, err)
+		}
+	}
+	if _, err := DeserializeBlock(append(data, 0)); err == nil {
+		t.Fatal("trailing byte accepted")
+	}
+	wrongVersion := append([]byte(nil), data...)
+	wrongVersion[0] = EncodingVersion + 1
+	if _, err := DeserializeBlock(wrongVersion); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("unknown version: got %v, want ErrMalformed", err)
+	}
+
+	// A plain transfer in the typed layout would give it a second encoding
+	e := &encoder{}
+	e.putByte(TypedTxVersion)
+	for _, s := range []string{"a", "b"} {
+		e.putString(s)
+	}
+	for i := 0; i < 3; i++ {
+		e.putInt(0)
+	}
+	e.putInt64(0)
+	e.putByte(byte(TxTransfer))
+	e.putBytes(nil)
+	e.putString("")
+	e.putString("")
+	if _, err := DeserializeTransaction(e.buf); err == nil {
+		t.Fatal("untyped transaction in typed encoding accepted")
+	}
+
+	// Random corruption must never panic
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		mutated := append([]byte(nil), data...)
+		mutated[r.Intn(len(mutated))] = byte(r.Intn(256))
+		DeserializeBlock(mutated)
+		junk := make([]byte, r.Intn(64))
+		r.Read(junk)
+		DeserializeBlock(junk)
+		DeserializeTransaction(junk)
+		DeserializeHeader(junk)
+	}
+}
+
+// The IDs of existing transactions must never change, whatever is added to
+// the encoding later.
+func TestTransactionIDStability(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   *Transaction
+		want string
+	}{
+		{
+			"transfer",
+			&Transaction{From: "alice", To: "bob", Amount: 5, Fee: 1, Nonce: 3, Timestamp: 1767225600},
+			"6e6b7e89a58e6321733d0e84b1fc66498bfdde296b2583d611deb4b630111609",
+		},
+		{
+			"typed",
+			&Transaction{From: "alice", To: "bob", Amount: 5, Fee: 1, Nonce: 3, Timestamp: 1767225600, Type: TxJobPayment, Payload: []byte("job")},
+			"b25a32e269b9b0acf6f6aa8d3141a2e87057b942d6d3f9814a24036a481a9066",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.tx.CalculateHash(); got != tt.want {
+			t.Errorf("%s: ID = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIDExcludesWitness(t *testing.T) {
+	tx := signedTx(t, wallet.NewWallet(), TxTransfer, nil)
+	id := tx.ID
+
+	tx.Signature = "00|00"
+	tx.PublicKey = "other"
+	tx.Signatures = []string{"x"}
+	if tx.CalculateHash() != id {
+		t.Fatal("witness fields changed the ID")
+	}
+
+	tx.Amount++
+	if tx.CalculateHash() == id {
+		t.Fatal("amount not covered by the ID")
+	}
+}
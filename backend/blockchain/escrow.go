@@ -0,0 +1,330 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"decentralized-net/wallet"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Hash time-locked escrow (HTLC). A TxHTLCLock moves Amount from the client
+// into an escrow for the worker (To). Before the timeout height the worker
+// takes it with a TxHTLCClaim revealing the preimage of HashLock; from the
+// timeout height on, the client takes it back with a TxHTLCRefund.
+//
+// The worker picks the preimage (EscrowPreimage) and hands out only its hash.
+// It sends the result sealed under the preimage (SealResult), so the claim
+// that pays the worker is what lets the client read the result, and the
+// client has nothing to hold back once the job has run.
+//
+// Open escrows are part of the account state:
+//
+//	"htlc_<lockTxID>" -> Escrow
+const escrowPrefix = "htlc_"
+
+// ErrNoEscrow is returned when an escrow doesn't exist or was already settled.
+var ErrNoEscrow = errors.New("no open escrow")
+
+// Escrow is an open HTLC, keyed by the ID of the transaction that locked it.
+type Escrow struct {
+	ID       string
+	From     string // Client, who can refund
+	To       string // Worker, who can claim
+	Amount   int
+	HashLock []byte // sha256 of the preimage that releases the funds
+	Timeout  int    // First height at which the client may refund
+	JobHash  []byte // Job the funds pay for, see JobHash
+}
+
+// HTLCLockPayload builds the payload of a TxHTLCLock.
+func HTLCLockPayload(hashLock []byte, timeout int, jobHash []byte) []byte {
+	e := &encoder{}
+	e.putBytes(hashLock)
+	e.putInt(timeout)
+	e.putBytes(jobHash)
+	return e.buf
+}
+
+// HTLCClaimPayload builds the payload of a TxHTLCClaim.
+func HTLCClaimPayload(lockID string, preimage []byte) []byte {
+	e := &encoder{}
+	e.putString(lockID)
+	e.putBytes(preimage)
+	return e.buf
+}
+
+// HTLCRefundPayload builds the payload of a TxHTLCRefund.
+func HTLCRefundPayload(lockID string) []byte {
+	e := &encoder{}
+	e.putString(lockID)
+	return e.buf
+}
+
+func decodeLockPayload(payload []byte) (hashLock []byte, timeout int, jobHash []byte, err error) {
+	d := &decoder{data: payload}
+	hashLock = d.readBytes(maxFieldLen, "hash lock")
+	timeout = d.readInt("timeout")
+	jobHash = d.readBytes(maxFieldLen, "job hash")
+	return hashLock, timeout, jobHash, d.finish("lock payload")
+}
+
+func decodeClaimPayload(payload []byte) (lockID string, preimage []byte, err error) {
+	d := &decoder{data: payload}
+	lockID = d.readString("lock id")
+	preimage = d.readBytes(maxFieldLen, "preimage")
+	return lockID, preimage, d.finish("claim payload")
+}
+
+func decodeRefundPayload(payload []byte) (lockID string, err error) {
+	d := &decoder{data: payload}
+	lockID = d.readString("lock id")
+	return lockID, d.finish("refund payload")
+}
+
+// EscrowPreimage derives the preimage a worker locks the escrow for a job
+// under. It is keyed by the worker's wallet, so it stays secret until the
+// claim reveals it and needs nothing stored per job.
+func EscrowPreimage(w *wallet.Wallet, jobHash []byte) []byte {
+	mac := hmac.New(sha256.New, w.Private.D.FillBytes(make([]byte, 32)))
+	mac.Write([]byte("escrow preimage"))
+	mac.Write(jobHash)
+	return mac.Sum(nil)
+}
+
+// resultCipher returns the AEAD that seals a job result under preimage.
+func resultCipher(preimage []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte("escrow result"), preimage...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealResult encrypts a job result under the escrow preimage.
+func SealResult(preimage, result []byte) ([]byte, error) {
+	aead, err := resultCipher(preimage)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, result, nil), nil
+}
+
+// OpenResult decrypts a result sealed with SealResult. It fails if preimage
+// is not the one the result was sealed under.
+func OpenResult(preimage, sealed []byte) ([]byte, error) {
+	aead, err := resultCipher(preimage)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed result too short")
+	}
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	result, err := aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening sealed result: %w", err)
+	}
+	return result, nil
+}
+
+// settledEscrow returns the lock ID a claim or refund settles.
+func settledEscrow(tx *Transaction) string {
+	switch tx.Type {
+	case TxHTLCClaim:
+		lockID, _, _ := decodeClaimPayload(tx.Payload)
+		return lockID
+	case TxHTLCRefund:
+		lockID, _ := decodeRefundPayload(tx.Payload)
+		return lockID
+	}
+	return ""
+}
+
+// checkEscrowPayload validates the stateless parts of an escrow transaction.
+func checkEscrowPayload(tx *Transaction) error {
+	switch tx.Type {
+	case TxHTLCLock:
+		hashLock, timeout, jobHash, err := decodeLockPayload(tx.Payload)
+		if err != nil {
+			return err
+		}
+		if len(hashLock) != sha256.Size || len(jobHash) != JobHashSize {
+			return fmt.Errorf("escrow lock needs a %d-byte hash lock and job hash", sha256.Size)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("invalid escrow timeout %d", timeout)
+		}
+		if tx.To == "" || tx.To == tx.From {
+			return fmt.Errorf("escrow must lock funds for another address")
+		}
+	case TxHTLCClaim:
+		if _, _, err := decodeClaimPayload(tx.Payload); err != nil {
+			return err
+		}
+	case TxHTLCRefund:
+		if _, err := decodeRefundPayload(tx.Payload); err != nil {
+			return err
+		}
+	}
+	// Settled funds always go back to whoever settles
+	if tx.Type != TxHTLCLock && tx.To != tx.From {
+		return fmt.Errorf("escrow %s must pay its sender", tx.Type)
+	}
+	return nil
+}
+
+// checkEscrowContext validates an escrow transaction against the escrows open
+// at the tip and those already settled in ctx.
+func (bc *Blockchain) checkEscrowContext(tx *Transaction, ctx *txContext) error {
+	if tx.Type == TxHTLCLock {
+		_, timeout, _, _ := decodeLockPayload(tx.Payload)
+		if timeout <= ctx.height {
+			return fmt.Errorf("escrow timeout %d is not after height %d", timeout, ctx.height)
+		}
+		return nil
+	}
+
+	lockID := settledEscrow(tx)
+	if ctx.settled[lockID] {
+		return fmt.Errorf("%w: %s is already settled", ErrNoEscrow, lockID)
+	}
+	esc, err := bc.GetEscrow(lockID)
+	if err != nil {
+		return err
+	}
+	if tx.Amount != esc.Amount {
+		return fmt.Errorf("escrow %s holds %d, not %d", lockID, esc.Amount, tx.Amount)
+	}
+
+	switch tx.Type {
+	case TxHTLCClaim:
+		_, preimage, _ := decodeClaimPayload(tx.Payload)
+		if tx.From != esc.To {
+			return fmt.Errorf("only %s can claim escrow %s", esc.To, lockID)
+		}
+		if ctx.height >= esc.Timeout {
+			return fmt.Errorf("escrow %s timed out at height %d", lockID, esc.Timeout)
+		}
+		if sum := sha256.Sum256(preimage); !bytes.Equal(sum[:], esc.HashLock) {
+			return fmt.Errorf("wrong preimage for escrow %s", lockID)
+		}
+	case TxHTLCRefund:
+		if tx.From != esc.From {
+			return fmt.Errorf("only %s can refund escrow %s", esc.From, lockID)
+		}
+		if ctx.height < esc.Timeout {
+			return fmt.Errorf("escrow %s can't be refunded before height %d", lockID, esc.Timeout)
+		}
+	}
+	return nil
+}
+
+func encodeEscrow(esc *Escrow) []byte {
+	e := &encoder{}
+	e.putString(esc.From)
+	e.putString(esc.To)
+	e.putInt(esc.Amount)
+	e.putBytes(esc.HashLock)
+	e.putInt(esc.Timeout)
+	e.putBytes(esc.JobHash)
+	return e.buf
+}
+
+func decodeEscrow(id string, data []byte) (*Escrow, error) {
+	d := &decoder{data: data}
+	esc := &Escrow{
+		ID:       id,
+		From:     d.readString("from"),
+		To:       d.readString("to"),
+		Amount:   d.readInt("amount"),
+		HashLock: d.readBytes(maxFieldLen, "hash lock"),
+		Timeout:  d.readInt("timeout"),
+		JobHash:  d.readBytes(maxFieldLen, "job hash"),
+	}
+	if err := d.finish("escrow"); err != nil {
+		return nil, err
+	}
+	return esc, nil
+}
+
+// applyEscrow opens or settles the escrow of a connected transaction. The
+// sender has already been charged tx.cost().
+func (st *stateTxn) applyEscrow(tx *Transaction) error {
+	if tx.Type == TxHTLCLock {
+		hashLock, timeout, jobHash, err := decodeLockPayload(tx.Payload)
+		if err != nil {
+			return err
+		}
+		esc := &Escrow{From: tx.From, To: tx.To, Amount: tx.Amount, HashLock: hashLock, Timeout: timeout, JobHash: jobHash}
+		return st.set([]byte(escrowPrefix+tx.ID), encodeEscrow(esc))
+	}
+	if err := st.del([]byte(escrowPrefix + settledEscrow(tx))); err != nil {
+		return err
+	}
+	return st.credit(tx.To, tx.Amount)
+}
+
+// GetEscrow returns an open escrow by the ID of its lock transaction.
+func (bc *Blockchain) GetEscrow(lockID string) (*Escrow, error) {
+	var esc *Escrow
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(escrowPrefix + lockID))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w: %s", ErrNoEscrow, lockID)
+		}
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		esc, err = decodeEscrow(lockID, val)
+		return err
+	})
+	return esc, err
+}
+
+// AcceptEscrowForJob checks that lockID is an open escrow of at least
+// minAmount to worker for the job with jobHash that stays claimable for at
+// least minBlocks more blocks, and marks it redeemed so it can't pay for
+// another run. The worker claims it with EscrowPreimage once the job has run.
+func (bc *Blockchain) AcceptEscrowForJob(lockID, worker string, jobHash []byte, minAmount, minBlocks int) (*Escrow, error) {
+	esc, err := bc.GetEscrow(lockID)
+	if err != nil {
+		return nil, err
+	}
+	if esc.To != worker {
+		return nil, fmt.Errorf("escrow %s is for %s, not this worker", lockID, esc.To)
+	}
+	if !bytes.Equal(esc.JobHash, jobHash) {
+		return nil, fmt.Errorf("escrow %s is for a different job", lockID)
+	}
+	if esc.Amount < minAmount {
+		return nil, fmt.Errorf("escrow %s holds %d coins, need %d", lockID, esc.Amount, minAmount)
+	}
+	height, _, err := bc.GetTip()
+	if err != nil {
+		return nil, err
+	}
+	if esc.Timeout-height-1 < minBlocks {
+		return nil, fmt.Errorf("escrow %s times out at height %d, too soon to claim", lockID, esc.Timeout)
+	}
+	if err := bc.markRedeemed(lockID); err != nil {
+		return nil, err
+	}
+	return esc, nil
+}
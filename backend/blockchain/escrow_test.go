@@ -0,0 +1,153 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func TestEscrowClaimAndRefund(t *testing.T) {
+	client, worker := wallet.NewWallet(), wallet.NewWallet()
+	bc := openChain(t, client.Address())
+	preimage := []byte("secret-preimage")
+	hashLock := sha256.Sum256(preimage)
+	jobHash := JobHash([]byte("wasm"), []byte("input"))
+	typed := func(w *wallet.Wallet, amount int, typ TxType, payload []byte) *Transaction {
+		t.Helper()
+		tx, err := bc.CreateTypedTransaction(w.Address(), w.Address(), amount, 0, typ, payload, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	lock, err := bc.CreateTypedTransaction(client.Address(), worker.Address(), 20, 1, TxHTLCLock, HTLCLockPayload(hashLock[:], 5, jobHash), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(lock); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #1
+	if bc.GetBalance(client.Address()) != 1000000-21 || bc.GetBalance(worker.Address()) != 0 {
+		t.Fatal("lock did not move the funds into escrow")
+	}
+
+	// The worker accepts the escrow for this job once
+	if _, err := bc.AcceptEscrowForJob(lock.ID, worker.Address(), jobHash, 5, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.AcceptEscrowForJob(lock.ID, worker.Address(), jobHash, 5, 2); err == nil {
+		t.Fatal("escrow accepted twice")
+	}
+
+	rejected := []struct {
+		name string
+		tx   *Transaction
+	}{
+		{"refund before timeout", typed(client, 20, TxHTLCRefund, HTLCRefundPayload(lock.ID))},
+		{"claim with wrong preimage", typed(worker, 20, TxHTLCClaim, HTLCClaimPayload(lock.ID, []byte("nope")))},
+	}
+	for _, tt := range rejected {
+		if err := bc.AddTransaction(tt.tx); err == nil {
+			t.Errorf("%s accepted", tt.name)
+		}
+	}
+
+	if err := bc.AddTransaction(typed(worker, 20, TxHTLCClaim, HTLCClaimPayload(lock.ID, preimage))); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #2
+	if bc.GetBalance(worker.Address()) != 20 {
+		t.Fatal("claim did not pay the worker")
+	}
+	if _, err := bc.GetEscrow(lock.ID); err == nil {
+		t.Fatal("escrow still open after the claim")
+	}
+
+	// A second lock times out and is refunded at its timeout height
+	lock2, err := bc.CreateTypedTransaction(client.Address(), worker.Address(), 7, 0, TxHTLCLock, HTLCLockPayload(hashLock[:], 4, jobHash), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(lock2); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #3
+	before := bc.GetBalance(client.Address())
+	if err := bc.AddTransaction(typed(client, 7, TxHTLCRefund, HTLCRefundPayload(lock2.ID))); err != nil {
+		t.Fatal(err)
+	}
+	if b := bc.AddBlock("m"); len(b.Transactions) != 2 || bc.GetBalance(client.Address()) != before+7 {
+		t.Fatal("refund not applied")
+	}
+
+	if err := bc.ReindexState(); err != nil {
+		t.Fatal(err)
+	}
+	if bc.GetBalance(client.Address()) != before+7 || bc.GetBalance(worker.Address()) != 20 {
+		t.Fatal("replayed state differs")
+	}
+}
+
+func TestEscrowClientCannotWithholdPayment(t *testing.T) {
+	client, worker := wallet.NewWallet(), wallet.NewWallet()
+	bc := openChain(t, client.Address())
+	jobHash := JobHash([]byte("wasm"), []byte("input"))
+
+	// The worker quotes the hash lock; the client only ever sees its hash
+	preimage := EscrowPreimage(worker, jobHash)
+	hashLock := sha256.Sum256(preimage)
+	if bytes.Equal(EscrowPreimage(wallet.NewWallet(), jobHash), preimage) || bytes.Equal(EscrowPreimage(worker, JobHash(nil, nil)), preimage) {
+		t.Fatal("preimage not bound to the worker and job")
+	}
+	lock, err := bc.CreateTypedTransaction(client.Address(), worker.Address(), 20, 0, TxHTLCLock, HTLCLockPayload(hashLock[:], 5, jobHash), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(lock); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m") // #1
+
+	// The client gets the result sealed and can't read it without the preimage
+	sealed, err := SealResult(preimage, []byte("42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenResult(hashLock[:], sealed); err == nil {
+		t.Fatal("sealed result opened with the hash lock")
+	}
+
+	// Going silent doesn't stop the worker's claim or let the client refund
+	claim, err := bc.CreateTypedTransaction(worker.Address(), worker.Address(), 20, 0, TxHTLCClaim, HTLCClaimPayload(lock.ID, preimage), worker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(claim); err != nil {
+		t.Fatal(err)
+	}
+	refund, err := bc.CreateTypedTransaction(client.Address(), client.Address(), 20, 0, TxHTLCRefund, HTLCRefundPayload(lock.ID), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(refund); err == nil {
+		t.Fatal("refund accepted before the timeout")
+	}
+	bc.AddBlock("m") // #2
+	if bc.GetBalance(worker.Address()) != 20 {
+		t.Fatal("worker not paid")
+	}
+
+	// The claim on chain reveals the preimage, which opens the result
+	_, revealed, err := decodeClaimPayload(claim.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := OpenResult(revealed, sealed)
+	if err != nil || string(result) != "42" {
+		t.Fatalf("result = %q, %v", result, err)
+	}
+}
@@ -0,0 +1,222 @@
+package blockchain
+
+import (
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Key layout for the address-history index:
+//
+//	"ah_<address>_<height>_<position>" -> hash of the main-chain block
+//	"addrindex"                        -> present once the index is complete
+//
+// Height and position are zero-padded so keys sort in chain order. Entries
+// are written and deleted together with the tx_ index as blocks are
+// connected and disconnected.
+const (
+	addressPrefix   = "ah_"
+	addressIndexKey = "addrindex"
+)
+
+func addressKeyPrefix(address string) []byte {
+	return []byte(addressPrefix + address + "_")
+}
+
+func addressKey(address string, height, position int) []byte {
+	return []byte(fmt.Sprintf("%s%s_%016d_%04d", addressPrefix, address, height, position))
+}
+
+// addressKeys returns the index keys a block's transactions add. The
+// coinbase sender (and an empty genesis recipient) is not indexed.
+func addressKeys(b *Block) [][]byte {
+	var keys [][]byte
+	for i, tx := range b.Transactions {
+		if tx.From != CoinbaseSender {
+			keys = append(keys, addressKey(tx.From, b.Index, i))
+		}
+		if tx.To != tx.From && tx.To != "" {
+			keys = append(keys, addressKey(tx.To, b.Index, i))
+		}
+	}
+	return keys
+}
+
+// indexAddresses adds history entries for a connected block.
+func indexAddresses(txn *badger.Txn, b *Block) error {
+	for _, key := range addressKeys(b) {
+		if err := txn.Set(key, []byte(b.Hash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexAddresses removes history entries for a disconnected block.
+func unindexAddresses(txn *badger.Txn, b *Block) error {
+	for _, key := range addressKeys(b) {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddressTx is a confirmed transaction that sent to or from an address.
+type AddressTx struct {
+	Transaction *Transaction
+	BlockHash   string
+	Height      int
+	Timestamp   int64 // Block time
+}
+
+// GetAddressHistory returns an address's confirmed transactions on the
+// active chain, newest first, skipping the first offset and returning at
+// most limit entries.
+func (bc *Blockchain) GetAddressHistory(address string, offset, limit int) ([]AddressTx, error) {
+	return bc.scanAddress(address, true, 0, math.MaxInt, offset, limit)
+}
+
+// GetAddressHistoryRange returns an address's confirmed transactions in
+// blocks fromHeight..toHeight (inclusive), oldest first, skipping the first
+// offset and returning at most limit entries. Used for statements.
+func (bc *Blockchain) GetAddressHistoryRange(address string, fromHeight, toHeight, offset, limit int) ([]AddressTx, error) {
+	return bc.scanAddress(address, false, fromHeight, toHeight, offset, limit)
+}
+
+// scanAddress walks an address's index entries for blocks fromHeight..toHeight
+// in one read txn, so a concurrent reorg can't mix blocks from two branches.
+func (bc *Blockchain) scanAddress(address string, newestFirst bool, fromHeight, toHeight, offset, limit int) ([]AddressTx, error) {
+	prefix := addressKeyPrefix(address)
+	history := []AddressTx{}
+
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.Reverse = newestFirst
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		seek := addressKey(address, fromHeight, 0)
+		if newestFirst {
+			seek = addressKey(address, toHeight, 9999)
+		}
+
+		var block *Block
+		for it.Seek(seek); it.ValidForPrefix(prefix) && len(history) < limit; it.Next() {
+			var height, position int
+			key := it.Item().Key()
+			if _, err := fmt.Sscanf(string(key[len(prefix):]), "%016d_%04d", &height, &position); err != nil {
+				return fmt.Errorf("corrupt address index key %q: %w", key, err)
+			}
+			if height < fromHeight || height > toHeight {
+				break
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+
+			blockHash, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			// Consecutive entries usually share a block
+			if block == nil || block.Hash != string(blockHash) {
+				item, err := txn.Get(blockHash)
+				if err != nil {
+					return err
+				}
+				err = item.Value(func(val []byte) error {
+					block, err = DeserializeBlock(val)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if position >= len(block.Transactions) {
+				return fmt.Errorf("address index points past block %s", block.Hash)
+			}
+
+			history = append(history, AddressTx{
+				Transaction: block.Transactions[position],
+				BlockHash:   block.Hash,
+				Height:      block.Index,
+				Timestamp:   block.Timestamp,
+			})
+		}
+		return nil
+	})
+	return history, err
+}
+
+// ensureAddressIndex builds the address-history index for databases
+// created before it existed (or whose rebuild was interrupted).
+func (bc *Blockchain) ensureAddressIndex() error {
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(addressIndexKey))
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+	return bc.ReindexAddressHistory()
+}
+
+// ReindexAddressHistory drops the address-history index and rebuilds it from
+// the active chain.
+func (bc *Blockchain) ReindexAddressHistory() error {
+	if pruned, err := bc.PrunedHeight(); err != nil {
+		return err
+	} else if pruned > 0 {
+		return fmt.Errorf("%w below #%d, history can't be rebuilt from genesis", ErrPruned, pruned)
+	}
+
+	log.Println("[Blockchain] Rebuilding address history index...")
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(addressIndexKey))
+	})
+	if err != nil {
+		return err
+	}
+	if err := bc.Database.DropPrefix([]byte(addressPrefix)); err != nil {
+		return err
+	}
+
+	tip, err := bc.GetBlock(bc.LastHash)
+	if err != nil {
+		return err
+	}
+	wb := bc.Database.NewWriteBatch()
+	defer wb.Cancel()
+	for height := 0; height <= tip.Index; height++ {
+		hash, err := bc.GetBlockHashByHeight(height)
+		if err != nil {
+			return fmt.Errorf("missing main-chain block at height %d: %w", height, err)
+		}
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		for _, key := range addressKeys(block) {
+			if err := wb.Set(key, []byte(block.Hash)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := wb.Set([]byte(addressIndexKey), []byte{1}); err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	log.Printf("[Blockchain] Address history indexed up to block #%d", tip.Index)
+	return nil
+}
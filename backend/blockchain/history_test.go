@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func TestAddressHistory(t *testing.T) {
+	w := wallet.NewWallet()
+	bc := openChain(t, w.Address())
+	for i := 1; i <= 5; i++ {
+		tx, err := bc.CreateTransaction(w.Address(), "dest", i, 1, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+		bc.AddBlock("m")
+	}
+
+	all, err := bc.GetAddressHistory("dest", 0, 100)
+	if err != nil || len(all) != 5 {
+		t.Fatalf("history = %d entries, %v", len(all), err)
+	}
+	if all[0].Transaction.Amount != 5 || all[0].Height != 5 {
+		t.Fatalf("newest entry = %+v", all[0])
+	}
+	page, err := bc.GetAddressHistory("dest", 2, 2)
+	if err != nil || len(page) != 2 || page[0].Transaction.Amount != 3 || page[1].Transaction.Amount != 2 {
+		t.Fatalf("page = %+v, %v", page, err)
+	}
+	// Five sends and the genesis premine
+	if sender, _ := bc.GetAddressHistory(w.Address(), 0, 100); len(sender) != 6 {
+		t.Fatalf("sender history = %d entries, want 6", len(sender))
+	}
+
+	if hash, err := bc.GetTransactionBlockHash(all[0].Transaction.ID); err != nil || hash != all[0].BlockHash {
+		t.Fatalf("GetTransactionBlockHash = %s, %v", hash, err)
+	}
+	tx, err := bc.CreateTransaction(w.Address(), "dest", 1, 1, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	if bc.Mempool.Get(tx.ID) != tx || bc.Mempool.Get("unknown") != nil {
+		t.Fatal("Mempool.Get returned the wrong transaction")
+	}
+}
+
+func TestAddressHistoryFollowsReorgs(t *testing.T) {
+	w := wallet.NewWallet()
+	bc := openChain(t, w.Address())
+	for i := 1; i <= 4; i++ {
+		tx, err := bc.CreateTransaction(w.Address(), "dest", i, 0, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+		bc.AddBlock("m")
+	}
+	r, err := bc.GetAddressHistoryRange("dest", 2, 3, 0, 10)
+	if err != nil || len(r) != 2 || r[0].Height != 2 || r[1].Height != 3 {
+		t.Fatalf("range = %+v, %v", r, err)
+	}
+
+	// Replace #4 with two empty blocks mined by "miner"
+	h3, _ := bc.GetBlockHashByHeight(3)
+	b3, err := bc.GetBlock(h3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x4 := mineOn(t, bc, b3)
+	x5 := mineOn(t, bc, x4)
+	for _, b := range []*Block{x4, x5} {
+		if err := bc.ProcessBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(when string) {
+		t.Helper()
+		dest, _ := bc.GetAddressHistory("dest", 0, 10)
+		m, _ := bc.GetAddressHistory("m", 0, 10)
+		miner, _ := bc.GetAddressHistory("miner", 0, 10)
+		if len(dest) != 3 || dest[0].Height != 3 || len(m) != 3 || len(miner) != 2 {
+			t.Fatalf("%s: dest %d, m %d, miner %d entries", when, len(dest), len(m), len(miner))
+		}
+	}
+	check("after reorg")
+
+	if err := bc.ReindexAddressHistory(); err != nil {
+		t.Fatal(err)
+	}
+	check("after reindex")
+
+	bc = reopen(t, bc)
+	check("after reopen")
+	if page, _ := bc.GetAddressHistory("dest", 1, 1); len(page) != 1 || page[0].Height != 2 {
+		t.Fatalf("page = %+v", page)
+	}
+}
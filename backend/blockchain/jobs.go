@@ -0,0 +1,76 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// JobHashSize is the length of a JobHash (and of a TxJobPayment payload).
+const JobHashSize = sha256.Size
+
+// redeemedPrefix marks job payments this node has already worked for:
+// "redeemed_<txID>" -> unix time of redemption. It is local bookkeeping of
+// the worker, not chain state, so it survives reorgs and reindexing.
+const redeemedPrefix = "redeemed_"
+
+// ErrPaymentRedeemed is returned when a job payment (or escrow) was already used.
+var ErrPaymentRedeemed = errors.New("job payment already redeemed")
+
+// JobHash commits to a compute job: sha256 over the length-prefixed wasm
+// followed by the input, so a payment can't be replayed for another job.
+func JobHash(wasm, input []byte) []byte {
+	h := sha256.New()
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(wasm)))
+	h.Write(size[:])
+	h.Write(wasm)
+	h.Write(input)
+	return h.Sum(nil)
+}
+
+// RedeemJobPayment checks that txID is a confirmed job payment of at least
+// minAmount to worker for the job with jobHash, and marks it redeemed so it
+// can't pay for another run.
+func (bc *Blockchain) RedeemJobPayment(txID, worker string, jobHash []byte, minAmount int) (*Transaction, error) {
+	tx, err := bc.FindTransaction(txID)
+	if err != nil {
+		return nil, fmt.Errorf("payment %s not confirmed: %w", txID, err)
+	}
+	if tx.Type != TxJobPayment {
+		return nil, fmt.Errorf("payment %s is a %s, not a job payment", txID, tx.Type)
+	}
+	if tx.To != worker {
+		return nil, fmt.Errorf("payment %s is addressed to %s, not this worker", txID, tx.To)
+	}
+	if !bytes.Equal(tx.Payload, jobHash) {
+		return nil, fmt.Errorf("payment %s is for a different job", txID)
+	}
+	if tx.Amount < minAmount {
+		return nil, fmt.Errorf("payment %s is %d coins, need %d", txID, tx.Amount, minAmount)
+	}
+
+	if err := bc.markRedeemed(txID); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// markRedeemed records that this node has worked for a payment, failing if
+// it already has. The check and the mark happen in one Badger transaction.
+func (bc *Blockchain) markRedeemed(txID string) error {
+	return bc.Database.Update(func(txn *badger.Txn) error {
+		key := []byte(redeemedPrefix + txID)
+		if _, err := txn.Get(key); err == nil {
+			return fmt.Errorf("%w: %s", ErrPaymentRedeemed, txID)
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.Set(key, binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix())))
+	})
+}
@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func TestRedeemJobPayment(t *testing.T) {
+	w := wallet.NewWallet()
+	bc := openChain(t, w.Address())
+	job := JobHash([]byte("wasm"), []byte("in"))
+
+	short, err := bc.CreateTypedTransaction(w.Address(), "worker", 5, 0, TxJobPayment, []byte("short"), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(short); err == nil {
+		t.Fatal("job payment without a job hash accepted")
+	}
+	pay, err := bc.CreateTypedTransaction(w.Address(), "worker", 5, 0, TxJobPayment, job, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(pay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.RedeemJobPayment(pay.ID, "worker", job, 5); err == nil {
+		t.Fatal("unconfirmed payment redeemed")
+	}
+	bc.AddBlock("m")
+
+	tests := []struct {
+		name   string
+		worker string
+		job    []byte
+		amount int
+	}{
+		{"other worker", "other", job, 5},
+		{"other job", "worker", JobHash([]byte("wasm"), []byte("in2")), 5},
+		// The length prefix keeps wasm and input from sliding into each other
+		{"shifted job", "worker", JobHash([]byte("was"), []byte("min")), 5},
+		{"too little", "worker", job, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := bc.RedeemJobPayment(pay.ID, tt.worker, tt.job, tt.amount); err == nil {
+				t.Fatal("payment redeemed")
+			}
+		})
+	}
+
+	if _, err := bc.RedeemJobPayment(pay.ID, "worker", job, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.RedeemJobPayment(pay.ID, "worker", job, 5); !errors.Is(err, ErrPaymentRedeemed) {
+		t.Fatalf("second redemption: got %v, want ErrPaymentRedeemed", err)
+	}
+}
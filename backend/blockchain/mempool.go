@@ -0,0 +1,247 @@
+package blockchain
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mempool limits
+const (
+	// MaxMempoolSize is the total number of pending transactions kept.
+	MaxMempoolSize = 5000
+	// MaxTxsPerSender caps pending transactions from a single address.
+	MaxTxsPerSender = 25
+	// MempoolExpiry is how long a transaction may wait before it is dropped.
+	MempoolExpiry = 3 * time.Hour
+)
+
+var (
+	// ErrTxConflict is returned when a pending transaction from the same
+	// sender already uses the nonce and pays at least the same fee.
+	ErrTxConflict = errors.New("conflicts with a pending transaction")
+	// ErrMempoolFull is returned when the pool is full and the transaction's
+	// fee is too low to evict anything.
+	ErrMempoolFull = errors.New("mempool is full")
+)
+
+type mempoolEntry struct {
+	tx    *Transaction
+	added time.Time
+}
+
+// Mempool holds transactions waiting to be mined. Each sender's transactions
+// form a gap-free nonce sequence; a transaction for an already pending nonce
+// replaces the old one only if it pays a higher fee.
+//
+// The Mempool only enforces pool policy. Checking transactions against chain
+// state is done by Blockchain.AddTransaction before calling Add.
+type Mempool struct {
+	mu       sync.Mutex
+	txs      map[string]*mempoolEntry         // By tx ID
+	bySender map[string]map[int]*mempoolEntry // Sender -> Nonce -> entry
+}
+
+// NewMempool creates an empty mempool.
+func NewMempool() *Mempool {
+	return &Mempool{
+		txs:      make(map[string]*mempoolEntry),
+		bySender: make(map[string]map[int]*mempoolEntry),
+	}
+}
+
+// Add inserts a transaction, replacing a lower-fee transaction with the same
+// sender and nonce, and evicting the cheapest transaction if the pool is full.
+func (mp *Mempool) Add(tx *Transaction) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if _, ok := mp.txs[tx.ID]; ok {
+		return fmt.Errorf("%w: %s is in the mempool", ErrTxKnown, tx.ID)
+	}
+
+	pending := mp.bySender[tx.From]
+	if old, ok := pending[tx.Nonce]; ok {
+		if tx.Fee <= old.tx.Fee {
+			return fmt.Errorf("%w: %s has nonce %d with fee %d", ErrTxConflict, old.tx.ID, tx.Nonce, old.tx.Fee)
+		}
+		mp.remove(old.tx)
+		mp.insert(tx)
+		return nil
+	}
+
+	if len(pending) >= MaxTxsPerSender {
+		return fmt.Errorf("sender %s has %d pending transactions", tx.From, len(pending))
+	}
+	if len(mp.txs) >= MaxMempoolSize {
+		victim := mp.cheapestEvictable(tx.From)
+		if victim == nil || victim.Fee >= tx.Fee {
+			return ErrMempoolFull
+		}
+		mp.remove(victim)
+	}
+	mp.insert(tx)
+	return nil
+}
+
+// Has reports whether a transaction is pending.
+func (mp *Mempool) Has(id string) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	_, ok := mp.txs[id]
+	return ok
+}
+
+// Get returns a pending transaction, or nil if it is not in the pool.
+func (mp *Mempool) Get(id string) *Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if entry, ok := mp.txs[id]; ok {
+		return entry.tx
+	}
+	return nil
+}
+
+// Len returns the number of pending transactions.
+func (mp *Mempool) Len() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return len(mp.txs)
+}
+
+// SenderTransactions returns an address's pending transactions by nonce.
+func (mp *Mempool) SenderTransactions(address string) []*Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.senderQueue(address)
+}
+
+// Transactions returns every pending transaction in mining order: highest
+// fee first, but never ahead of a lower nonce from the same sender.
+func (mp *Mempool) Transactions() []*Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	queues := make(senderQueues, 0, len(mp.bySender))
+	for sender := range mp.bySender {
+		queues = append(queues, mp.senderQueue(sender))
+	}
+	heap.Init(&queues)
+
+	ordered := make([]*Transaction, 0, len(mp.txs))
+	for queues.Len() > 0 {
+		ordered = append(ordered, queues[0][0])
+		queues[0] = queues[0][1:]
+		if len(queues[0]) == 0 {
+			heap.Pop(&queues)
+		} else {
+			heap.Fix(&queues, 0)
+		}
+	}
+	return ordered
+}
+
+// Remove drops transactions included in a block, along with any pending
+// transaction that spent the same sender nonce (a double-spend that lost).
+func (mp *Mempool) Remove(included []*Transaction) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, tx := range included {
+		if entry, ok := mp.txs[tx.ID]; ok {
+			mp.remove(entry.tx)
+		}
+		if entry, ok := mp.bySender[tx.From][tx.Nonce]; ok {
+			mp.remove(entry.tx)
+		}
+	}
+}
+
+// Expire drops transactions older than MempoolExpiry, and every later nonce
+// from the same sender since those can no longer be mined. It returns the
+// number of transactions removed.
+func (mp *Mempool) Expire(now time.Time) int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	removed := 0
+	for sender := range mp.bySender {
+		expired := false
+		for _, tx := range mp.senderQueue(sender) {
+			if !expired && now.Sub(mp.txs[tx.ID].added) < MempoolExpiry {
+				continue
+			}
+			expired = true
+			mp.remove(tx)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (mp *Mempool) insert(tx *Transaction) {
+	entry := &mempoolEntry{tx: tx, added: time.Now()}
+	mp.txs[tx.ID] = entry
+	if mp.bySender[tx.From] == nil {
+		mp.bySender[tx.From] = make(map[int]*mempoolEntry)
+	}
+	mp.bySender[tx.From][tx.Nonce] = entry
+}
+
+func (mp *Mempool) remove(tx *Transaction) {
+	delete(mp.txs, tx.ID)
+	delete(mp.bySender[tx.From], tx.Nonce)
+	if len(mp.bySender[tx.From]) == 0 {
+		delete(mp.bySender, tx.From)
+	}
+}
+
+// senderQueue returns a sender's pending transactions sorted by nonce.
+func (mp *Mempool) senderQueue(address string) []*Transaction {
+	queue := make([]*Transaction, 0, len(mp.bySender[address]))
+	for _, entry := range mp.bySender[address] {
+		queue = append(queue, entry.tx)
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i].Nonce < queue[j].Nonce })
+	return queue
+}
+
+// cheapestEvictable returns the lowest-fee transaction that can be evicted.
+// Only the last nonce of each sender qualifies (removing an earlier one would
+// strand the rest), and the incoming transaction's own sender is skipped.
+func (mp *Mempool) cheapestEvictable(exclude string) *Transaction {
+	var victim *Transaction
+	for sender, pending := range mp.bySender {
+		if sender == exclude {
+			continue
+		}
+		var last *Transaction
+		for _, entry := range pending {
+			if last == nil || entry.tx.Nonce > last.Nonce {
+				last = entry.tx
+			}
+		}
+		if victim == nil || last.Fee < victim.Fee {
+			victim = last
+		}
+	}
+	return victim
+}
+
+// senderQueues is a max-heap of per-sender nonce queues, keyed on the fee of
+// each queue's next transaction.
+type senderQueues [][]*Transaction
+
+func (q senderQueues) Len() int           { return len(q) }
+func (q senderQueues) Less(i, j int) bool { return q[i][0].Fee > q[j][0].Fee }
+func (q senderQueues) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *senderQueues) Push(x any)        { *q = append(*q, x.([]*Transaction)) }
+func (q *senderQueues) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,137 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"decentralized-net/wallet"
+)
+
+func TestMempoolOrdering(t *testing.T) {
+	mp := NewMempool()
+	// Highest fee first, but a sender's transactions stay in nonce order
+	for _, tx := range []*Transaction{
+		{ID: "x0", From: "x", Nonce: 0, Fee: 1},
+		{ID: "x1", From: "x", Nonce: 1, Fee: 100},
+		{ID: "y0", From: "y", Nonce: 0, Fee: 50},
+		{ID: "z0", From: "z", Nonce: 0, Fee: 2},
+	} {
+		if err := mp.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, tx := range mp.Transactions() {
+		got = append(got, tx.ID)
+	}
+	if want := "[y0 z0 x0 x1]"; fmt.Sprint(got) != want {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+
+	// Expiring x0 strands x1, so both go
+	mp.txs["x0"].added = time.Now().Add(-MempoolExpiry)
+	if n := mp.Expire(time.Now()); n != 2 || mp.Has("x1") || mp.Len() != 2 {
+		t.Fatalf("expired %d, %d left", n, mp.Len())
+	}
+	if n := mp.Expire(time.Now().Add(MempoolExpiry)); n != 2 || mp.Len() != 0 {
+		t.Fatalf("expired %d, %d left", n, mp.Len())
+	}
+}
+
+func TestMempoolLimits(t *testing.T) {
+	mp := NewMempool()
+	for i := 0; i < MaxTxsPerSender; i++ {
+		if err := mp.Add(&Transaction{ID: fmt.Sprint("s", i), From: "s", Nonce: i, Fee: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mp.Add(&Transaction{ID: "s-extra", From: "s", Nonce: MaxTxsPerSender, Fee: 1}); err == nil {
+		t.Fatal("sender exceeded MaxTxsPerSender")
+	}
+
+	// Fill the pool; a cheap newcomer is refused, a better one evicts the
+	// cheapest last-nonce transaction of another sender
+	for i := mp.Len(); i < MaxMempoolSize; i++ {
+		mp.Add(&Transaction{ID: fmt.Sprint("f", i), From: fmt.Sprint("f", i), Fee: 2})
+	}
+	if err := mp.Add(&Transaction{ID: "cheap", From: "n", Fee: 1}); !errors.Is(err, ErrMempoolFull) {
+		t.Fatalf("got %v, want ErrMempoolFull", err)
+	}
+	if err := mp.Add(&Transaction{ID: "rich", From: "n", Fee: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if mp.Len() != MaxMempoolSize || !mp.Has("s0") || mp.Has(fmt.Sprint("s", MaxTxsPerSender-1)) {
+		t.Fatal("wrong transaction evicted")
+	}
+}
+
+func TestMempoolAdmission(t *testing.T) {
+	w := wallet.NewWallet()
+	bc := openChain(t, w.Address())
+	newTx := func(amount, fee, nonce int) *Transaction {
+		tx := &Transaction{From: w.Address(), To: "r", Amount: amount, Fee: fee, Nonce: nonce, Timestamp: time.Now().UnixNano()}
+		if err := tx.Sign(w); err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	a0, a1 := newTx(10, 1, 0), newTx(10, 5, 1)
+	if err := bc.AddTransaction(a0); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(a1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		tx   *Transaction
+		want error // nil means any error
+	}{
+		{"duplicate", a1, ErrTxKnown},
+		{"nonce gap", newTx(10, 0, 3), nil},
+		{"negative fee", newTx(10, -1, 2), nil},
+		{"replacement without a higher fee", newTx(11, 1, 0), ErrTxConflict},
+		{"replacement the sender can't afford", newTx(999995, 2, 0), ErrTxConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := bc.AddTransaction(tt.tx)
+			if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// A higher fee replaces the pending transaction with the same nonce
+	r0 := newTx(12, 2, 0)
+	if err := bc.AddTransaction(r0); err != nil {
+		t.Fatal(err)
+	}
+	if bc.Mempool.Has(a0.ID) || bc.Mempool.Len() != 2 || bc.NextNonce(w.Address()) != 2 {
+		t.Fatal("replacement not applied")
+	}
+
+	// Mining takes both and pays their fees to the miner; a pending
+	// double-spend of a mined nonce goes
+	b := bc.AddBlock("m")
+	if len(b.Transactions) != 3 || b.Transactions[1].ID != r0.ID || bc.Mempool.Len() != 0 {
+		t.Fatalf("mined %d transactions, %d left pending", len(b.Transactions), bc.Mempool.Len())
+	}
+	if got := immature(t, bc, "m"); got != bc.Params.Subsidy(1)+2+5 {
+		t.Fatalf("miner reward = %d", got)
+	}
+	if got := bc.GetBalance(w.Address()); got != 1000000-12-2-10-5 {
+		t.Fatalf("sender balance = %d", got)
+	}
+	bc.Mempool.Add(newTx(1, 9, 2))
+	loser := newTx(1, 0, 2)
+	bc.Mempool.Remove([]*Transaction{loser})
+	if bc.Mempool.Len() != 0 {
+		t.Fatal("double-spend of a mined nonce left pending")
+	}
+}
@@ -0,0 +1,180 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Leaves and inner nodes are hashed with different prefixes so an inner node
+// can never be passed off as a transaction.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleProof shows that a transaction is included under a block's MerkleRoot.
+// Tx is the hex of the transaction's serialized bytes, the leaf the tree is
+// built over. Siblings are listed from the leaf level up; Index is the tx
+// position in the block and tells, at each level, whether the sibling sits
+// left or right.
+type MerkleProof struct {
+	TxID     string
+	Tx       string
+	Index    int
+	Siblings []string
+}
+
+func merkleLeaf(data []byte) []byte {
+	h := sha256.Sum256(append([]byte{merkleLeafPrefix}, data...))
+	return h[:]
+}
+
+func merkleNode(left, right []byte) []byte {
+	data := make([]byte, 0, 1+len(left)+len(right))
+	data = append(data, merkleNodePrefix)
+	data = append(data, left...)
+	data = append(data, right...)
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// merkleLevels builds every level of the tree over the serialized
+// transactions. Hashing the full encoding rather than the ID makes the block
+// hash commit to the signatures and public keys too, so a relay can't alter
+// them without changing the block.
+func merkleLevels(txs []*Transaction) [][][]byte {
+	leaves := make([][]byte, len(txs))
+	for i, tx := range txs {
+		leaves[i] = merkleLeaf(tx.Serialize())
+	}
+	return merkleTree(leaves)
+}
+
+// merkleTree builds every level of the tree, leaves first. An odd node at
+// the end of a level is paired with itself.
+func merkleTree(leaves [][]byte) [][][]byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+	level := leaves
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, merkleNode(level[i], right))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// merkleMutated reports whether any level pairs two equal nodes. Because an
+// odd node is paired with itself, [..., x] and [..., x, x] hash to the same
+// root (CVE-2012-2459); such a tree is only valid in its shorter form.
+func merkleMutated(levels [][][]byte) bool {
+	for _, level := range levels {
+		for i := 0; i+1 < len(level); i += 2 {
+			if bytes.Equal(level[i], level[i+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckMerkleRoot verifies that a block's transactions hash to its
+// MerkleRoot and are not a mutated copy of another body with the same root.
+// Run it before storing a block or blaming its hash: a relay can duplicate
+// transactions without changing the hash, so those failures say nothing
+// about the block the miner produced.
+func CheckMerkleRoot(b *Block) error {
+	seen := make(map[string]bool, len(b.Transactions))
+	for _, tx := range b.Transactions {
+		if seen[tx.ID] {
+			return fmt.Errorf("block %s repeats transaction %s", b.Hash, tx.ID)
+		}
+		seen[tx.ID] = true
+	}
+
+	levels := merkleLevels(b.Transactions)
+	if merkleMutated(levels) {
+		return fmt.Errorf("block %s has a mutated merkle tree", b.Hash)
+	}
+	if merkleRoot(levels) != b.MerkleRoot {
+		return fmt.Errorf("block %s has an invalid merkle root", b.Hash)
+	}
+	return nil
+}
+
+// ComputeMerkleRoot returns the hex Merkle root of the transactions.
+func ComputeMerkleRoot(txs []*Transaction) string {
+	return merkleRoot(merkleLevels(txs))
+}
+
+func merkleRoot(levels [][][]byte) string {
+	if levels == nil {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+	return hex.EncodeToString(levels[len(levels)-1][0])
+}
+
+// NewMerkleProof builds the inclusion proof for the transaction at index.
+func NewMerkleProof(txs []*Transaction, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(txs) {
+		return nil, fmt.Errorf("transaction index %d out of range", index)
+	}
+
+	tx := txs[index]
+	proof := &MerkleProof{TxID: tx.ID, Tx: hex.EncodeToString(tx.Serialize()), Index: index}
+	levels := merkleLevels(txs)
+	pos := index
+	for _, level := range levels[:len(levels)-1] {
+		sibling := pos ^ 1
+		if sibling >= len(level) {
+			sibling = pos // Odd node paired with itself
+		}
+		proof.Siblings = append(proof.Siblings, hex.EncodeToString(level[sibling]))
+		pos /= 2
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProof checks that the proof links its transaction to root and
+// that the transaction it carries has ID TxID.
+func VerifyMerkleProof(proof *MerkleProof, root string) bool {
+	if proof == nil || proof.Index < 0 {
+		return false
+	}
+	data, err := hex.DecodeString(proof.Tx)
+	if err != nil {
+		return false
+	}
+	tx, err := DeserializeTransaction(data)
+	if err != nil || tx.ID != proof.TxID {
+		return false
+	}
+
+	current := merkleLeaf(data)
+	pos := proof.Index
+	for _, s := range proof.Siblings {
+		sibling, err := hex.DecodeString(s)
+		if err != nil || len(sibling) != sha256.Size {
+			return false
+		}
+		if pos%2 == 0 {
+			current = merkleNode(current, sibling)
+		} else {
+			current = merkleNode(sibling, current)
+		}
+		pos /= 2
+	}
+	return pos == 0 && hex.EncodeToString(current) == root
+}
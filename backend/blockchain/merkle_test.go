@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func coinbases(n int) []*Transaction {
+	txs := make([]*Transaction, n)
+	for i := range txs {
+		txs[i] = NewCoinbaseTx(fmt.Sprint("addr", i), 1, i)
+	}
+	return txs
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		txs := coinbases(n)
+		root := ComputeMerkleRoot(txs)
+		for i := range txs {
+			proof, err := NewMerkleProof(txs, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyMerkleProof(proof, root) {
+				t.Errorf("n=%d: proof for tx %d rejected", n, i)
+			}
+		}
+	}
+}
+
+func TestMerkleProofRejectsTampering(t *testing.T) {
+	txs := coinbases(5)
+	root := ComputeMerkleRoot(txs)
+	other := NewCoinbaseTx("someone else", 1, 2)
+
+	tests := []struct {
+		name   string
+		tamper func(p *MerkleProof)
+	}{
+		{"wrong index", func(p *MerkleProof) { p.Index ^= 1 }},
+		{"negative index", func(p *MerkleProof) { p.Index = -1 }},
+		{"wrong sibling", func(p *MerkleProof) { p.Siblings[0] = p.Siblings[1] }},
+		{"missing sibling", func(p *MerkleProof) { p.Siblings = p.Siblings[1:] }},
+		{"malformed sibling", func(p *MerkleProof) { p.Siblings[0] = "zz" }},
+		{"other tx ID", func(p *MerkleProof) { p.TxID = other.ID }},
+		{"other tx bytes", func(p *MerkleProof) { p.Tx = fmt.Sprintf("%x", other.Serialize()) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof, err := NewMerkleProof(txs, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(proof)
+			if VerifyMerkleProof(proof, root) {
+				t.Fatal("tampered proof accepted")
+			}
+		})
+	}
+
+	if _, err := NewMerkleProof(txs, len(txs)); err == nil {
+		t.Fatal("proof for an out-of-range index")
+	}
+}
+
+func TestMerkleRootCoversSignatures(t *testing.T) {
+	tx := signedTx(t, wallet.NewWallet(), TxTransfer, nil)
+	txs := []*Transaction{NewCoinbaseTx("m", 1, 1), tx}
+	root := ComputeMerkleRoot(txs)
+
+	stripped := *tx
+	stripped.Signature = "00|00"
+	if ComputeMerkleRoot([]*Transaction{txs[0], &stripped}) == root {
+		t.Fatal("changing a signature kept the Merkle root")
+	}
+}
+
+func TestCheckMerkleRootRejectsMutation(t *testing.T) {
+	block := func(txs ...*Transaction) *Block {
+		return &Block{BlockHeader: BlockHeader{Hash: "b", MerkleRoot: ComputeMerkleRoot(txs)}, Transactions: txs}
+	}
+	five, six := coinbases(5), coinbases(6)
+
+	// Repeating the odd node of a level, at the leaves or one level up,
+	// keeps the root of the shorter tree
+	tests := []struct {
+		name            string
+		honest, mutated []*Transaction
+	}{
+		{"leaf level", five, append(five[:5:5], five[4])},
+		{"inner level", six, append(six[:6:6], six[4], six[5])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckMerkleRoot(block(tt.honest...)); err != nil {
+				t.Fatal(err)
+			}
+			if ComputeMerkleRoot(tt.mutated) != ComputeMerkleRoot(tt.honest) {
+				t.Fatal("mutation changed the root")
+			}
+			if err := CheckMerkleRoot(block(tt.mutated...)); err == nil {
+				t.Fatal("mutated tree accepted")
+			}
+		})
+	}
+
+	leaves := [][]byte{merkleLeaf([]byte("a")), merkleLeaf([]byte("b")), merkleLeaf([]byte("c"))}
+	if merkleMutated(merkleTree(leaves)) || !merkleMutated(merkleTree(append(leaves, leaves[2]))) {
+		t.Fatal("merkleMutated misreports equal sibling leaves")
+	}
+}
+
+func TestGetMerkleProof(t *testing.T) {
+	alice := wallet.NewWallet()
+	bc := openChain(t, alice.Address())
+	genesis := tipBlock(t, bc)
+
+	txs := []*Transaction{
+		transfer(t, alice, "bob", 1, 0),
+		transfer(t, alice, "bob", 2, 1),
+		transfer(t, alice, "bob", 3, 2),
+	}
+	b := mineOn(t, bc, genesis, txs...)
+
+	// Reordering the transactions keeps the header but breaks the root
+	swapped := *b
+	swapped.Transactions = []*Transaction{txs[1], txs[0], txs[2]}
+	if err := bc.ProcessBlock(&swapped); err == nil {
+		t.Fatal("block with transactions not matching its Merkle root accepted")
+	}
+	if err := bc.ProcessBlock(b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tx := range txs {
+		proof, header, err := bc.GetMerkleProof(tx.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Hash != b.Hash || !VerifyMerkleProof(proof, header.MerkleRoot) {
+			t.Fatalf("proof for %s does not verify against its block", tx.ID)
+		}
+	}
+	if _, _, err := bc.GetMerkleProof("unknown"); err == nil {
+		t.Fatal("proof for an unknown transaction")
+	}
+}
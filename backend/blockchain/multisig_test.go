@@ -0,0 +1,92 @@
+package blockchain
+
+import (
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func TestMultisigScript(t *testing.T) {
+	a, b, c := wallet.NewWallet(), wallet.NewWallet(), wallet.NewWallet()
+	ka, _ := a.PublicKeyHex()
+	kb, _ := b.PublicKeyHex()
+	kc, _ := c.PublicKeyHex()
+
+	script, err := wallet.NewMultisigScript(2, []string{kc, ka, kb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted, err := wallet.NewMultisigScript(2, []string{ka, kb, kc})
+	if err != nil || sorted.Address() != script.Address() {
+		t.Fatal("key order changed the multisig address")
+	}
+	decoded, err := wallet.DecodeMultisigScript(script.Encode())
+	if err != nil || decoded.Address() != script.Address() {
+		t.Fatalf("decoded script: %v", err)
+	}
+	if !wallet.IsMultisigScript(script.Encode()) || wallet.IsMultisigScript(ka) {
+		t.Fatal("IsMultisigScript misclassified a key")
+	}
+	for _, keys := range [][]string{{ka, ka}, {ka}} {
+		if _, err := wallet.NewMultisigScript(2, keys); err == nil {
+			t.Errorf("2-of-%d script with keys %d accepted", len(keys), len(keys))
+		}
+	}
+}
+
+func TestMultisigTransaction(t *testing.T) {
+	a, b, c, funder := wallet.NewWallet(), wallet.NewWallet(), wallet.NewWallet(), wallet.NewWallet()
+	var keys []string
+	for _, w := range []*wallet.Wallet{a, b, c} {
+		key, _ := w.PublicKeyHex()
+		keys = append(keys, key)
+	}
+	script, err := wallet.NewMultisigScript(2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := openChain(t, funder.Address())
+	fund, err := bc.CreateTransaction(funder.Address(), script.Address(), 100, 0, funder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(fund); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m")
+
+	tx := &Transaction{From: script.Address(), To: "dest", Amount: 30, Fee: 1, Timestamp: 1767225600}
+	if err := tx.SignMultisig(script, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AddTransaction(tx); err == nil {
+		t.Fatal("1-of-2 signed transaction accepted")
+	}
+	if err := tx.SignMultisig(script, funder); err == nil {
+		t.Fatal("signature from a key outside the script accepted")
+	}
+	if err := tx.SignMultisig(script, c); err != nil {
+		t.Fatal(err)
+	}
+	relayed, err := DeserializeTransaction(tx.Serialize())
+	if err != nil || relayed.ID != tx.ID {
+		t.Fatalf("round trip: %v", err)
+	}
+	if err := bc.AddTransaction(relayed); err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("m")
+	if bc.GetBalance("dest") != 30 || bc.GetBalance(script.Address()) != 69 {
+		t.Fatal("multisig spend not applied")
+	}
+
+	// A signature copied into another signer's slot doesn't count
+	forged := &Transaction{From: script.Address(), To: "dest", Amount: 1, Nonce: 1, Timestamp: 1767225600}
+	forged.SignMultisig(script, a)
+	forged.SignMultisig(script, b)
+	forged.Signatures[2] = forged.Signatures[0]
+	if err := bc.AddTransaction(forged); err == nil {
+		t.Fatal("copied signature accepted")
+	}
+}
@@ -0,0 +1,195 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"time"
+
+	"decentralized-net/wallet"
+)
+
+// NetworkParams holds everything that differs between networks: genesis,
+// consensus rules and the names used on the wire. Every node on a network
+// must use the same values.
+type NetworkParams struct {
+	Name string
+
+	// DataDir holds this network's chain databases, so networks never share
+	// a directory.
+	DataDir string
+	// ProtocolPrefix namespaces pubsub topics and stream protocols, so nodes
+	// only gossip and sync with peers on the same network.
+	ProtocolPrefix string
+
+	// Genesis block. It is built from these fields alone, so every node
+	// derives the same genesis hash.
+	GenesisTimestamp int64
+	// GenesisAddress receives GenesisPremine, which (unlike later rewards)
+	// is spendable immediately.
+	GenesisAddress string
+	GenesisPremine int
+
+	// PowLimit is the easiest target a block may have.
+	PowLimit *big.Int
+	// GenesisBits is the starting target.
+	GenesisBits uint32
+	// TargetBlockTime is the block interval retargeting aims for.
+	TargetBlockTime time.Duration
+	// RetargetInterval is the number of blocks between target adjustments.
+	// Zero keeps the genesis target forever.
+	RetargetInterval int
+
+	// InitialSubsidy is the newly minted block reward before any halving.
+	InitialSubsidy int
+	// HalvingInterval is the number of blocks between subsidy halvings.
+	HalvingInterval int
+	// CoinbaseMaturity is the number of blocks that must be built on top of
+	// a coinbase before its reward can be spent.
+	CoinbaseMaturity int
+
+	// MineOnDemand turns off the background miner; blocks are only mined
+	// when explicitly requested.
+	MineOnDemand bool
+}
+
+// pow2 returns 2^n - 1, the largest hash with 256-n leading zero bits.
+func pow2(n uint) *big.Int {
+	return new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), n), big.NewInt(1))
+}
+
+// RegTestGenesisSeed is the public seed of the regtest premine key
+// (wallet.FromSeed), so test scripts start with spendable coins.
+const RegTestGenesisSeed = "decentralized-net regtest premine"
+
+// MainNetParams are the rules of the public network. The genesis block is
+// the same for every node, so there is no per-node premine any more, and no
+// shared key exists to hold one: main and testnet coins all come from mining.
+var MainNetParams = &NetworkParams{
+	Name:             "main",
+	DataDir:          "./data",
+	ProtocolPrefix:   "/decentralized-net",
+	GenesisTimestamp: 1767225600, // 2026-01-01 00:00:00 UTC
+	PowLimit:         pow2(248),
+	GenesisPremine:   0, // see above
+	GenesisBits:      BigToCompact(pow2(240)),
+	TargetBlockTime:  30 * time.Second,
+	RetargetInterval: 20,
+	InitialSubsidy:   50,
+	HalvingInterval:  210000,
+	CoinbaseMaturity: 100,
+}
+
+// TestNetParams are for the shared test network: easier difficulty, faster
+// blocks and quicker maturity.
+var TestNetParams = &NetworkParams{
+	Name:             "testnet",
+	DataDir:          "./data/testnet",
+	ProtocolPrefix:   "/decentralized-net/testnet",
+	GenesisTimestamp: 1767225600,
+	GenesisPremine:   0, // like main
+	PowLimit:         pow2(252),
+	GenesisBits:      BigToCompact(pow2(248)),
+	TargetBlockTime:  10 * time.Second,
+	RetargetInterval: 10,
+	InitialSubsidy:   50,
+	HalvingInterval:  210000,
+	CoinbaseMaturity: 10,
+}
+
+// RegTestParams are for local and automated testing. Blocks are trivial to
+// mine and are only produced on demand, and the genesis pays the old
+// 1,000,000 coin premine to the well-known RegTestGenesisSeed key.
+var RegTestParams = &NetworkParams{
+	Name:             "regtest",
+	DataDir:          "./data/regtest",
+	ProtocolPrefix:   "/decentralized-net/regtest",
+	GenesisTimestamp: 1767225600,
+	PowLimit:         pow2(255),
+	GenesisBits:      BigToCompact(pow2(255)),
+	TargetBlockTime:  10 * time.Second,
+	RetargetInterval: 0,
+	GenesisAddress:   wallet.FromSeed(RegTestGenesisSeed).Address(),
+	GenesisPremine:   1000000,
+	InitialSubsidy:   50,
+	HalvingInterval:  150,
+	CoinbaseMaturity: 10,
+	MineOnDemand:     true,
+}
+
+// ParamsByName returns the parameters of a network ("main", "testnet" or
+// "regtest").
+func ParamsByName(name string) (*NetworkParams, error) {
+	for _, p := range []*NetworkParams{MainNetParams, TestNetParams, RegTestParams} {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %q", name)
+}
+
+// Subsidy returns the newly minted reward for the block at height.
+func (p *NetworkParams) Subsidy(height int) int {
+	halvings := height / p.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return p.InitialSubsidy >> uint(halvings)
+}
+
+// GenesisBlock builds (and mines) the network's first block.
+func (p *NetworkParams) GenesisBlock() *Block {
+	coinbase := &Transaction{
+		From:      CoinbaseSender,
+		To:        p.GenesisAddress,
+		Amount:    p.GenesisPremine,
+		Timestamp: p.GenesisTimestamp,
+	}
+	coinbase.ID = coinbase.CalculateHash()
+
+	genesis := NewBlock([]*Transaction{coinbase}, "0", 0, p.GenesisBits)
+	genesis.Timestamp = p.GenesisTimestamp
+	MineBlock(genesis)
+	return genesis
+}
+
+// ChainPath returns the database directory for a node on this network.
+func (p *NetworkParams) ChainPath(nodeID string) string {
+	return filepath.Join(p.DataDir, "blockchain_"+nodeID)
+}
+
+// BlockTopic is the pubsub topic for new blocks.
+func (p *NetworkParams) BlockTopic() string {
+	return p.ProtocolPrefix + "/blocks/1.0.0"
+}
+
+// TxTopic is the pubsub topic for pending transactions.
+func (p *NetworkParams) TxTopic() string {
+	return p.ProtocolPrefix + "/transactions/1.0.0"
+}
+
+// SyncProtocol is the stream protocol for downloading chain history.
+func (p *NetworkParams) SyncProtocol() string {
+	return p.ProtocolPrefix + "/sync/1.2.0"
+}
+
+// ComputeProtocol is the stream protocol for compute jobs paid on chain.
+func (p *NetworkParams) ComputeProtocol() string {
+	return p.ProtocolPrefix + "/compute/1.0.0"
+}
+
+// ChannelProtocol is the stream protocol for compute jobs paid over
+// payment channels.
+func (p *NetworkParams) ChannelProtocol() string {
+	return p.ProtocolPrefix + "/channel/1.0.0"
+}
+
+// DealProtocol is the stream protocol for storing shards under deals.
+func (p *NetworkParams) DealProtocol() string {
+	return p.ProtocolPrefix + "/deal/1.0.0"
+}
+
+// ProofProtocol is the stream protocol for off-chain storage audits.
+func (p *NetworkParams) ProofProtocol() string {
+	return p.ProtocolPrefix + "/proof/1.0.0"
+}
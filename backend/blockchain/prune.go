@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Pruning. A node with PruneDepth set drops the bodies of main-chain blocks
+// more than PruneDepth below the tip, with their undo records and their
+// tx_ and address-history entries. Headers, the height and work indexes and
+// the account state stay, so the node still validates new blocks, answers
+// balance queries and serves the recent blocks and transactions.
+//
+//	"pruned" -> height of the oldest main-chain block whose body is stored
+//
+// The key is absent on a full chain. A pruned node can't follow a reorg
+// deeper than PruneDepth, nor rebuild its state or history from genesis.
+const prunedKey = "pruned"
+
+// MinPruneDepth is the fewest recent block bodies a pruned node keeps.
+const MinPruneDepth = 288
+
+// ErrPruned is returned for block bodies a pruned node no longer stores.
+var ErrPruned = errors.New("block pruned")
+
+// PrunedHeight returns the height of the oldest main-chain block whose body
+// is stored: 0 unless the chain was pruned or loaded from a snapshot.
+func (bc *Blockchain) PrunedHeight() (int, error) {
+	height := 0
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(prunedKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			height, err = strconv.Atoi(string(val))
+			return err
+		})
+	})
+	return height, err
+}
+
+// Prune drops the block bodies that are more than PruneDepth below the tip
+// and returns how many it dropped. It does nothing when PruneDepth is 0.
+func (bc *Blockchain) Prune() (int, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.prune()
+}
+
+// prune is Prune without locking; callers must hold bc.mu.
+func (bc *Blockchain) prune() (int, error) {
+	if bc.PruneDepth <= 0 {
+		return 0, nil
+	}
+	from, err := bc.PrunedHeight()
+	if err != nil {
+		return 0, err
+	}
+	tip, err := bc.GetHeader(bc.LastHash)
+	if err != nil {
+		return 0, err
+	}
+
+	keepFrom := tip.Index - max(bc.PruneDepth, MinPruneDepth) + 1
+	for height := from; height < keepFrom; height++ {
+		if err := bc.pruneBlock(height); err != nil {
+			return height - from, fmt.Errorf("pruning block #%d: %w", height, err)
+		}
+	}
+	return max(keepFrom-from, 0), nil
+}
+
+// pruneBlock drops the body of the main-chain block at height and everything
+// indexed from it, and moves the pruned height past it in the same
+// transaction, so an interrupted prune picks up where it stopped.
+func (bc *Blockchain) pruneBlock(height int) error {
+	hash, err := bc.GetBlockHashByHeight(height)
+	if err != nil {
+		return err
+	}
+	block, err := bc.GetBlock(hash)
+	if err != nil {
+		return err
+	}
+
+	return bc.Database.Update(func(txn *badger.Txn) error {
+		for _, tx := range block.Transactions {
+			if err := txn.Delete([]byte("tx_" + tx.ID)); err != nil {
+				return err
+			}
+		}
+		if err := unindexAddresses(txn, block); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte(undoPrefix + hash)); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte(hash)); err != nil {
+			return err
+		}
+		return txn.Set([]byte(prunedKey), []byte(strconv.Itoa(height+1)))
+	})
+}
+
+// failStartup stops a node whose indexes can't be brought up to date. A
+// pruned chain can't be replayed from genesis, so instead of a panic the
+// operator is told how to recover.
+func (bc *Blockchain) failStartup(err error) {
+	if errors.Is(err, ErrPruned) {
+		bc.Database.Close()
+		log.Fatalf("[Blockchain] %v. A pruned chain can't be repaired in place: resync into an empty data directory or restore a snapshot (snapshot load)", err)
+	}
+	log.Panic(err)
+}
+
+// pruneAfterConnect prunes once a block has moved the tip. Failures only
+// leave bodies behind, so they are logged rather than failing the block.
+func (bc *Blockchain) pruneAfterConnect() {
+	n, err := bc.prune()
+	if err != nil {
+		log.Printf("[Blockchain] Pruning failed: %v", err)
+		return
+	}
+	if n > 1 {
+		log.Printf("[Blockchain] Pruned %d old block bodies", n)
+	}
+}
@@ -0,0 +1,92 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func TestPrune(t *testing.T) {
+	w := wallet.NewWallet()
+	params := testParams(t, w.Address())
+	params.RetargetInterval = 0 // Hundreds of fast blocks would raise the target
+	a := InitBlockchain(params, "a")
+	defer func() { a.Close() }()
+
+	old, _ := a.CreateTransaction(w.Address(), "bob", 10, 1, w)
+	if err := a.AddTransaction(old); err != nil {
+		t.Fatal(err)
+	}
+	a.AddBlock("miner")
+	a.PruneDepth = 5 // raised to MinPruneDepth
+	for i := 0; i < 299; i++ {
+		a.AddBlock("miner")
+	}
+	recent, _ := a.CreateTransaction(w.Address(), "bob", 7, 1, w)
+	if err := a.AddTransaction(recent); err != nil {
+		t.Fatal(err)
+	}
+	a.AddBlock("miner") // #301
+
+	pruned, _ := a.PrunedHeight()
+	if pruned != 301-MinPruneDepth+1 {
+		t.Fatalf("pruned height = %d", pruned)
+	}
+	h1, _ := a.GetBlockHashByHeight(1)
+	if _, err := a.GetBlock(h1); !errors.Is(err, ErrPruned) {
+		t.Fatalf("pruned block: got %v, want ErrPruned", err)
+	}
+	if !a.HasBlock(h1) {
+		t.Fatal("pruned block no longer known")
+	}
+	if a.GetBalance("bob") != 17 {
+		t.Fatal("pruning changed balances")
+	}
+	if _, err := a.FindTransaction(old.ID); err == nil {
+		t.Fatal("pruned transaction still found")
+	}
+	if _, err := a.FindTransaction(recent.ID); err != nil {
+		t.Fatal(err)
+	}
+	if hist, err := a.GetAddressHistory("bob", 0, 10); err != nil || len(hist) != 1 {
+		t.Fatalf("history has %d entries: %v", len(hist), err)
+	}
+	if err := a.ReindexState(); err == nil {
+		t.Fatal("reindexed a pruned chain")
+	}
+	if _, err := a.ExportChain(&bytes.Buffer{}, 0, 1<<30); err == nil {
+		t.Fatal("exported pruned blocks")
+	}
+	if _, err := a.ExportChain(&bytes.Buffer{}, pruned, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+
+	// A heavier branch forking below the pruned height is refused up front
+	b := openNode(t, params, "b")
+	for i := 0; i < 310; i++ {
+		b.AddBlock("other")
+	}
+	tip := a.LastHash
+	var lastErr error
+	for h := 1; h <= 310; h++ {
+		hash, _ := b.GetBlockHashByHeight(h)
+		blk, _ := b.GetBlock(hash)
+		if err := a.ProcessBlock(blk); err != nil {
+			lastErr = err
+		}
+	}
+	if !errors.Is(lastErr, ErrPruned) || a.LastHash != tip || a.GetBalance("bob") != 17 {
+		t.Fatalf("deep reorg: %v", lastErr)
+	}
+
+	a.Close()
+	a = InitBlockchain(params, "a")
+	if a.GetBalance("bob") != 17 {
+		t.Fatal("state lost on reopen")
+	}
+	if n, err := a.Prune(); err != nil || n != 0 {
+		t.Fatalf("pruned %d more blocks: %v", n, err)
+	}
+}
@@ -0,0 +1,307 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Key layout for fork tracking (next to "lh", "<hash>" and "tx_<ID>"):
+//
+//	"w_<hash>"   -> cumulative work of the chain ending at <hash> (decimal)
+//	"h_<height>" -> hash of the main-chain block at <height>
+//	"bad_<hash>" -> marker for blocks that failed transaction validation
+//	"hdr_<hash>" -> BlockHeader, kept separately from the full block
+const (
+	headerPrefix  = "hdr_"
+	workPrefix    = "w_"
+	heightPrefix  = "h_"
+	invalidPrefix = "bad_"
+)
+
+// ErrOrphanBlock is returned by ProcessBlock when the parent block is unknown.
+var ErrOrphanBlock = errors.New("parent block unknown")
+
+// ErrInvalidBlock marks a connect failure caused by the block's own contents,
+// as opposed to a storage error. Only these get the block hash marked invalid.
+var ErrInvalidBlock = errors.New("invalid block")
+
+func heightKey(height int) []byte {
+	return []byte(fmt.Sprintf("%s%d", heightPrefix, height))
+}
+
+// getWork returns the cumulative work stored for a block.
+func (bc *Blockchain) getWork(hash string) (*big.Int, error) {
+	work := new(big.Int)
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(workPrefix + hash))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if _, ok := work.SetString(string(val), 10); !ok {
+				return fmt.Errorf("corrupt work entry for %s", hash)
+			}
+			return nil
+		})
+	})
+	return work, err
+}
+
+// GetBlockHashByHeight returns the hash of the main-chain block at height.
+func (bc *Blockchain) GetBlockHashByHeight(height int) (string, error) {
+	var hash string
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightKey(height))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			hash = string(val)
+			return nil
+		})
+	})
+	return hash, err
+}
+
+// isOnMainChain reports whether the block is part of the active chain.
+func (bc *Blockchain) isOnMainChain(h *BlockHeader) bool {
+	hash, err := bc.GetBlockHashByHeight(h.Index)
+	return err == nil && hash == h.Hash
+}
+
+// isInvalid reports whether the block was previously rejected during connect.
+func (bc *Blockchain) isInvalid(hash string) bool {
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(invalidPrefix + hash))
+		return err
+	})
+	return err == nil
+}
+
+// storeBlock saves a block, its header and its cumulative work without
+// touching the active chain. Side branches live here until they become the
+// heaviest.
+func (bc *Blockchain) storeBlock(b *Block, work *big.Int) error {
+	return bc.Database.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte(b.Hash), b.Serialize()); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte(headerPrefix+b.Hash), b.BlockHeader.Serialize()); err != nil {
+			return err
+		}
+		return txn.Set([]byte(workPrefix+b.Hash), []byte(work.String()))
+	})
+}
+
+// connectBlock applies a stored block on top of the current tip: validates
+// its transactions against the tip state, updates account state, indexes
+// them and moves "lh" in one Badger transaction.
+func (bc *Blockchain) connectBlock(b *Block) error {
+	if b.PrevHash != bc.LastHash {
+		return fmt.Errorf("block %s does not extend tip %s", b.Hash, bc.LastHash)
+	}
+	if err := bc.validateBlockTransactions(b); err != nil {
+		return fmt.Errorf("%w %d: %w", ErrInvalidBlock, b.Index, err)
+	}
+
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		// INDEX TRANSACTIONS (Fast Lookup)
+		// "tx_<ID>" -> BlockHash. FindTransaction fetches the block, then the tx.
+		for _, tx := range b.Transactions {
+			if err := txn.Set([]byte("tx_"+tx.ID), []byte(b.Hash)); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set(heightKey(b.Index), []byte(b.Hash)); err != nil {
+			return err
+		}
+		if err := indexAddresses(txn, b); err != nil {
+			return err
+		}
+		if err := bc.applyBlock(txn, b); err != nil {
+			return err
+		}
+		return txn.Set([]byte("lh"), []byte(b.Hash))
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.LastHash = b.Hash
+	bc.Mempool.Remove(b.Transactions)
+	if n := bc.Mempool.Expire(time.Now()); n > 0 {
+		log.Printf("[Blockchain] Expired %d stale mempool transaction(s)", n)
+	}
+	return nil
+}
+
+// disconnectBlock rolls the tip back to its parent, reverting account state,
+// dropping the tx_ and address index entries and returning its transfers to the mempool.
+func (bc *Blockchain) disconnectBlock(b *Block) error {
+	if b.Hash != bc.LastHash {
+		return fmt.Errorf("block %s is not the tip", b.Hash)
+	}
+
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		for _, tx := range b.Transactions {
+			if err := txn.Delete([]byte("tx_" + tx.ID)); err != nil {
+				return err
+			}
+		}
+		if err := txn.Delete(heightKey(b.Index)); err != nil {
+			return err
+		}
+		if err := unindexAddresses(txn, b); err != nil {
+			return err
+		}
+		if err := revertBlock(txn, b); err != nil {
+			return err
+		}
+		return txn.Set([]byte("lh"), []byte(b.PrevHash))
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.LastHash = b.PrevHash
+	for _, tx := range b.Transactions {
+		if tx.From != CoinbaseSender {
+			bc.Mempool.Add(tx)
+		}
+	}
+	return nil
+}
+
+// reorganize makes newTip the active tip. It walks back to the fork point,
+// disconnects our blocks down to it and connects the new branch. If any
+// block on the new branch is invalid, the old chain is restored. A pruned
+// node refuses reorgs that would disconnect blocks it no longer stores.
+func (bc *Blockchain) reorganize(newTip *Block) error {
+	// 1. Collect the new branch back to the fork point. The fork point is
+	// only read as a header: its body may be pruned
+	var branch []*Block
+	fork := &newTip.BlockHeader
+	for !bc.isOnMainChain(fork) {
+		block, err := bc.GetBlock(fork.Hash)
+		if err != nil {
+			return fmt.Errorf("broken branch at %s: %w", fork.Hash, err)
+		}
+		branch = append([]*Block{block}, branch...)
+		if fork, err = bc.GetHeader(block.PrevHash); err != nil {
+			return fmt.Errorf("broken branch at %s: %w", block.Hash, err)
+		}
+	}
+	if pruned, err := bc.PrunedHeight(); err != nil {
+		return err
+	} else if fork.Index+1 < pruned {
+		return fmt.Errorf("%w: reorg to a fork at #%d, below the oldest kept block #%d", ErrPruned, fork.Index, pruned)
+	}
+
+	// 2. Disconnect our blocks above the fork point
+	var detached []*Block
+	for bc.LastHash != fork.Hash {
+		tip, err := bc.GetBlock(bc.LastHash)
+		if err != nil {
+			return err
+		}
+		if err := bc.disconnectBlock(tip); err != nil {
+			return err
+		}
+		detached = append([]*Block{tip}, detached...)
+	}
+	if len(detached) > 0 {
+		log.Printf("[Blockchain] Reorg: fork at #%d, replacing %d block(s) with %d", fork.Index, len(detached), len(branch))
+	}
+
+	// 3. Connect the new branch
+	for i, b := range branch {
+		if err := bc.connectBlock(b); err != nil {
+			// processBlock stored this body only after CheckMerkleRoot, and
+			// no other body has its hash, so the block is invalid for every peer
+			if errors.Is(err, ErrInvalidBlock) {
+				bc.markInvalid(branch[i:])
+			}
+			if rbErr := bc.rollbackReorg(fork, detached); rbErr != nil {
+				log.Panicf("reorg rollback failed: %v (after %v)", rbErr, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackReorg undoes a failed reorganization, restoring the old branch.
+func (bc *Blockchain) rollbackReorg(fork *BlockHeader, detached []*Block) error {
+	for bc.LastHash != fork.Hash {
+		tip, err := bc.GetBlock(bc.LastHash)
+		if err != nil {
+			return err
+		}
+		if err := bc.disconnectBlock(tip); err != nil {
+			return err
+		}
+	}
+	for _, b := range detached {
+		if err := bc.connectBlock(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markInvalid flags blocks so they (and their descendants) are never retried.
+func (bc *Blockchain) markInvalid(blocks []*Block) {
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		for _, b := range blocks {
+			if err := txn.Set([]byte(invalidPrefix+b.Hash), []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Blockchain] Failed to mark invalid blocks: %v", err)
+	}
+}
+
+// ensureChainIndex builds the work and height indexes for databases created
+// before fork tracking existed, by walking back from "lh".
+func (bc *Blockchain) ensureChainIndex() error {
+	if _, err := bc.getWork(bc.LastHash); err == nil {
+		return nil
+	}
+
+	log.Println("[Blockchain] Building fork-choice index...")
+	var blocks []*Block
+	iter := bc.Iterator()
+	for {
+		block := iter.Next()
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+		if block.PrevHash == "" || block.PrevHash == "0" {
+			break
+		}
+	}
+
+	work := new(big.Int)
+	wb := bc.Database.NewWriteBatch()
+	defer wb.Cancel()
+	for i := len(blocks) - 1; i >= 0; i-- {
+		b := blocks[i]
+		work.Add(work, blockWork(b.Bits))
+		if err := wb.Set([]byte(workPrefix+b.Hash), []byte(work.String())); err != nil {
+			return err
+		}
+		if err := wb.Set(heightKey(b.Index), []byte(b.Hash)); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
@@ -0,0 +1,469 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Chain files. Both are a sequence of records, each a uint32 length followed
+// by that many bytes, starting with a meta record naming the network.
+//
+//	Export:   [Meta] then one record per block (Block.Serialize), until EOF
+//	Snapshot: [Meta] [Height] then the headers of blocks 0..Height, the block
+//	          at Height, one record per state key ([Key] [Value]), an empty
+//	          record, and the sha256 of everything before it (32 bytes)
+//
+// An export is replayed through ProcessBlock, so it needs no more trust
+// than a peer. A snapshot is the account state at a height, and is loaded
+// as is: only use snapshots from a node you trust.
+//
+// A chain loaded from a snapshot starts out pruned at the snapshot's block
+// (see prune.go).
+const (
+	exportMagic   = "dnet-chain"
+	snapshotMagic = "dnet-snapshot"
+)
+
+// statePrefixes are the account-state keys a snapshot carries (undo records
+// stay behind: a bootstrapped chain can't disconnect below its snapshot).
+var statePrefixes = []string{accountPrefix, rewardPrefix, escrowPrefix, channelPrefix, dealPrefix}
+
+func writeRecord(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readRecord reads one record; io.EOF means the input ended between records.
+func readRecord(r io.Reader, maxLen uint32) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated record length", ErrMalformed)
+		}
+		return nil, err
+	}
+	if n > maxLen {
+		return nil, fmt.Errorf("%w: record too large (%d bytes)", ErrMalformed, n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("%w: truncated record", ErrMalformed)
+	}
+	return data, nil
+}
+
+func (p *NetworkParams) fileMeta(magic string) []byte {
+	e := &encoder{}
+	e.putString(magic)
+	e.putByte(EncodingVersion)
+	e.putString(p.Name)
+	return e.buf
+}
+
+// checkFileMeta reads the meta record and checks it is a magic file for
+// this network.
+func (p *NetworkParams) checkFileMeta(r io.Reader, magic string) error {
+	data, err := readRecord(r, maxFieldLen)
+	if err != nil {
+		return fmt.Errorf("not a %s file: %w", magic, err)
+	}
+	d := &decoder{data: data}
+	if d.readString("magic") != magic {
+		return fmt.Errorf("not a %s file", magic)
+	}
+	d.readVersion("file")
+	network := d.readString("network")
+	if err := d.finish("file meta"); err != nil {
+		return err
+	}
+	if network != p.Name {
+		return fmt.Errorf("file is for the %s network, not %s", network, p.Name)
+	}
+	return nil
+}
+
+// ExportChain writes the main-chain blocks fromHeight..toHeight (clamped to
+// the tip) to w and returns how many it wrote.
+func (bc *Blockchain) ExportChain(w io.Writer, fromHeight, toHeight int) (int, error) {
+	tip, err := bc.GetHeader(bc.LastHash)
+	if err != nil {
+		return 0, err
+	}
+	toHeight = min(toHeight, tip.Index)
+	if pruned, err := bc.PrunedHeight(); err != nil {
+		return 0, err
+	} else if fromHeight < pruned {
+		return 0, fmt.Errorf("%w below #%d, export from there on", ErrPruned, pruned)
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeRecord(bw, bc.Params.fileMeta(exportMagic)); err != nil {
+		return 0, err
+	}
+	written := 0
+	for height := max(fromHeight, 0); height <= toHeight; height++ {
+		hash, err := bc.GetBlockHashByHeight(height)
+		if err != nil {
+			return written, fmt.Errorf("missing main-chain block at height %d: %w", height, err)
+		}
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return written, err
+		}
+		if err := writeRecord(bw, block.Serialize()); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, bw.Flush()
+}
+
+// ImportChain reads an export and processes every block as if a peer had
+// sent it, so each one is fully validated. Blocks already stored are
+// skipped. It returns how many blocks were added.
+func (bc *Blockchain) ImportChain(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	if err := bc.Params.checkFileMeta(br, exportMagic); err != nil {
+		return 0, err
+	}
+	imported := 0
+	for {
+		data, err := readRecord(br, MaxBlockSize)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		block, err := DeserializeBlock(data)
+		if err != nil {
+			return imported, err
+		}
+		err = bc.ProcessBlock(block)
+		if errors.Is(err, ErrBlockKnown) {
+			continue
+		}
+		if err != nil {
+			return imported, fmt.Errorf("block #%d %s: %w", block.Index, block.Hash, err)
+		}
+		imported++
+		if imported%1000 == 0 {
+			log.Printf("[Blockchain] Imported %d blocks (at #%d)", imported, block.Index)
+		}
+	}
+}
+
+// WriteSnapshot writes the account state as of the main-chain block at
+// height to w, with the headers a new node needs to continue from it. It
+// returns that block's header and the number of state entries.
+//
+// The state is rolled back from the tip with the blocks' undo records inside
+// a transaction that is never committed, so the node keeps running on it.
+func (bc *Blockchain) WriteSnapshot(w io.Writer, height int) (*BlockHeader, int, error) {
+	txn := bc.Database.NewTransaction(true)
+	defer txn.Discard()
+
+	// Walk back from the block the state table reflects
+	item, err := txn.Get([]byte(stateTipKey))
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading state tip: %w", err)
+	}
+	tipHash, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	header, err := bc.GetHeader(string(tipHash))
+	if err != nil {
+		return nil, 0, err
+	}
+	if height < 0 || height > header.Index {
+		return nil, 0, fmt.Errorf("snapshot height %d is not on the chain (tip #%d)", height, header.Index)
+	}
+	for header.Index > height {
+		if err := revertBlock(txn, &Block{BlockHeader: *header}); err != nil {
+			if errors.Is(err, badger.ErrTxnTooBig) {
+				return nil, 0, fmt.Errorf("snapshot height %d is too far below the tip", height)
+			}
+			return nil, 0, err
+		}
+		if header, err = bc.GetHeader(header.PrevHash); err != nil {
+			return nil, 0, err
+		}
+	}
+	base, err := bc.GetBlock(header.Hash)
+	if err != nil {
+		return nil, 0, fmt.Errorf("block #%d: %w", height, err)
+	}
+	hashAt := func(h int) (string, error) {
+		item, err := txn.Get(heightKey(h))
+		if err != nil {
+			return "", fmt.Errorf("missing main-chain block at height %d: %w", h, err)
+		}
+		val, err := item.ValueCopy(nil)
+		return string(val), err
+	}
+
+	sum := sha256.New()
+	bw := bufio.NewWriter(w)
+	out := io.MultiWriter(bw, sum)
+
+	e := &encoder{}
+	e.putInt(height)
+	if err := writeRecord(out, bc.Params.fileMeta(snapshotMagic)); err != nil {
+		return nil, 0, err
+	}
+	if err := writeRecord(out, e.buf); err != nil {
+		return nil, 0, err
+	}
+
+	for h := 0; h <= height; h++ {
+		hash, err := hashAt(h)
+		if err != nil {
+			return nil, 0, err
+		}
+		hdr, err := bc.GetHeader(hash)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := writeRecord(out, hdr.Serialize()); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := writeRecord(out, base.Serialize()); err != nil {
+		return nil, 0, err
+	}
+
+	entries := 0
+	for _, prefix := range statePrefixes {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return nil, 0, err
+			}
+			e := &encoder{}
+			e.putBytes(it.Item().KeyCopy(nil))
+			e.putBytes(value)
+			if err := writeRecord(out, e.buf); err != nil {
+				it.Close()
+				return nil, 0, err
+			}
+			entries++
+		}
+		it.Close()
+	}
+	if err := writeRecord(out, nil); err != nil {
+		return nil, 0, err
+	}
+	if _, err := bw.Write(sum.Sum(nil)); err != nil {
+		return nil, 0, err
+	}
+	return &base.BlockHeader, entries, bw.Flush()
+}
+
+// LoadSnapshot creates the chain database of nodeID from a snapshot, so the
+// node starts at the snapshot's block instead of syncing from genesis. The
+// database must not exist yet. Headers are checked for Proof of Work and
+// linkage back to our Genesis block; the state itself is trusted.
+//
+// Blocks below the snapshot are not stored, so the node can't serve them
+// to peers or reorganize below it.
+func LoadSnapshot(params *NetworkParams, nodeID string, r io.Reader) (*BlockHeader, error) {
+	path := params.ChainPath(nodeID)
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("chain database %s already exists", path)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := loadSnapshot(db, params, r)
+	db.Close()
+	if err != nil {
+		os.RemoveAll(path)
+		return nil, err
+	}
+	return base, nil
+}
+
+func loadSnapshot(db *badger.DB, params *NetworkParams, r io.Reader) (*BlockHeader, error) {
+	sum := sha256.New()
+	br := bufio.NewReader(r)
+	in := io.TeeReader(br, sum)
+
+	if err := params.checkFileMeta(in, snapshotMagic); err != nil {
+		return nil, err
+	}
+	data, err := readRecord(in, maxFieldLen)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{data: data}
+	height := d.readInt("height")
+	if err := d.finish("snapshot height"); err != nil {
+		return nil, err
+	}
+	if height < 0 {
+		return nil, fmt.Errorf("%w: negative snapshot height", ErrMalformed)
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	// 1. Headers back to our Genesis, with their work and height index
+	var parent *BlockHeader
+	work := new(big.Int)
+	for h := 0; h <= height; h++ {
+		data, err := readRecord(in, maxFieldLen)
+		if err != nil {
+			return nil, fmt.Errorf("header %d: %w", h, err)
+		}
+		hdr, err := DeserializeHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSnapshotHeader(hdr, parent, h, params); err != nil {
+			return nil, err
+		}
+		work.Add(work, blockWork(hdr.Bits))
+		if err := wb.Set([]byte(headerPrefix+hdr.Hash), data); err != nil {
+			return nil, err
+		}
+		if err := wb.Set([]byte(workPrefix+hdr.Hash), []byte(work.String())); err != nil {
+			return nil, err
+		}
+		if err := wb.Set(heightKey(h), []byte(hdr.Hash)); err != nil {
+			return nil, err
+		}
+		parent = hdr
+	}
+
+	// 2. The snapshot block, which becomes our tip
+	data, err = readRecord(in, MaxBlockSize)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot block: %w", err)
+	}
+	base, err := DeserializeBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	if base.Hash != parent.Hash || CheckMerkleRoot(base) != nil {
+		return nil, fmt.Errorf("snapshot block does not match header %s", parent.Hash)
+	}
+	if err := wb.Set([]byte(base.Hash), data); err != nil {
+		return nil, err
+	}
+	for _, tx := range base.Transactions {
+		if err := wb.Set([]byte("tx_"+tx.ID), []byte(base.Hash)); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range addressKeys(base) {
+		if err := wb.Set(key, []byte(base.Hash)); err != nil {
+			return nil, err
+		}
+	}
+
+	// 3. Account state
+	entries := 0
+	for {
+		data, err := readRecord(in, MaxBlockSize)
+		if err != nil {
+			return nil, fmt.Errorf("state entry %d: %w", entries, err)
+		}
+		if len(data) == 0 {
+			break
+		}
+		d := &decoder{data: data}
+		key := d.readBytes(2*maxFieldLen, "state key")
+		value := d.readBytes(MaxBlockSize, "state value")
+		if err := d.finish("state entry"); err != nil {
+			return nil, err
+		}
+		if !isStateKey(key) {
+			return nil, fmt.Errorf("%w: unexpected state key %q", ErrMalformed, key)
+		}
+		if err := wb.Set(key, value); err != nil {
+			return nil, err
+		}
+		entries++
+	}
+
+	// 4. Checksum, then the markers that make the database usable
+	want := sum.Sum(nil)
+	got := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(br, got); err != nil || !bytes.Equal(got, want) {
+		return nil, fmt.Errorf("%w: snapshot checksum mismatch", ErrMalformed)
+	}
+	if err := wb.Flush(); err != nil {
+		return nil, err
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for key, value := range map[string]string{
+			prunedKey:       strconv.Itoa(height),
+			stateTipKey:     base.Hash,
+			addressIndexKey: "1",
+			"lh":            base.Hash,
+		} {
+			if err := txn.Set([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Blockchain] Loaded snapshot at block #%d %s (%d state entries)", height, base.Hash, entries)
+	return &base.BlockHeader, nil
+}
+
+// checkSnapshotHeader checks a snapshot header's Proof of Work and its link
+// to the previous one; the first must be our Genesis block.
+func checkSnapshotHeader(hdr, parent *BlockHeader, height int, params *NetworkParams) error {
+	if hdr.Index != height {
+		return fmt.Errorf("snapshot header %s has height %d, expected %d", hdr.Hash, hdr.Index, height)
+	}
+	if parent == nil {
+		if genesis := params.GenesisBlock(); hdr.Hash != genesis.Hash {
+			return fmt.Errorf("snapshot starts at %s, not our genesis %s", hdr.Hash, genesis.Hash)
+		}
+		return nil
+	}
+	if hdr.PrevHash != parent.Hash {
+		return fmt.Errorf("snapshot header #%d does not link to %s", height, parent.Hash)
+	}
+	return CheckHeader(hdr, params)
+}
+
+func isStateKey(key []byte) bool {
+	for _, prefix := range statePrefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
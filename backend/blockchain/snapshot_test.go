@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"decentralized-net/wallet"
+)
+
+func TestExportImportAndSnapshot(t *testing.T) {
+	w := wallet.NewWallet()
+	params := testParams(t, w.Address())
+	a := openNode(t, params, "a")
+	for i := 0; i < 12; i++ {
+		tx, _ := a.CreateTransaction(w.Address(), "bob", 10+i, 1, w)
+		if err := a.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+		a.AddBlock("miner")
+	}
+	tip, _, _ := a.GetTip()
+
+	var exp bytes.Buffer
+	if n, err := a.ExportChain(&exp, 0, 1<<30); err != nil || n != tip+1 {
+		t.Fatalf("exported %d blocks: %v", n, err)
+	}
+	b := openNode(t, params, "b")
+	if got, err := b.ImportChain(bytes.NewReader(exp.Bytes())); err != nil || got != tip {
+		t.Fatalf("imported %d blocks: %v", got, err)
+	}
+	if b.LastHash != a.LastHash || b.GetBalance("bob") != a.GetBalance("bob") {
+		t.Fatal("imported chain differs")
+	}
+	if got, err := b.ImportChain(bytes.NewReader(exp.Bytes())); err != nil || got != 0 {
+		t.Fatalf("reimport connected %d blocks: %v", got, err)
+	}
+
+	corrupt := append([]byte(nil), exp.Bytes()...)
+	corrupt[len(corrupt)-5] ^= 0xff
+	if _, err := openNode(t, params, "c").ImportChain(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("corrupt export imported")
+	}
+
+	// Snapshot a few blocks below the tip
+	bob := a.GetBalance("bob")
+	var snap bytes.Buffer
+	hdr, entries, err := a.WriteSnapshot(&snap, tip-4)
+	if err != nil || hdr.Index != tip-4 || entries == 0 {
+		t.Fatalf("snapshot at %v with %d entries: %v", hdr, entries, err)
+	}
+	if a.GetBalance("bob") != bob {
+		t.Fatal("writing a snapshot changed the live state")
+	}
+
+	corrupt = append([]byte(nil), snap.Bytes()...)
+	corrupt[len(corrupt)-40] ^= 1
+	if _, err := LoadSnapshot(params, "d", bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("corrupt snapshot loaded")
+	}
+	if _, err := os.Stat(params.ChainPath("d")); !os.IsNotExist(err) {
+		t.Fatal("failed load left its directory behind")
+	}
+	if _, err := LoadSnapshot(params, "a", bytes.NewReader(snap.Bytes())); err == nil {
+		t.Fatal("snapshot loaded over an existing chain")
+	}
+	if _, err := LoadSnapshot(params, "d", bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	d := openNode(t, params, "d")
+	if d.LastHash != hdr.Hash {
+		t.Fatal("snapshot tip not restored")
+	}
+	if err := d.ReindexState(); err == nil {
+		t.Fatal("reindexed without the blocks below the snapshot")
+	}
+	if _, err := d.ExportChain(&bytes.Buffer{}, 0, 100); err == nil {
+		t.Fatal("exported blocks below the snapshot")
+	}
+
+	// The rest of the chain connects on top of the snapshot
+	if _, err := d.ImportChain(bytes.NewReader(exp.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if d.LastHash != a.LastHash || d.GetBalance("bob") != bob || d.GetBalance(w.Address()) != a.GetBalance(w.Address()) {
+		t.Fatal("state after catching up differs")
+	}
+}
@@ -0,0 +1,340 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"log"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Key layout for the account-state table:
+//
+//	"acct_<address>" -> AccountState (balances + nonce) at the active tip
+//	"cb_<height>"    -> coinbase reward of the block at <height> until it matures
+//	"undo_<hash>"    -> previous values of every state key the block changed
+//	"htlc_<txID>"    -> open escrow (see escrow.go)
+//	"chan_<txID>"    -> open payment channel (see channel.go)
+//	"deal_<txID>"    -> active storage deal (see deals.go)
+//	"state"          -> hash of the block the state table reflects
+const (
+	accountPrefix = "acct_"
+	rewardPrefix  = "cb_"
+	undoPrefix    = "undo_"
+	stateTipKey   = "state"
+)
+
+// AccountState is the per-address state maintained as blocks are connected.
+type AccountState struct {
+	Balance  int // Spendable
+	Nonce    int
+	Immature int // Coinbase rewards still waiting for CoinbaseMaturity
+}
+
+func encodeAccount(acc AccountState) []byte {
+	buf := binary.AppendVarint(nil, int64(acc.Balance))
+	buf = binary.AppendVarint(buf, int64(acc.Nonce))
+	return binary.AppendVarint(buf, int64(acc.Immature))
+}
+
+func decodeAccount(data []byte) (AccountState, error) {
+	balance, n := binary.Varint(data)
+	if n <= 0 {
+		return AccountState{}, fmt.Errorf("corrupt account balance")
+	}
+	nonce, m := binary.Varint(data[n:])
+	if m <= 0 {
+		return AccountState{}, fmt.Errorf("corrupt account nonce")
+	}
+	acc := AccountState{Balance: int(balance), Nonce: int(nonce)}
+	if rest := data[n+m:]; len(rest) > 0 { // Absent in entries written before maturity
+		immature, k := binary.Varint(rest)
+		if k <= 0 {
+			return AccountState{}, fmt.Errorf("corrupt account immature balance")
+		}
+		acc.Immature = int(immature)
+	}
+	return acc, nil
+}
+
+func rewardKey(height int) []byte {
+	return []byte(fmt.Sprintf("%s%d", rewardPrefix, height))
+}
+
+// undoEntry is the value a state key had before a block touched it.
+type undoEntry struct {
+	Key     []byte
+	Value   []byte
+	Existed bool
+}
+
+// stateTxn wraps a Badger transaction and records undo data for every state
+// key written, so the block can be disconnected later.
+type stateTxn struct {
+	txn     *badger.Txn
+	undo    []undoEntry
+	touched map[string]bool
+}
+
+func newStateTxn(txn *badger.Txn) *stateTxn {
+	return &stateTxn{txn: txn, touched: make(map[string]bool)}
+}
+
+// get returns the current value of a state key (nil if absent).
+func (st *stateTxn) get(key []byte) ([]byte, error) {
+	item, err := st.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+// set writes a state key, remembering its previous value the first time.
+func (st *stateTxn) set(key, value []byte) error {
+	if !st.touched[string(key)] {
+		prev, err := st.get(key)
+		if err != nil {
+			return err
+		}
+		st.undo = append(st.undo, undoEntry{Key: key, Value: prev, Existed: prev != nil})
+		st.touched[string(key)] = true
+	}
+	return st.txn.Set(key, value)
+}
+
+// del removes a state key, remembering its previous value the first time.
+func (st *stateTxn) del(key []byte) error {
+	if !st.touched[string(key)] {
+		prev, err := st.get(key)
+		if err != nil {
+			return err
+		}
+		st.undo = append(st.undo, undoEntry{Key: key, Value: prev, Existed: prev != nil})
+		st.touched[string(key)] = true
+	}
+	return st.txn.Delete(key)
+}
+
+func (st *stateTxn) getAccount(address string) (AccountState, error) {
+	val, err := st.get([]byte(accountPrefix + address))
+	if err != nil || val == nil {
+		return AccountState{}, err
+	}
+	return decodeAccount(val)
+}
+
+func (st *stateTxn) putAccount(address string, acc AccountState) error {
+	return st.set([]byte(accountPrefix+address), encodeAccount(acc))
+}
+
+// credit adds amount to an address balance.
+func (st *stateTxn) credit(address string, amount int) error {
+	acc, err := st.getAccount(address)
+	if err != nil {
+		return err
+	}
+	acc.Balance += amount
+	return st.putAccount(address, acc)
+}
+
+// lockReward credits a coinbase reward as immature and remembers it under
+// "cb_<height>" so it can be released once it matures.
+func (st *stateTxn) lockReward(height int, address string, amount int) error {
+	acc, err := st.getAccount(address)
+	if err != nil {
+		return err
+	}
+	acc.Immature += amount
+	if err := st.putAccount(address, acc); err != nil {
+		return err
+	}
+	value := binary.AppendVarint(nil, int64(amount))
+	return st.set(rewardKey(height), append(value, address...))
+}
+
+// releaseReward makes the coinbase reward of the block at height spendable.
+func (st *stateTxn) releaseReward(height int) error {
+	val, err := st.get(rewardKey(height))
+	if err != nil || val == nil {
+		return err
+	}
+	amount, n := binary.Varint(val)
+	if n <= 0 {
+		return fmt.Errorf("corrupt reward entry at height %d", height)
+	}
+	address := string(val[n:])
+
+	acc, err := st.getAccount(address)
+	if err != nil {
+		return err
+	}
+	acc.Immature -= int(amount)
+	acc.Balance += int(amount)
+	if err := st.putAccount(address, acc); err != nil {
+		return err
+	}
+	return st.del(rewardKey(height))
+}
+
+// applyBlock updates account state for every transaction in the block,
+// matures the reward from CoinbaseMaturity blocks back and stores the undo
+// record under "undo_<hash>".
+func (bc *Blockchain) applyBlock(txn *badger.Txn, b *Block) error {
+	st := newStateTxn(txn)
+	for _, tx := range b.Transactions {
+		// Rewards stay locked until buried; the genesis premine is exempt
+		if tx.From == CoinbaseSender && b.Index > 0 {
+			if err := st.lockReward(b.Index, tx.To, tx.Amount); err != nil {
+				return err
+			}
+			continue
+		}
+		if tx.From != CoinbaseSender {
+			sender, err := st.getAccount(tx.From)
+			if err != nil {
+				return err
+			}
+			sender.Balance -= tx.cost()
+			sender.Nonce++
+			if err := st.putAccount(tx.From, sender); err != nil {
+				return err
+			}
+			if err := st.applyTx(tx, b.Index); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := st.credit(tx.To, tx.Amount); err != nil {
+			return err
+		}
+	}
+	if err := st.releaseReward(b.Index - bc.Params.CoinbaseMaturity); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(st.undo); err != nil {
+		return err
+	}
+	if err := txn.Set([]byte(undoPrefix+b.Hash), buf.Bytes()); err != nil {
+		return err
+	}
+	return txn.Set([]byte(stateTipKey), []byte(b.Hash))
+}
+
+// revertBlock restores the state keys a block changed from its undo record.
+func revertBlock(txn *badger.Txn, b *Block) error {
+	item, err := txn.Get([]byte(undoPrefix + b.Hash))
+	if err != nil {
+		return fmt.Errorf("missing undo data for block %s: %w", b.Hash, err)
+	}
+	var undo []undoEntry
+	err = item.Value(func(val []byte) error {
+		return gob.NewDecoder(bytes.NewReader(val)).Decode(&undo)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(undo) - 1; i >= 0; i-- {
+		entry := undo[i]
+		if entry.Existed {
+			err = txn.Set(entry.Key, entry.Value)
+		} else {
+			err = txn.Delete(entry.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := txn.Delete([]byte(undoPrefix + b.Hash)); err != nil {
+		return err
+	}
+	return txn.Set([]byte(stateTipKey), []byte(b.PrevHash))
+}
+
+// GetAccount returns the balances and nonce of an address at the active tip.
+func (bc *Blockchain) GetAccount(address string) (AccountState, error) {
+	var acc AccountState
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		acc, err = newStateTxn(txn).getAccount(address)
+		return err
+	})
+	return acc, err
+}
+
+// ensureState rebuilds the account-state table if it does not match the tip
+// (databases created before the table existed, or an interrupted rebuild).
+func (bc *Blockchain) ensureState() error {
+	var stateTip string
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(stateTipKey))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			stateTip = string(val)
+			return nil
+		})
+	})
+	if err == nil && stateTip == bc.LastHash {
+		return nil
+	}
+	return bc.ReindexState()
+}
+
+// ReindexState drops the account-state table and rebuilds it by replaying
+// the active chain from genesis.
+func (bc *Blockchain) ReindexState() error {
+	if pruned, err := bc.PrunedHeight(); err != nil {
+		return err
+	} else if pruned > 0 {
+		return fmt.Errorf("%w below #%d, state can't be replayed from genesis", ErrPruned, pruned)
+	}
+
+	log.Println("[Blockchain] Rebuilding account state from chain...")
+	// Clear the marker first so an interrupted rebuild is redone on restart
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(stateTipKey))
+	})
+	if err != nil {
+		return err
+	}
+	prefixes := [][]byte{[]byte(undoPrefix)}
+	for _, prefix := range statePrefixes {
+		prefixes = append(prefixes, []byte(prefix))
+	}
+	if err := bc.Database.DropPrefix(prefixes...); err != nil {
+		return err
+	}
+
+	tip, err := bc.GetBlock(bc.LastHash)
+	if err != nil {
+		return err
+	}
+	for height := 0; height <= tip.Index; height++ {
+		hash, err := bc.GetBlockHashByHeight(height)
+		if err != nil {
+			return fmt.Errorf("missing main-chain block at height %d: %w", height, err)
+		}
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		err = bc.Database.Update(func(txn *badger.Txn) error {
+			return bc.applyBlock(txn, block)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply block #%d: %w", height, err)
+		}
+	}
+
+	log.Printf("[Blockchain] Account state rebuilt up to block #%d", tip.Index)
+	return nil
+}
@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Proof of storage. A deal's ShardRoot is the Merkle root over the shard's
+// ShardChunkSize-byte chunks (the last one may be shorter). Every
+// DealProofPeriod blocks the chain challenges the provider for one chunk,
+// picked from the hash of the block that starts the period, and the
+// provider answers on chain with the chunk and its Merkle path before the
+// period ends. Verifiers can also ask for any chunk off-chain and check it
+// against the root without holding the shard.
+const (
+	// ShardChunkSize is the size of the chunks storage proofs open.
+	ShardChunkSize = 256
+	// DealProofPeriod is the number of blocks between storage challenges.
+	DealProofPeriod = 20
+	// maxProofDepth bounds the Merkle path of a storage proof (2^32 chunks).
+	maxProofDepth = 32
+)
+
+// StorageProof opens one chunk of a shard against its ShardRoot. Siblings
+// are listed from the leaf level up, as in MerkleProof.
+type StorageProof struct {
+	Index    int
+	Chunk    []byte
+	Siblings [][]byte
+}
+
+// ShardChunkCount returns the number of chunks of a shard of size bytes.
+func ShardChunkCount(size int) int {
+	return (size + ShardChunkSize - 1) / ShardChunkSize
+}
+
+func shardLevels(data []byte) [][][]byte {
+	leaves := make([][]byte, 0, ShardChunkCount(len(data)))
+	for start := 0; start < len(data); start += ShardChunkSize {
+		leaves = append(leaves, merkleLeaf(data[start:min(start+ShardChunkSize, len(data))]))
+	}
+	return merkleTree(leaves)
+}
+
+// ShardRoot returns the Merkle root of a shard's chunks, which storage deals
+// commit to.
+func ShardRoot(data []byte) []byte {
+	levels := shardLevels(data)
+	if levels == nil {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	return levels[len(levels)-1][0]
+}
+
+// NewStorageProof opens the chunk at index of a shard.
+func NewStorageProof(data []byte, index int) (*StorageProof, error) {
+	if index < 0 || index >= ShardChunkCount(len(data)) {
+		return nil, fmt.Errorf("chunk index %d out of range", index)
+	}
+
+	start := index * ShardChunkSize
+	proof := &StorageProof{Index: index, Chunk: data[start:min(start+ShardChunkSize, len(data))]}
+	levels := shardLevels(data)
+	pos := index
+	for _, level := range levels[:len(levels)-1] {
+		sibling := pos ^ 1
+		if sibling >= len(level) {
+			sibling = pos // Odd node paired with itself
+		}
+		proof.Siblings = append(proof.Siblings, level[sibling])
+		pos /= 2
+	}
+	return proof, nil
+}
+
+// Verify checks that the proof opens chunk Index of the size-byte shard with
+// Merkle root root.
+func (p *StorageProof) Verify(root []byte, size int) bool {
+	chunks := ShardChunkCount(size)
+	if p.Index < 0 || p.Index >= chunks || len(p.Siblings) > maxProofDepth {
+		return false
+	}
+	if want := min(ShardChunkSize, size-p.Index*ShardChunkSize); len(p.Chunk) != want {
+		return false
+	}
+
+	current := merkleLeaf(p.Chunk)
+	pos := p.Index
+	for _, sibling := range p.Siblings {
+		if len(sibling) != sha256.Size {
+			return false
+		}
+		if pos%2 == 0 {
+			current = merkleNode(current, sibling)
+		} else {
+			current = merkleNode(sibling, current)
+		}
+		pos /= 2
+	}
+	return pos == 0 && bytes.Equal(current, root)
+}
+
+// ChallengeIndex picks the chunk a deal must prove in a period from seed,
+// the hash of the block at the period's ChallengeHeight.
+func ChallengeIndex(seed, dealID string, period, chunks int) int {
+	e := &encoder{}
+	e.putString("storage-challenge")
+	e.putString(seed)
+	e.putString(dealID)
+	e.putInt(period)
+	sum := sha256.Sum256(e.buf)
+	return int(binary.BigEndian.Uint64(sum[:8]) % uint64(chunks))
+}
+
+// StorageProofPayload builds the payload of a TxStorageProof.
+func StorageProofPayload(dealID string, period int, proof *StorageProof) []byte {
+	e := &encoder{}
+	e.putString(dealID)
+	e.putInt(period)
+	e.putInt(proof.Index)
+	e.putBytes(proof.Chunk)
+	e.putUint32(uint32(len(proof.Siblings)))
+	for _, sibling := range proof.Siblings {
+		e.putBytes(sibling)
+	}
+	return e.buf
+}
+
+// DealSlashPayload builds the payload of a TxDealSlash.
+func DealSlashPayload(dealID string) []byte {
+	e := &encoder{}
+	e.putString(dealID)
+	return e.buf
+}
+
+func decodeStorageProofPayload(payload []byte) (dealID string, period int, proof *StorageProof, err error) {
+	d := &decoder{data: payload}
+	dealID = d.readString("deal id")
+	period = d.readInt("period")
+	proof = &StorageProof{
+		Index: d.readInt("chunk index"),
+		Chunk: d.readBytes(ShardChunkSize, "chunk"),
+	}
+	count := d.readUint32("sibling count")
+	if count > maxProofDepth {
+		d.fail("storage proof too deep (%d)", count)
+	}
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		proof.Siblings = append(proof.Siblings, d.readBytes(sha256.Size, "sibling"))
+	}
+	return dealID, period, proof, d.finish("storage proof payload")
+}
+
+func decodeDealSlashPayload(payload []byte) (dealID string, err error) {
+	d := &decoder{data: payload}
+	dealID = d.readString("deal id")
+	return dealID, d.finish("deal slash payload")
+}
@@ -0,0 +1,126 @@
+package blockchain
+
+import "fmt"
+
+// TxType says what a transaction is for. The type and its Payload are
+// covered by the transaction ID, so they can't be changed after signing.
+type TxType byte
+
+const (
+	// TxTransfer is a plain payment with no payload.
+	TxTransfer TxType = iota
+	// TxJobPayment pays a compute worker (To) for one job. The payload is the
+	// JobHash of the wasm and input, and workers only redeem it once.
+	TxJobPayment
+	// TxHTLCLock moves Amount into an escrow for To, see escrow.go.
+	TxHTLCLock
+	// TxHTLCClaim pays an escrow to its worker, revealing the preimage.
+	TxHTLCClaim
+	// TxHTLCRefund returns a timed-out escrow to its client.
+	TxHTLCRefund
+	// TxChannelOpen locks Amount in a payment channel to To, see channel.go.
+	TxChannelOpen
+	// TxChannelClose closes a channel with the payer's latest update.
+	TxChannelClose
+	// TxChannelSettle pays out a channel whose dispute window has passed.
+	TxChannelSettle
+	// TxStorageDeal escrows Amount for To storing a shard, see deals.go.
+	TxStorageDeal
+	// TxDealClaim pays a provider what its deal has released so far.
+	TxDealClaim
+	// TxStorageProof answers a deal's storage challenge, see storageproof.go.
+	TxStorageProof
+	// TxDealSlash refunds a client the deal periods its provider didn't prove.
+	TxDealSlash
+)
+
+func (t TxType) String() string {
+	switch t {
+	case TxTransfer:
+		return "transfer"
+	case TxJobPayment:
+		return "job-payment"
+	case TxHTLCLock:
+		return "htlc-lock"
+	case TxHTLCClaim:
+		return "htlc-claim"
+	case TxHTLCRefund:
+		return "htlc-refund"
+	case TxChannelOpen:
+		return "channel-open"
+	case TxChannelClose:
+		return "channel-close"
+	case TxChannelSettle:
+		return "channel-settle"
+	case TxStorageDeal:
+		return "storage-deal"
+	case TxDealClaim:
+		return "deal-claim"
+	case TxStorageProof:
+		return "storage-proof"
+	case TxDealSlash:
+		return "deal-slash"
+	}
+	return fmt.Sprintf("type-%d", byte(t))
+}
+
+// checkTxType validates the type-specific fields of a transaction.
+func checkTxType(tx *Transaction) error {
+	switch tx.Type {
+	case TxTransfer:
+		if len(tx.Payload) > 0 {
+			return fmt.Errorf("transfer has a payload")
+		}
+	case TxJobPayment:
+		if len(tx.Payload) != JobHashSize {
+			return fmt.Errorf("job payment payload is %d bytes, expected a %d-byte job hash", len(tx.Payload), JobHashSize)
+		}
+	case TxHTLCLock, TxHTLCClaim, TxHTLCRefund:
+		return checkEscrowPayload(tx)
+	case TxChannelOpen, TxChannelClose, TxChannelSettle:
+		return checkChannelPayload(tx)
+	case TxStorageDeal, TxDealClaim, TxStorageProof, TxDealSlash:
+		return checkDealPayload(tx)
+	default:
+		return fmt.Errorf("unknown transaction type %d", tx.Type)
+	}
+	return nil
+}
+
+// cost is what a transaction takes from its sender's balance. Escrow claims
+// and refunds, channel closes and settlements, and deal claims, proofs and
+// slashes pay out of the locked funds, so the sender only pays the fee.
+func (tx *Transaction) cost() int {
+	switch tx.Type {
+	case TxHTLCClaim, TxHTLCRefund, TxChannelClose, TxChannelSettle, TxDealClaim, TxStorageProof, TxDealSlash:
+		return tx.Fee
+	}
+	return tx.Amount + tx.Fee
+}
+
+// checkTxContext validates the type-specific rules that depend on chain state.
+func (bc *Blockchain) checkTxContext(tx *Transaction, ctx *txContext) error {
+	switch tx.Type {
+	case TxHTLCLock, TxHTLCClaim, TxHTLCRefund:
+		return bc.checkEscrowContext(tx, ctx)
+	case TxChannelOpen, TxChannelClose, TxChannelSettle:
+		return bc.checkChannelContext(tx, ctx)
+	case TxStorageDeal, TxDealClaim, TxStorageProof, TxDealSlash:
+		return bc.checkDealContext(tx, ctx)
+	}
+	return nil
+}
+
+// applyTx credits the effects of a transaction connected at height. The
+// sender has already been charged tx.cost().
+func (st *stateTxn) applyTx(tx *Transaction, height int) error {
+	switch tx.Type {
+	case TxHTLCLock, TxHTLCClaim, TxHTLCRefund:
+		return st.applyEscrow(tx)
+	case TxChannelOpen, TxChannelClose, TxChannelSettle:
+		return st.applyChannel(tx, height)
+	case TxStorageDeal, TxDealClaim, TxStorageProof, TxDealSlash:
+		return st.applyDeal(tx, height)
+	}
+	return st.credit(tx.To, tx.Amount)
+}
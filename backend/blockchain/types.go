@@ -1,9 +1,8 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/gob"
+	"decentralized-net/wallet"
 	"encoding/hex"
 	"fmt"
 	"time"
@@ -14,81 +13,133 @@ type Transaction struct {
 	From      string // Sender Address
 	To        string // Recipient Address
 	Amount    int    // Value
+	Fee       int    // Paid by the sender to the miner of the block
+	Nonce     int    // Sender's tx count, prevents replays
 	Timestamp int64  // Time created
+	Type      TxType // What the transfer is for, see txtypes.go
+	Payload   []byte // Type-specific data (empty for plain transfers)
+	PublicKey string // Sender's public key (hex PKIX) or multisig script, must hash to From
 	Signature string // Cryptographic Signature of Sender
-	ID        string // Hash of the Tx (calculated)
+	// Signatures replaces Signature for multisig senders: one slot per
+	// script key, "" for keys that did not sign.
+	Signatures []string
+	ID         string // Hash of the Tx (calculated)
 }
 
-// CalculateHash generates the ID for the transaction
+// CalculateHash generates the ID for the transaction from its canonical bytes
 func (tx *Transaction) CalculateHash() string {
-	record := fmt.Sprintf("%s%s%d%d", tx.From, tx.To, tx.Amount, tx.Timestamp)
-	h := sha256.New()
-	h.Write([]byte(record))
-	return hex.EncodeToString(h.Sum(nil))
+	sum := sha256.Sum256(tx.signingBytes())
+	return hex.EncodeToString(sum[:])
 }
 
-// Block represents a secured batch of transactions
-type Block struct {
-	Index        int
-	Timestamp    int64
-	Transactions []*Transaction
-	PrevHash     string
-	Hash         string
-	Nonce        int
-}
+// Sign sets the sender's public key, computes the ID and signs it
+func (tx *Transaction) Sign(w *wallet.Wallet) error {
+	pubKey, err := w.PublicKeyHex()
+	if err != nil {
+		return err
+	}
+	tx.PublicKey = pubKey
+	tx.ID = tx.CalculateHash()
 
-// Serialize converts the block to bytes
-func (b *Block) Serialize() []byte {
-	var result bytes.Buffer
-	encoder := gob.NewEncoder(&result)
-	err := encoder.Encode(b)
+	digest, err := hex.DecodeString(tx.ID)
+	if err != nil {
+		return err
+	}
+	sig, err := w.Sign(digest)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return result.Bytes()
+	tx.Signature = sig
+	return nil
 }
 
-// DeserializeBlock decodes bytes into a Block
-func DeserializeBlock(d []byte) *Block {
-	var block Block
-	decoder := gob.NewDecoder(bytes.NewReader(d))
-	err := decoder.Decode(&block)
+// SignMultisig sets the sender's multisig script and adds w's signature.
+// Each signer calls it in turn on the same transaction until M have signed.
+func (tx *Transaction) SignMultisig(script *wallet.MultisigScript, w *wallet.Wallet) error {
+	pubKey, err := w.PublicKeyHex()
+	if err != nil {
+		return err
+	}
+	slot := script.IndexOf(pubKey)
+	if slot < 0 {
+		return fmt.Errorf("wallet %s is not a signer of %s", w.Address(), script.Address())
+	}
+
+	// Changing the contents invalidates everyone's signatures
+	encoded := script.Encode()
+	id := tx.CalculateHash()
+	if tx.PublicKey != encoded || tx.ID != id || len(tx.Signatures) != len(script.PublicKeys) {
+		tx.PublicKey = encoded
+		tx.ID = id
+		tx.Signatures = make([]string, len(script.PublicKeys))
+	}
+
+	digest, err := hex.DecodeString(tx.ID)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return &block
+	sig, err := w.Sign(digest)
+	if err != nil {
+		return err
+	}
+	tx.Signatures[slot] = sig
+	return nil
 }
 
-// CalculateHash generates the hash of the block
-func (b *Block) CalculateHash() string {
-	// Simple verification hash (concatenating critical fields)
-	// In production, use Merkle Root for Transactions
-	txData := ""
-	for _, tx := range b.Transactions {
-		txData += tx.ID
+// NewCoinbaseTx creates the reward transaction for the block at height.
+// The height goes in the Nonce so rewards to the same miner get unique IDs.
+func NewCoinbaseTx(to string, amount, height int) *Transaction {
+	tx := &Transaction{
+		From:      CoinbaseSender,
+		To:        to,
+		Amount:    amount,
+		Nonce:     height,
+		Timestamp: time.Now().Unix(),
 	}
-	record := fmt.Sprintf("%d%d%s%s%d", b.Index, b.Timestamp, txData, b.PrevHash, b.Nonce)
-	h := sha256.New()
-	h.Write([]byte(record))
-	return hex.EncodeToString(h.Sum(nil))
+	tx.ID = tx.CalculateHash()
+	return tx
+}
+
+// BlockHeader holds the fields covered by the block hash. Transactions are
+// bound to it through MerkleRoot, so a header alone is enough to check a
+// Merkle inclusion proof.
+type BlockHeader struct {
+	Index      int
+	Timestamp  int64
+	PrevHash   string
+	MerkleRoot string
+	Bits       uint32 // Compact PoW target, see CompactToBig
+	Hash       string
+	Nonce      int
 }
 
-// NewBlock creates a new block
-func NewBlock(txs []*Transaction, prevHash string, height int) *Block {
+// Block represents a secured batch of transactions
+type Block struct {
+	BlockHeader
+	Transactions []*Transaction
+}
+
+// CalculateHash generates the hash of the block header from its canonical bytes
+func (h *BlockHeader) CalculateHash() string {
+	sum := sha256.Sum256(h.Serialize())
+	return hex.EncodeToString(sum[:])
+}
+
+// NewBlock creates a new block with the given PoW target
+func NewBlock(txs []*Transaction, prevHash string, height int, bits uint32) *Block {
 	block := &Block{
-		Index:        height,
-		Timestamp:    time.Now().Unix(),
+		BlockHeader: BlockHeader{
+			Index:      height,
+			Timestamp:  time.Now().Unix(),
+			PrevHash:   prevHash,
+			MerkleRoot: ComputeMerkleRoot(txs),
+			Bits:       bits,
+			Nonce:      0,
+		},
 		Transactions: txs,
-		PrevHash:     prevHash,
-		Nonce:        0,
 	}
 	// Hash is calculated during Mining, not here.
 	// But we set a placeholder.
 	block.Hash = block.CalculateHash()
 	return block
 }
-
-// NewGenesisBlock creates the first block
-func NewGenesisBlock(coinbase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinbase}, "0", 0)
-}
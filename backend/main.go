@@ -3,14 +3,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -32,10 +37,19 @@ func main() {
 	mode := flag.String("mode", "full", "Node mode: full, storage, or compute")
 	peerAddr := flag.String("peer", "", "Bootstrap peer address to connect to")
 	apiPort := flag.Int("api-port", 8080, "Port for HTTP API Gateway (e.g., 8080)")
+	network := flag.String("network", "main", "Network to join: main, testnet or regtest")
+	noMine := flag.Bool("no-mine", false, "Run as a validator only (blocks can still be mined via generate)")
+	allowGenerate := flag.Bool("allow-generate", false, "Serve the generate API on networks other than regtest (testing only)")
+	prune := flag.Int("prune", 0, fmt.Sprintf("Keep only the last N block bodies (0 keeps all, minimum %d)", blockchain.MinPruneDepth))
 
 	// 2. Parse Global Flags
 	flag.Parse()
 
+	params, err := blockchain.ParamsByName(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// ---------------------------------------------------------
 	// CLI Handling (Decision Logic)
 	// ---------------------------------------------------------
@@ -61,25 +75,54 @@ func main() {
 
 	switch command {
 	case "wallet":
-		handleWalletCmd(port)
+		// "wallet regtest-premine" adopts the well-known regtest premine key
+		handleWalletCmd(port, args[1:])
 	case "run-job":
-		handleRunJobCmd(ctx, args[1:], peerAddr)
+		handleRunJobCmd(ctx, params, port, args[1:], peerAddr)
 	case "pay":
 		// Pay requires blockchain access (for nonces/balance).
 		// If the node is running, the DB is locked.
 		// For this MVP, we will try to open it. If locked, we warn the user.
-		handlePayCmd(port, args[1:])
+		handlePayCmd(params, port, args[1:])
+	case "multisig":
+		// M-of-N addresses: create, then pay/sign/send spends from them
+		handleMultisigCmd(port, args[1:])
+	case "channel":
+		// Payment channels: open, then pay per job off-chain (run-job --channel), close/settle
+		handleChannelCmd(params, port, args[1:])
+	case "deal":
+		// Storage deals (see upload --duration): audit a provider, slash missed proofs
+		handleDealCmd(ctx, params, port, peerAddr, args[1:])
+	case "refund":
+		// Returns a timed-out escrow (see pay --escrow) to this wallet
+		handleRefundCmd(params, port, args[1:])
+	case "generate":
+		// Asks a running node to mine blocks now (regtest and scripted tests)
+		handleGenerateCmd(args[1:])
+	case "reindex":
+		// Rebuilds the account-state table and address history from the stored chain (node must be stopped)
+		handleReindexCmd(params, port)
+	case "export":
+		// Writes the chain's blocks to a file (node must be stopped)
+		handleExportCmd(params, port, args[1:])
+	case "import":
+		// Validates and adds the blocks of an export file (node must be stopped)
+		handleImportCmd(params, port, args[1:])
+	case "snapshot":
+		// Saves the account state at a height, or bootstraps a new node from one
+		handleSnapshotCmd(params, port, args[1:])
 	case "upload":
-		handleUploadCmd(ctx, peerAddr, args[1:])
+		handleUploadCmd(ctx, params, port, peerAddr, args[1:])
 	case "download":
-		handleDownloadCmd(ctx, peerAddr, args[1:])
+		handleDownloadCmd(ctx, params, peerAddr, args[1:])
 	case "mine":
 		// Mine is a server-side activity usually, but exposed as CLI.
 		// It creates a full node.
-		startFullNode(ctx, port, vaultPath, mode, peerAddr, apiPort, true)
+		startFullNode(ctx, params, port, vaultPath, mode, peerAddr, apiPort, allowGenerate, prune, true)
 	default:
-		// No command -> Start Full Node (Mining Enabled by default for MVP)
-		startFullNode(ctx, port, vaultPath, mode, peerAddr, apiPort, true)
+		// No command -> Start Full Node (Mining Enabled by default for MVP,
+		// except with --no-mine or on networks that mine on demand)
+		startFullNode(ctx, params, port, vaultPath, mode, peerAddr, apiPort, allowGenerate, prune, !*noMine && !params.MineOnDemand)
 	}
 }
 
@@ -87,12 +130,26 @@ func main() {
 // Command Handlers (Refactored)
 // ---------------------------------------------------------
 
-func handleWalletCmd(port *int) {
+func handleWalletCmd(port *int, args []string) {
 	walletPath := fmt.Sprintf("./data/wallet_%d.dat", *port)
 	if *port == 0 {
 		walletPath = "./data/wallet_default.dat"
 	}
 
+	if len(args) > 0 {
+		if args[0] != "regtest-premine" {
+			log.Fatal("Usage: wallet [regtest-premine]")
+		}
+		// The key is public: never use this wallet outside regtest
+		if _, err := os.Stat(walletPath); err == nil {
+			log.Fatalf("Wallet %s already exists; use another --port", walletPath)
+		}
+		if err := wallet.FromSeed(blockchain.RegTestGenesisSeed).SaveFile(walletPath); err != nil {
+			log.Fatalf("Failed to save wallet: %v", err)
+		}
+		log.Printf("Saved the regtest premine key to %s (regtest only: the key is public)", walletPath)
+	}
+
 	w, err := wallet.LoadFile(walletPath)
 	if err != nil {
 		log.Println("No existing wallet found. Creating new...")
@@ -102,15 +159,155 @@ func handleWalletCmd(port *int) {
 		}
 	}
 	fmt.Printf("Wallet Address: %s\n", w.Address())
+	if pubKey, err := w.PublicKeyHex(); err == nil {
+		// Shared with co-signers to build multisig addresses
+		fmt.Printf("Public Key: %s\n", pubKey)
+	}
+}
+
+func handleMultisigCmd(port *int, args []string) {
+	usage := "Usage: multisig create|pay|sign|send [flags]"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	switch args[0] {
+	case "create":
+		// Builds an M-of-N address from the signers' public keys (see wallet)
+		createCmd := flag.NewFlagSet("multisig create", flag.ExitOnError)
+		m := createCmd.Int("m", 2, "Signatures required")
+		keys := createCmd.String("keys", "", "Comma-separated public keys of all signers")
+		if err := createCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+
+		script, err := wallet.NewMultisigScript(*m, strings.Split(*keys, ","))
+		if err != nil {
+			log.Fatalf("Invalid multisig: %v", err)
+		}
+		fmt.Printf("Multisig Address (%d-of-%d): %s\n", script.M, len(script.PublicKeys), script.Address())
+		fmt.Printf("Script: %s\n", script.Encode())
+
+	case "pay":
+		// Creates a spend from the multisig address with our signature
+		payCmd := flag.NewFlagSet("multisig pay", flag.ExitOnError)
+		encoded := payCmd.String("script", "", "Multisig script (from multisig create)")
+		toAddr := payCmd.String("to", "", "Recipient Address")
+		amount := payCmd.Int("amount", 0, "Amount to send")
+		fee := payCmd.Int("fee", 0, "Fee offered to the miner")
+		out := payCmd.String("out", "multisig_tx.json", "File to write the partially signed transaction to")
+		apiPort := payCmd.Int("api-port", 8080, "API Port of running node")
+		if err := payCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+		if *encoded == "" || *toAddr == "" || *amount <= 0 {
+			log.Fatal("Usage: multisig pay --script <script> --to <addr> --amount <N> [--fee <N>] [--out file]")
+		}
+
+		script, err := wallet.DecodeMultisigScript(*encoded)
+		if err != nil {
+			log.Fatalf("Invalid script: %v", err)
+		}
+		nonce, err := fetchNonce(*apiPort, script.Address())
+		if err != nil {
+			log.Fatalf("Could not fetch nonce from node: %v", err)
+		}
+		tx := &blockchain.Transaction{
+			From:      script.Address(),
+			To:        *toAddr,
+			Amount:    *amount,
+			Fee:       *fee,
+			Nonce:     nonce,
+			Timestamp: time.Now().Unix(),
+		}
+		if err := tx.SignMultisig(script, loadWallet(port)); err != nil {
+			log.Fatalf("Failed to sign: %v", err)
+		}
+		writeMultisigTx(*out, tx)
+		log.Printf("Signed 1 of %d required. Pass %s to the other signers (multisig sign --tx %s)", script.M, *out, *out)
+
+	case "sign":
+		// Adds our signature to a transaction another signer created
+		signCmd := flag.NewFlagSet("multisig sign", flag.ExitOnError)
+		txFile := signCmd.String("tx", "multisig_tx.json", "Partially signed transaction file")
+		if err := signCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+
+		tx := readMultisigTx(*txFile)
+		script, err := wallet.DecodeMultisigScript(tx.PublicKey)
+		if err != nil {
+			log.Fatalf("Transaction is not from a multisig address: %v", err)
+		}
+		if err := tx.SignMultisig(script, loadWallet(port)); err != nil {
+			log.Fatalf("Failed to sign: %v", err)
+		}
+		writeMultisigTx(*txFile, tx)
+
+		signed := 0
+		for _, sig := range tx.Signatures {
+			if sig != "" {
+				signed++
+			}
+		}
+		log.Printf("Signed %d of %d required (Tx %s)", signed, script.M, tx.ID)
+
+	case "send":
+		// Submits a fully signed transaction to a running node
+		sendCmd := flag.NewFlagSet("multisig send", flag.ExitOnError)
+		txFile := sendCmd.String("tx", "multisig_tx.json", "Signed transaction file")
+		apiPort := sendCmd.Int("api-port", 8080, "API Port of running node")
+		if err := sendCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+
+		jsonData, _ := json.Marshal(readMultisigTx(*txFile))
+		resp, err := http.Post(fmt.Sprintf("http://localhost:%d/api/v1/transaction", *apiPort), "application/json", bytes.NewBuffer(jsonData))
+		if err != nil {
+			log.Fatalf("API Connection Failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("API Error (Status %d): %s", resp.StatusCode, string(body))
+		}
+		log.Printf("✅ Multisig Payment Sent Successfully!")
+		log.Println(string(body))
+
+	default:
+		log.Fatal(usage)
+	}
+}
+
+func readMultisigTx(path string) *blockchain.Transaction {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read transaction: %v", err)
+	}
+	var tx blockchain.Transaction
+	if err := json.Unmarshal(data, &tx); err != nil {
+		log.Fatalf("Invalid transaction file: %v", err)
+	}
+	return &tx
+}
+
+func writeMultisigTx(path string, tx *blockchain.Transaction) {
+	data, _ := json.MarshalIndent(tx, "", "  ")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		log.Fatalf("Failed to write transaction: %v", err)
+	}
 }
 
-func handleRunJobCmd(ctx context.Context, args []string, bootPeer *string) {
+func handleRunJobCmd(ctx context.Context, params *blockchain.NetworkParams, port *int, args []string, bootPeer *string) {
 	// Lightweight P2P Node (No Chain, No Vault)
 	jobCmd := flag.NewFlagSet("run-job", flag.ExitOnError)
 	wasmFile := jobCmd.String("wasm", "", "WASM file to execute")
 	inputText := jobCmd.String("input", "", "Input string data")
 	targetID := jobCmd.String("target", "", "Specific Peer ID to send job to (optional)")
-	txID := jobCmd.String("tx", "", "Transaction ID for payment")
+	txID := jobCmd.String("tx", "", "Job payment or escrow transaction ID (see pay --wasm)")
+	channelID := jobCmd.String("channel", "", "Pay through this payment channel instead (see channel open)")
+	price := jobCmd.Int("price", p2p.MinJobPayment, "Coins to pay over the channel for this job (with --channel)")
+	quote := jobCmd.Bool("quote", false, "Ask the worker for the hash lock to escrow this job under (see pay --escrow) instead of running it")
 	// Allow --peer to be specified AFTER the subcommand
 	subPeer := jobCmd.String("peer", "", "Bootstrap peer address")
 
@@ -124,7 +321,7 @@ func handleRunJobCmd(ctx context.Context, args []string, bootPeer *string) {
 
 	// Initialize Lightweight P2P Node (Random Port)
 	log.Println("[CLI] Starting lightweight P2P client...")
-	node, err := p2p.NewNode(ctx, 0) // 0 = Random Port
+	node, err := p2p.NewNode(ctx, 0, params) // 0 = Random Port
 	if err != nil {
 		log.Fatalf("Failed to start P2P client: %v", err)
 	}
@@ -175,10 +372,48 @@ func handleRunJobCmd(ctx context.Context, args []string, bootPeer *string) {
 		node.Host.Connect(ctx, providers[0])
 	}
 
+	if *quote {
+		address, hashLock, err := node.RequestEscrowQuote(ctx, targetPeer, wasmCode, []byte(*inputText))
+		if err != nil {
+			log.Fatalf("Quote failed: %v", err)
+		}
+		log.Printf("Worker %s (address %s) quotes hash lock %x", targetPeer, address, hashLock)
+		log.Printf("Lock the payment with: pay --to %s --amount %d --wasm %s --input %q --escrow <blocks> --hashlock %x", address, p2p.MinJobPayment, *wasmFile, *inputText, hashLock)
+		return
+	}
+
 	log.Printf("Sending job to %s...", targetPeer)
-	result, err := node.SendComputeReq(ctx, targetPeer, wasmCode, []byte(*inputText), *txID)
-	if err != nil {
-		log.Fatalf("Job Execution Failed: %v", err)
+	var result []byte
+	if *channelID != "" {
+		// Sign a balance update raising what we have paid over the channel.
+		// It is saved first: once sent, the worker may hold it.
+		paid := readChannelPaid(*channelID) + *price
+		update, err := blockchain.SignChannelUpdate(*channelID, paid, loadWallet(port))
+		if err != nil {
+			log.Fatalf("Failed to sign channel update: %v", err)
+		}
+		writeChannelPaid(*channelID, paid)
+		result, err = node.SendChannelComputeReq(ctx, targetPeer, wasmCode, []byte(*inputText), update)
+		if err != nil {
+			log.Fatalf("Job Execution Failed: %v", err)
+		}
+		log.Printf("Paid %d over channel %s (%d in total)", *price, *channelID, paid)
+	} else if lock, err := os.ReadFile(escrowLockPath(*txID)); err == nil {
+		// Escrowed payment: the result only opens with the preimage the
+		// worker reveals by claiming
+		hashLock, err := hex.DecodeString(string(lock))
+		if err != nil {
+			log.Fatalf("Corrupt escrow hash lock: %v", err)
+		}
+		result, err = node.SendEscrowedComputeReq(ctx, targetPeer, wasmCode, []byte(*inputText), *txID, hashLock)
+		if err != nil {
+			log.Fatalf("Job Execution Failed: %v", err)
+		}
+	} else {
+		result, err = node.SendComputeReq(ctx, targetPeer, wasmCode, []byte(*inputText), *txID)
+		if err != nil {
+			log.Fatalf("Job Execution Failed: %v", err)
+		}
 	}
 
 	log.Println("------------------------------------------------")
@@ -186,29 +421,31 @@ func handleRunJobCmd(ctx context.Context, args []string, bootPeer *string) {
 	log.Println("------------------------------------------------")
 }
 
-func handlePayCmd(port *int, args []string) {
+func handlePayCmd(params *blockchain.NetworkParams, port *int, args []string) {
 	// Re-uses full node logic partially but fails if locked.
 	// For MVP: Must open chain to create valid TX.
-	walletPath := fmt.Sprintf("./data/wallet_%d.dat", *port)
-	if *port == 0 {
-		walletPath = "./data/wallet_default.dat"
-	}
-	w, err := wallet.LoadFile(walletPath)
-	if err != nil {
-		log.Fatalf("Wallet not found: %v", err)
-	}
+	w := loadWallet(port)
 
 	payCmd := flag.NewFlagSet("pay", flag.ExitOnError)
 	toAddr := payCmd.String("to", "", "Recipient Address")
 	amount := payCmd.Int("amount", 0, "Amount to send")
+	fee := payCmd.Int("fee", 0, "Fee offered to the miner (higher confirms sooner)")
 	apiPort := payCmd.Int("api-port", 8080, "API Port of running node")
+	nonce := payCmd.Int("nonce", -1, "Transaction nonce (-1 = ask the node)")
+	jobWasm := payCmd.String("wasm", "", "Pay for a compute job: WASM file the worker (--to) will run")
+	jobInput := payCmd.String("input", "", "Input string of the paid compute job (with --wasm)")
+	escrowBlocks := payCmd.Int("escrow", 0, "Lock the job payment in escrow, refundable after N blocks (with --wasm)")
+	hashLockHex := payCmd.String("hashlock", "", "Hash lock the worker quoted for the job (with --escrow, see run-job --quote)")
 
 	if err := payCmd.Parse(args); err != nil {
 		log.Fatalf("Failed flags: %v", err)
 	}
 
 	if *toAddr == "" || *amount <= 0 {
-		log.Fatal("Usage: pay --to <addr> --amount <N> [--api-port 8080]")
+		log.Fatal("Usage: pay --to <addr> --amount <N> [--fee <N>] [--wasm <file> --input <str> [--escrow <blocks> --hashlock <hex>]] [--api-port 8080]")
+	}
+	if *escrowBlocks > 0 && (*jobWasm == "" || *hashLockHex == "") {
+		log.Fatal("--escrow needs the job's --wasm and --input, and the worker's --hashlock (see run-job --quote)")
 	}
 
 	// 1. Create Transaction (Offline)
@@ -221,17 +458,402 @@ func handlePayCmd(port *int, args []string) {
 		From:      w.Address(),
 		To:        *toAddr,
 		Amount:    *amount,
+		Fee:       *fee,
+		Nonce:     *nonce,
 		Timestamp: time.Now().Unix(),
 	}
-	tx.ID = tx.CalculateHash()
-	sig, err := w.Sign([]byte(tx.ID))
+	var hashLock []byte
+	if *jobWasm != "" {
+		// Bind the payment to this worker and job so it can't be reused
+		wasmCode, err := os.ReadFile(*jobWasm)
+		if err != nil {
+			log.Fatalf("Failed to read wasm file: %v", err)
+		}
+		jobHash := blockchain.JobHash(wasmCode, []byte(*jobInput))
+		tx.Type = blockchain.TxJobPayment
+		tx.Payload = jobHash
+
+		if *escrowBlocks > 0 {
+			// Only the worker knows the preimage; revealing it to claim is
+			// what opens the result it sends us (see run-job)
+			hashLock, err = hex.DecodeString(*hashLockHex)
+			if err != nil || len(hashLock) != sha256.Size {
+				log.Fatalf("Invalid --hashlock %q", *hashLockHex)
+			}
+			height, err := fetchTipHeight(*apiPort)
+			if err != nil {
+				log.Fatalf("Escrow needs a running node to read the chain height: %v", err)
+			}
+			tx.Type = blockchain.TxHTLCLock
+			tx.Payload = blockchain.HTLCLockPayload(hashLock, height+*escrowBlocks, jobHash)
+		}
+	}
+
+	tx = sendTransaction(params, port, *apiPort, tx, w)
+
+	if hashLock != nil {
+		lockPath := escrowLockPath(tx.ID)
+		if err := os.WriteFile(lockPath, []byte(hex.EncodeToString(hashLock)), 0600); err != nil {
+			log.Fatalf("Failed to save escrow hash lock (escrow %s can only be refunded): %v", tx.ID, err)
+		}
+		log.Printf("Escrow hash lock saved to %s. Run the job with: run-job --tx %s", lockPath, tx.ID)
+	}
+}
+
+func handleRefundCmd(params *blockchain.NetworkParams, port *int, args []string) {
+	w := loadWallet(port)
+
+	refundCmd := flag.NewFlagSet("refund", flag.ExitOnError)
+	lockID := refundCmd.String("lock", "", "Transaction ID of the escrow lock")
+	fee := refundCmd.Int("fee", 0, "Fee offered to the miner")
+	apiPort := refundCmd.Int("api-port", 8080, "API Port of running node")
+
+	if err := refundCmd.Parse(args); err != nil {
+		log.Fatalf("Failed flags: %v", err)
+	}
+	if *lockID == "" {
+		log.Fatal("Usage: refund --lock <txid> [--fee <N>] [--api-port 8080]")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/escrow/%s", *apiPort, *lockID))
 	if err != nil {
+		log.Fatalf("API Connection Failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Escrow lookup failed (Status %d): %s", resp.StatusCode, string(body))
+	}
+	var escrow blockchain.Escrow
+	if err := json.NewDecoder(resp.Body).Decode(&escrow); err != nil {
+		log.Fatalf("Bad escrow response: %v", err)
+	}
+
+	tx := &blockchain.Transaction{
+		From:      w.Address(),
+		To:        w.Address(),
+		Amount:    escrow.Amount,
+		Fee:       *fee,
+		Nonce:     -1,
+		Timestamp: time.Now().Unix(),
+		Type:      blockchain.TxHTLCRefund,
+		Payload:   blockchain.HTLCRefundPayload(escrow.ID),
+	}
+	sendTransaction(params, port, *apiPort, tx, w)
+}
+
+func handleChannelCmd(params *blockchain.NetworkParams, port *int, args []string) {
+	usage := "Usage: channel open|close|settle [flags]"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+	w := loadWallet(port)
+
+	switch args[0] {
+	case "open":
+		// Locks a deposit for a worker, paid out job by job with run-job --channel
+		openCmd := flag.NewFlagSet("channel open", flag.ExitOnError)
+		toAddr := openCmd.String("to", "", "Worker Address")
+		amount := openCmd.Int("amount", 0, "Deposit to lock in the channel")
+		window := openCmd.Int("window", 20, "Dispute window in blocks (workers need at least 6)")
+		fee := openCmd.Int("fee", 0, "Fee offered to the miner")
+		apiPort := openCmd.Int("api-port", 8080, "API Port of running node")
+		if err := openCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+		if *toAddr == "" || *amount <= 0 {
+			log.Fatal("Usage: channel open --to <addr> --amount <N> [--window <blocks>] [--fee <N>] [--api-port 8080]")
+		}
+
+		tx := &blockchain.Transaction{
+			From:      w.Address(),
+			To:        *toAddr,
+			Amount:    *amount,
+			Fee:       *fee,
+			Nonce:     -1,
+			Timestamp: time.Now().Unix(),
+			Type:      blockchain.TxChannelOpen,
+			Payload:   blockchain.ChannelOpenPayload(*window),
+		}
+		tx = sendTransaction(params, port, *apiPort, tx, w)
+		writeChannelPaid(tx.ID, 0)
+		log.Printf("Channel %s opened. Once confirmed, run jobs with: run-job --channel %s", tx.ID, tx.ID)
+
+	case "close":
+		// The worker closes with its latest update and is paid at once; the
+		// payer's close pays out after the dispute window (see channel settle)
+		closeCmd := flag.NewFlagSet("channel close", flag.ExitOnError)
+		id := closeCmd.String("id", "", "Channel ID (its open transaction)")
+		fee := closeCmd.Int("fee", 0, "Fee offered to the miner")
+		apiPort := closeCmd.Int("api-port", 8080, "API Port of running node")
+		if err := closeCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+		if *id == "" {
+			log.Fatal("Usage: channel close --id <channel> [--fee <N>] [--api-port 8080]")
+		}
+
+		ch := fetchChannel(*apiPort, *id)
+		switch w.Address() {
+		case ch.To:
+			// Only our node holds the updates we were paid with
+			resp, err := postAdmin(*apiPort, "/api/v1/channel/"+ch.ID+"/close", nil)
+			if err != nil {
+				log.Fatalf("API Connection Failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				log.Fatalf("API Error (Status %d): %s", resp.StatusCode, string(body))
+			}
+			log.Printf("✅ Channel Closed! %s", string(body))
+		case ch.From:
+			paid := readChannelPaid(ch.ID)
+			update := &blockchain.ChannelUpdate{ChannelID: ch.ID, Paid: paid}
+			if paid > 0 {
+				signed, err := blockchain.SignChannelUpdate(ch.ID, paid, w)
+				if err != nil {
+					log.Fatalf("Failed to sign channel update: %v", err)
+				}
+				update = signed
+			}
+			tx := &blockchain.Transaction{
+				From:      w.Address(),
+				To:        w.Address(),
+				Amount:    ch.Deposit,
+				Fee:       *fee,
+				Nonce:     -1,
+				Timestamp: time.Now().Unix(),
+				Type:      blockchain.TxChannelClose,
+				Payload:   blockchain.ChannelClosePayload(update),
+			}
+			sendTransaction(params, port, *apiPort, tx, w)
+			log.Printf("Closing channel %s with %d paid. Settle it %d blocks after the close confirms: channel settle --id %s", ch.ID, paid, ch.DisputeWindow, ch.ID)
+		default:
+			log.Fatalf("This wallet is not a party to channel %s", ch.ID)
+		}
+
+	case "settle":
+		// Pays out a payer's close once its dispute window has passed
+		settleCmd := flag.NewFlagSet("channel settle", flag.ExitOnError)
+		id := settleCmd.String("id", "", "Channel ID (its open transaction)")
+		fee := settleCmd.Int("fee", 0, "Fee offered to the miner")
+		apiPort := settleCmd.Int("api-port", 8080, "API Port of running node")
+		if err := settleCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+		if *id == "" {
+			log.Fatal("Usage: channel settle --id <channel> [--fee <N>] [--api-port 8080]")
+		}
+
+		ch := fetchChannel(*apiPort, *id)
+		tx := &blockchain.Transaction{
+			From:      w.Address(),
+			To:        w.Address(),
+			Amount:    ch.Deposit,
+			Fee:       *fee,
+			Nonce:     -1,
+			Timestamp: time.Now().Unix(),
+			Type:      blockchain.TxChannelSettle,
+			Payload:   blockchain.ChannelSettlePayload(ch.ID),
+		}
+		sendTransaction(params, port, *apiPort, tx, w)
+
+	default:
+		log.Fatal(usage)
+	}
+}
+
+func handleDealCmd(ctx context.Context, params *blockchain.NetworkParams, port *int, peerAddr *string, args []string) {
+	usage := "Usage: deal audit|slash [flags]"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	switch args[0] {
+	case "audit":
+		// Asks the provider for random chunks of the shard and checks them
+		// against the root the deal committed to; anyone can audit
+		auditCmd := flag.NewFlagSet("deal audit", flag.ExitOnError)
+		id := auditCmd.String("id", "", "Deal ID (its deal transaction)")
+		samples := auditCmd.Int("samples", 8, "Chunks to check (at most 16)")
+		subPeer := auditCmd.String("peer", "", "Bootstrap peer address")
+		apiPort := auditCmd.Int("api-port", 8080, "API Port of running node")
+		if err := auditCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+		if *id == "" {
+			log.Fatal("Usage: deal audit --id <deal> [--samples <N>] [--peer <addr>] [--api-port 8080]")
+		}
+		deal := fetchDeal(*apiPort, *id)
+		log.Printf("Deal %s: %d of %d periods proven, %d missed", deal.ID, deal.Proven, deal.Periods(), deal.Missed)
+
+		node, err := p2p.NewNode(ctx, 0, params)
+		if err != nil {
+			log.Fatalf("Failed to start P2P client: %v", err)
+		}
+		effectivePeer := *peerAddr
+		if *subPeer != "" {
+			effectivePeer = *subPeer
+		}
+		if effectivePeer != "" {
+			node.EnableDHT([]string{effectivePeer})
+		} else {
+			node.EnableDHT(nil)
+		}
+		time.Sleep(2 * time.Second) // Wait for DHT
+
+		ctxT, cancel := context.WithTimeout(ctx, 10*time.Second)
+		providers, err := node.DHT.FindProviders(ctxT, deal.ShardKey)
+		cancel()
+		if err != nil || len(providers) == 0 {
+			log.Fatalf("❌ No peer announces shard %s: %v", deal.ShardKey, err)
+		}
+		failed := 0
+		for _, provider := range providers {
+			err := node.AuditDeal(ctx, provider.ID, deal, *samples)
+			if err != nil {
+				log.Printf("❌ %s failed the audit: %v", provider.ID, err)
+				failed++
+				continue
+			}
+			log.Printf("✅ %s holds shard %s (%d chunks verified against root %x)", provider.ID, deal.ShardKey, min(max(*samples, 1), p2p.MaxAuditSamples), deal.ShardRoot)
+		}
+		if failed == len(providers) {
+			os.Exit(1)
+		}
+
+	case "slash":
+		// Refunds the periods the provider didn't prove (the provider's next
+		// proof also refunds them)
+		slashCmd := flag.NewFlagSet("deal slash", flag.ExitOnError)
+		id := slashCmd.String("id", "", "Deal ID (its deal transaction)")
+		fee := slashCmd.Int("fee", 0, "Fee offered to the miner")
+		apiPort := slashCmd.Int("api-port", 8080, "API Port of running node")
+		if err := slashCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+		if *id == "" {
+			log.Fatal("Usage: deal slash --id <deal> [--fee <N>] [--api-port 8080]")
+		}
+
+		w := loadWallet(port)
+		deal := fetchDeal(*apiPort, *id)
+		tx := &blockchain.Transaction{
+			From:      w.Address(),
+			To:        w.Address(),
+			Amount:    deal.Price,
+			Fee:       *fee,
+			Nonce:     -1,
+			Timestamp: time.Now().Unix(),
+			Type:      blockchain.TxDealSlash,
+			Payload:   blockchain.DealSlashPayload(deal.ID),
+		}
+		sendTransaction(params, port, *apiPort, tx, w)
+
+	default:
+		log.Fatal(usage)
+	}
+}
+
+// fetchDeal asks a running node for an active storage deal.
+func fetchDeal(apiPort int, dealID string) *blockchain.StorageDeal {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/deal/%s", apiPort, dealID))
+	if err != nil {
+		log.Fatalf("API Connection Failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Deal lookup failed (Status %d): %s", resp.StatusCode, string(body))
+	}
+	var deal blockchain.StorageDeal
+	if err := json.NewDecoder(resp.Body).Decode(&deal); err != nil {
+		log.Fatalf("Bad deal response: %v", err)
+	}
+	return &deal
+}
+
+// fetchChannel asks a running node for an open payment channel.
+func fetchChannel(apiPort int, channelID string) *blockchain.Channel {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/channel/%s", apiPort, channelID))
+	if err != nil {
+		log.Fatalf("API Connection Failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Channel lookup failed (Status %d): %s", resp.StatusCode, string(body))
+	}
+	var ch blockchain.Channel
+	if err := json.NewDecoder(resp.Body).Decode(&ch); err != nil {
+		log.Fatalf("Bad channel response: %v", err)
+	}
+	return &ch
+}
+
+// channelPaidPath is where the payer tracks the total paid over a channel.
+func channelPaidPath(channelID string) string {
+	return fmt.Sprintf("./data/channel_%s.paid", channelID)
+}
+
+func readChannelPaid(channelID string) int {
+	data, err := os.ReadFile(channelPaidPath(channelID))
+	if err != nil {
+		log.Fatalf("Unknown channel %s (open one with channel open): %v", channelID, err)
+	}
+	paid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		log.Fatalf("Corrupt channel file: %v", err)
+	}
+	return paid
+}
+
+func writeChannelPaid(channelID string, paid int) {
+	if err := os.WriteFile(channelPaidPath(channelID), []byte(strconv.Itoa(paid)), 0600); err != nil {
+		log.Fatalf("Failed to save channel state: %v", err)
+	}
+}
+
+// loadWallet opens the wallet of the node on port.
+func loadWallet(port *int) *wallet.Wallet {
+	walletPath := fmt.Sprintf("./data/wallet_%d.dat", *port)
+	if *port == 0 {
+		walletPath = "./data/wallet_default.dat"
+	}
+	w, err := wallet.LoadFile(walletPath)
+	if err != nil {
+		log.Fatalf("Wallet not found: %v", err)
+	}
+	return w
+}
+
+// escrowLockPath is where pay --escrow keeps the hash lock of an escrow, to
+// check the preimage the worker reveals.
+func escrowLockPath(lockID string) string {
+	return fmt.Sprintf("./data/escrow_%s.lock", lockID)
+}
+
+// sendTransaction signs tx (asking the node for the nonce if tx.Nonce < 0)
+// and submits it through the API of a running node, or directly to the
+// chain database if the node is down. It returns the submitted transaction.
+func sendTransaction(params *blockchain.NetworkParams, port *int, apiPort int, tx *blockchain.Transaction, w *wallet.Wallet) *blockchain.Transaction {
+	askNonce := tx.Nonce < 0
+	if askNonce {
+		// Ask the node for our next nonce (confirmed + pending)
+		// If the node is down, the offline fallback below reads it from the DB.
+		n, err := fetchNonce(apiPort, tx.From)
+		if err != nil {
+			log.Printf("⚠️ Could not fetch nonce from node: %v", err)
+		}
+		tx.Nonce = n
+	}
+	if err := tx.Sign(w); err != nil {
 		log.Fatalf("Failed to sign: %v", err)
 	}
-	tx.Signature = sig
 
 	// 2. Try Broadcast via API (Preferred)
-	apiURL := fmt.Sprintf("http://localhost:%d/api/v1/transaction", *apiPort)
+	apiURL := fmt.Sprintf("http://localhost:%d/api/v1/transaction", apiPort)
 	log.Printf("Attempting to broadcast Tx %s to %s...", tx.ID, apiURL)
 
 	jsonData, _ := json.Marshal(tx)
@@ -245,7 +867,7 @@ func handlePayCmd(port *int, args []string) {
 		if resp.StatusCode == 200 {
 			log.Printf("✅ Payment Sent Successfully! (via API)")
 			log.Println(string(body))
-			return
+			return tx
 		} else {
 			log.Printf("⚠️ API Error (Status %d): %s", resp.StatusCode, string(body))
 		}
@@ -259,34 +881,288 @@ func handlePayCmd(port *int, args []string) {
 		nodeID = fmt.Sprintf("%d", *port)
 	}
 
-	chain := blockchain.InitBlockchain(nodeID, w.Address())
+	chain := blockchain.InitBlockchain(params, nodeID)
 	defer chain.Close()
 
-	// Verify? We signed it ourselves, so it's valid.
-	chain.AddTransaction(tx)
+	if askNonce {
+		tx.Nonce = chain.NextNonce(tx.From)
+		if err := tx.Sign(w); err != nil {
+			log.Fatalf("Failed to sign: %v", err)
+		}
+	}
+	if err := chain.AddTransaction(tx); err != nil {
+		log.Fatalf("Transaction rejected: %v", err)
+	}
 	log.Printf("Transaction Added to Mempool (Offline Mode): %s", tx.ID)
 
 	// Auto-mine to confirm (since we are offline admin)
-	newBlock := chain.AddBlock([]*blockchain.Transaction{})
+	newBlock := chain.AddBlock(w.Address())
 	log.Printf("Confirmed in Block #%d", newBlock.Index)
+	return tx
+}
+
+// postAdmin sends a JSON POST to an admin route of the local node, with the
+// API token the node saved for apiPort.
+func postAdmin(apiPort int, path string, body []byte) (*http.Response, error) {
+	token, err := os.ReadFile(api.TokenPath(apiPort))
+	if err != nil {
+		return nil, fmt.Errorf("no API token for port %d (is the node running here?): %w", apiPort, err)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d%s", apiPort, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	api.SetToken(req, strings.TrimSpace(string(token)))
+	return http.DefaultClient.Do(req)
+}
+
+func handleGenerateCmd(args []string) {
+	genCmd := flag.NewFlagSet("generate", flag.ExitOnError)
+	blocks := genCmd.Int("blocks", 1, "Number of blocks to mine")
+	toAddr := genCmd.String("to", "", "Reward address (default: the node's wallet)")
+	apiPort := genCmd.Int("api-port", 8080, "API Port of running node")
+
+	if err := genCmd.Parse(args); err != nil {
+		log.Fatalf("Failed flags: %v", err)
+	}
+	if *blocks <= 0 {
+		log.Fatal("Usage: generate [--blocks <N>] [--to <addr>] [--api-port 8080]")
+	}
+
+	jsonData, _ := json.Marshal(api.GenerateRequest{Blocks: *blocks, Address: *toAddr})
+	resp, err := postAdmin(*apiPort, "/api/v1/generate", jsonData)
+	if err != nil {
+		log.Fatalf("API Connection Failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("API Error (Status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Height int      `json:"height"`
+		Blocks []string `json:"blocks"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		log.Fatalf("Bad response: %v", err)
+	}
+	for _, hash := range result.Blocks {
+		fmt.Println(hash)
+	}
+	log.Printf("✅ Mined %d blocks. Height: %d", len(result.Blocks), result.Height)
+}
+
+func handleReindexCmd(params *blockchain.NetworkParams, port *int) {
+	chain := blockchain.InitBlockchain(params, chainNodeID(port))
+	defer chain.Close()
+
+	if err := chain.ReindexState(); err != nil {
+		log.Fatalf("Reindex failed: %v", err)
+	}
+	if err := chain.ReindexAddressHistory(); err != nil {
+		log.Fatalf("Reindex failed: %v", err)
+	}
+	log.Printf("✅ Account state rebuilt. Tip: %s", chain.LastHash)
+}
+
+// chainNodeID names the chain database of the node on port, as setupNode does.
+func chainNodeID(port *int) string {
+	if *port == 0 {
+		return "random"
+	}
+	return fmt.Sprintf("%d", *port)
 }
 
-func handleUploadCmd(ctx context.Context, peerAddr *string, args []string) {
+func handleExportCmd(params *blockchain.NetworkParams, port *int, args []string) {
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+	out := exportCmd.String("out", "", "File to write the blocks to")
+	from := exportCmd.Int("from", 0, "First block height")
+	to := exportCmd.Int("to", math.MaxInt, "Last block height (default: the tip)")
+	if err := exportCmd.Parse(args); err != nil {
+		log.Fatalf("Failed flags: %v", err)
+	}
+	if *out == "" {
+		log.Fatal("Usage: export --out <file> [--from <height>] [--to <height>]")
+	}
+
+	chain := blockchain.InitBlockchain(params, chainNodeID(port))
+	defer chain.Close()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+	defer f.Close()
+	n, err := chain.ExportChain(f, *from, *to)
+	if err != nil {
+		log.Fatalf("Export failed after %d blocks: %v", n, err)
+	}
+	log.Printf("✅ Exported %d blocks to %s", n, *out)
+}
+
+func handleImportCmd(params *blockchain.NetworkParams, port *int, args []string) {
+	importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+	in := importCmd.String("in", "", "Export file to read the blocks from")
+	if err := importCmd.Parse(args); err != nil {
+		log.Fatalf("Failed flags: %v", err)
+	}
+	if *in == "" {
+		log.Fatal("Usage: import --in <file>")
+	}
+
+	chain := blockchain.InitBlockchain(params, chainNodeID(port))
+	defer chain.Close()
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", *in, err)
+	}
+	defer f.Close()
+	n, err := chain.ImportChain(f)
+	if err != nil {
+		log.Fatalf("Import stopped after %d blocks: %v", n, err)
+	}
+	log.Printf("✅ Imported %d blocks. Tip: %s", n, chain.LastHash)
+}
+
+func handleSnapshotCmd(params *blockchain.NetworkParams, port *int, args []string) {
+	usage := "Usage: snapshot save|load [flags]"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	switch args[0] {
+	case "save":
+		saveCmd := flag.NewFlagSet("snapshot save", flag.ExitOnError)
+		out := saveCmd.String("out", "", "File to write the snapshot to")
+		height := saveCmd.Int("height", -1, "Block height of the snapshot (default: the tip)")
+		if err := saveCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+		if *out == "" {
+			log.Fatal("Usage: snapshot save --out <file> [--height <N>]")
+		}
+
+		chain := blockchain.InitBlockchain(params, chainNodeID(port))
+		defer chain.Close()
+		if *height < 0 {
+			tip, err := chain.GetHeader(chain.LastHash)
+			if err != nil {
+				log.Fatalf("Failed to read tip: %v", err)
+			}
+			*height = tip.Index
+		}
+
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *out, err)
+		}
+		defer f.Close()
+		header, entries, err := chain.WriteSnapshot(f, *height)
+		if err != nil {
+			log.Fatalf("Snapshot failed: %v", err)
+		}
+		log.Printf("✅ Snapshot of block #%d %s (%d state entries) written to %s", header.Index, header.Hash, entries, *out)
+
+	case "load":
+		// Only for a new node: the state is taken from the file as is
+		loadCmd := flag.NewFlagSet("snapshot load", flag.ExitOnError)
+		in := loadCmd.String("in", "", "Snapshot file from a trusted node")
+		if err := loadCmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed flags: %v", err)
+		}
+		if *in == "" {
+			log.Fatal("Usage: snapshot load --in <file>")
+		}
+
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", *in, err)
+		}
+		defer f.Close()
+		header, err := blockchain.LoadSnapshot(params, chainNodeID(port), f)
+		if err != nil {
+			log.Fatalf("Snapshot load failed: %v", err)
+		}
+		log.Printf("✅ Node bootstrapped at block #%d %s. Start it to sync the rest from peers (or import an export).", header.Index, header.Hash)
+
+	default:
+		log.Fatal(usage)
+	}
+}
+
+// fetchNonce asks a running node for the next nonce of an address.
+func fetchNonce(apiPort int, address string) (int, error) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/nonce/%s", apiPort, address))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Nonce int `json:"nonce"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Nonce, nil
+}
+
+// fetchTipHeight asks a running node for the height of its chain tip.
+func fetchTipHeight(apiPort int) (int, error) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/chain/tip", apiPort))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Height int `json:"height"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Height, nil
+}
+
+func handleUploadCmd(ctx context.Context, params *blockchain.NetworkParams, port *int, peerAddr *string, args []string) {
 	// Lightweight P2P Node (No Chain, No Vault to avoid Lock)
 	uploadCmd := flag.NewFlagSet("upload", flag.ExitOnError)
 	fileToUpload := uploadCmd.String("file", "", "File to upload")
 	subPeer := uploadCmd.String("peer", "", "Bootstrap peer address")
+	duration := uploadCmd.Int("duration", 0, "Store under storage deals lasting N blocks (0 = free, unrecorded)")
+	price := uploadCmd.Int("price", 0, "Price per shard for the whole deal (default: the provider minimum)")
+	fee := uploadCmd.Int("fee", 0, "Fee offered to the miner per deal transaction")
+	apiPort := uploadCmd.Int("api-port", 8080, "API Port of running node (records the deals)")
 
 	if err := uploadCmd.Parse(args); err != nil {
 		log.Fatalf("Failed to parse upload flags: %v", err)
 	}
+	var w *wallet.Wallet
+	if *duration > 0 {
+		w = loadWallet(port)
+		if *price == 0 {
+			*price = *duration * p2p.MinDealPricePerBlock
+		}
+	}
 
 	if *fileToUpload == "" {
 		log.Fatal("Please specify --file")
 	}
 
 	log.Printf("[CLI] Starting lightweight upload client...")
-	node, err := p2p.NewNode(ctx, 0)
+	node, err := p2p.NewNode(ctx, 0, params)
 	if err != nil {
 		log.Fatalf("Failed to start P2P client: %v", err)
 	}
@@ -341,6 +1217,27 @@ func handleUploadCmd(ctx context.Context, peerAddr *string, args []string) {
 		key := []byte(fmt.Sprintf("%s-shard-%d", *fileToUpload, i))
 
 		log.Printf("Shard %d -> Sending to %s...", i, targetPeer)
+		if w != nil {
+			// The provider signs the terms; we record them and escrow the price
+			proposal, providerKey, sig, err := node.SendDealReq(ctx, targetPeer, w.Address(), key, shard, *duration, *price)
+			if err != nil {
+				log.Printf("Failed to store shard %d with %s: %v", i, targetPeer, err)
+				continue
+			}
+			tx := &blockchain.Transaction{
+				From:      w.Address(),
+				To:        proposal.Provider,
+				Amount:    proposal.Price,
+				Fee:       *fee,
+				Nonce:     -1,
+				Timestamp: time.Now().Unix(),
+				Type:      blockchain.TxStorageDeal,
+				Payload:   blockchain.StorageDealPayload(proposal, providerKey, sig),
+			}
+			tx = sendTransaction(params, port, *apiPort, tx, w)
+			log.Printf("Shard %d -> %s (Deal %s)", i, proposal.Provider, tx.ID)
+			continue
+		}
 		err := node.SendStoreReq(ctx, targetPeer, key, shard)
 		if err != nil {
 			log.Printf("Failed to send shard %d to %s: %v", i, targetPeer, err)
@@ -355,7 +1252,7 @@ func handleUploadCmd(ctx context.Context, peerAddr *string, args []string) {
 	log.Printf("Upload Complete! original_size=%d", fileSize)
 }
 
-func handleDownloadCmd(ctx context.Context, peerAddr *string, args []string) {
+func handleDownloadCmd(ctx context.Context, params *blockchain.NetworkParams, peerAddr *string, args []string) {
 	// Lightweight Download Client
 	downloadCmd := flag.NewFlagSet("download", flag.ExitOnError)
 	fileToDownload := downloadCmd.String("file", "", "File to download/reconstruct")
@@ -371,7 +1268,7 @@ func handleDownloadCmd(ctx context.Context, peerAddr *string, args []string) {
 	}
 
 	log.Printf("[CLI] Starting lightweight download client...")
-	node, err := p2p.NewNode(ctx, 0)
+	node, err := p2p.NewNode(ctx, 0, params)
 	if err != nil {
 		log.Fatalf("Failed to start P2P client: %v", err)
 	}
@@ -463,22 +1360,23 @@ func handleDownloadCmd(ctx context.Context, peerAddr *string, args []string) {
 	log.Printf("✅ Download Complete! File saved as: %s (%d bytes)", outputFile, len(reconstructed))
 }
 
-func startFullNode(ctx context.Context, port *int, vaultPath *string, mode *string, peerAddr *string, apiPort *int, isMining bool) {
-	node, _, chain, myAddress, err := setupNode(ctx, port, vaultPath, peerAddr, mode, apiPort)
+func startFullNode(ctx context.Context, params *blockchain.NetworkParams, port *int, vaultPath *string, mode *string, peerAddr *string, apiPort *int, allowGenerate *bool, prune *int, isMining bool) {
+	node, vault, chain, myAddress, err := setupNode(ctx, params, port, vaultPath, peerAddr, mode, apiPort, allowGenerate, prune)
 	if err != nil {
 		log.Fatalf("Failed to start node: %v", err)
 	}
 
+	// Catch up with the network before mining on top of a stale tip
+	node.SyncChain(ctx)
+	node.StartSyncLoop(ctx)
+	node.StartChannelWatcher(ctx)
+	node.StartDealProver(ctx, vault)
+
 	// Mining Loop (if isMining is true)
 	if isMining {
 		log.Printf("Starting Miner... Address: %s", myAddress)
 		for {
-			cbTx := &blockchain.Transaction{
-				From: "SYSTEM", To: myAddress,
-				Amount: 50, Timestamp: time.Now().Unix(),
-				ID: fmt.Sprintf("COINBASE_%d", time.Now().UnixNano()),
-			}
-			block := chain.AddBlock([]*blockchain.Transaction{cbTx})
+			block := chain.AddBlock(myAddress)
 			if err := node.BroadcastBlock(block); err != nil {
 				log.Printf("[Miner] Failed broadcast: %v", err)
 			} else {
@@ -486,7 +1384,7 @@ func startFullNode(ctx context.Context, port *int, vaultPath *string, mode *stri
 					log.Printf("[Miner] Mined Block #%d (and 9 others...)", block.Index)
 				}
 			}
-			time.Sleep(5 * time.Second)
+			// No pause between blocks: the retargeted difficulty paces mining
 		}
 	} else {
 		// Server Mode - Block Forever
@@ -495,7 +1393,7 @@ func startFullNode(ctx context.Context, port *int, vaultPath *string, mode *stri
 }
 
 // setupNode handles the heavy lifting of initializing Crypto, Vault, and P2P
-func setupNode(ctx context.Context, port *int, vaultPath *string, peerAddr *string, mode *string, apiPort *int) (*p2p.Node, *storage.Vault, *blockchain.Blockchain, string, error) {
+func setupNode(ctx context.Context, params *blockchain.NetworkParams, port *int, vaultPath *string, peerAddr *string, mode *string, apiPort *int, allowGenerate *bool, prune *int) (*p2p.Node, *storage.Vault, *blockchain.Blockchain, string, error) {
 	// 1. Wallet
 	walletPath := fmt.Sprintf("./data/wallet_%d.dat", *port)
 	if *port == 0 {
@@ -511,12 +1409,19 @@ func setupNode(ctx context.Context, port *int, vaultPath *string, peerAddr *stri
 	log.Printf("[Crypto] Wallet Address: %s", w.Address())
 
 	// 2. Blockchain
-	nodeID := fmt.Sprintf("%d", *port)
-	if *port == 0 {
-		nodeID = "random"
+	if *prune != 0 && *prune < blockchain.MinPruneDepth {
+		return nil, nil, nil, "", fmt.Errorf("--prune must be 0 or at least %d", blockchain.MinPruneDepth)
+	}
+	chain := blockchain.InitBlockchain(params, chainNodeID(port))
+	log.Printf("[Blockchain] Initialized on %s. Tip Hash: %s", params.Name, chain.LastHash)
+	if *prune > 0 {
+		chain.PruneDepth = *prune
+		n, err := chain.Prune()
+		if err != nil {
+			return nil, nil, nil, "", fmt.Errorf("pruning failed: %v", err)
+		}
+		log.Printf("[Blockchain] Pruned mode: keeping the last %d block bodies (%d dropped)", *prune, n)
 	}
-	chain := blockchain.InitBlockchain(nodeID, w.Address())
-	log.Printf("[Blockchain] Initialized. Tip Hash: %s", chain.LastHash)
 
 	// 3. Vault
 	// Derive key path from vault path (e.g. ./data/vault -> ./data/vault.key)
@@ -537,17 +1442,23 @@ func setupNode(ctx context.Context, port *int, vaultPath *string, peerAddr *stri
 	log.Printf("[Storage] Secured Vault initialized at %s", *vaultPath)
 
 	// 4. P2P Node
-	node, err := p2p.NewNode(ctx, *port)
+	node, err := p2p.NewNode(ctx, *port, params)
 	if err != nil {
 		return nil, nil, nil, "", fmt.Errorf("p2p node init failed: %v", err)
 	}
 	node.Chain = chain
+	node.Address = w.Address()
+	node.Wallet = w
 	log.Printf("[P2P] Node Online! ID: %s", node.Host.ID())
 
 	// 5. Handlers
 	node.HandleStoreStream(vault)
 	node.HandleRetrieveStream(vault)
+	node.HandleDealStream(vault)
+	node.HandleProofStream(vault)
+	node.HandleSyncStream()
 	node.SetupBlockPropagation()
+	node.SetupTransactionPropagation()
 
 	// 6. Bootstrapping
 	var bootstrapPeers []string
@@ -573,11 +1484,17 @@ func setupNode(ctx context.Context, port *int, vaultPath *string, peerAddr *stri
 		// Note: We don't defer close here easily, caller must handle context cancellation
 		log.Println("[Compute] VM Ready")
 		node.HandleComputeStream(vm)
+		node.HandleChannelStream(vm)
 	}
 
 	// 8. API
 	if apiPort != nil && *apiPort > 0 {
-		api.StartAPIServer(node, vault, vm, *apiPort)
+		token, err := api.LoadOrCreateToken(api.TokenPath(*apiPort))
+		if err != nil {
+			return nil, nil, nil, "", err
+		}
+		log.Printf("[API] Admin token in %s", api.TokenPath(*apiPort))
+		api.StartAPIServer(node, vault, vm, w.Address(), *apiPort, *allowGenerate, token)
 	}
 
 	return node, vault, chain, w.Address(), nil
@@ -2,20 +2,26 @@ package p2p
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 
 	"decentralized-net/blockchain"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-const BlockTopic = "/blockchain/blocks/1.0.0"
-
-// SetupBlockPropagation subscribes to the block topic and listens for new blocks.
+// SetupBlockPropagation subscribes to the block topic and listens for new
+// blocks. Gossiped blocks pass validateBlock before they are delivered or
+// relayed.
 func (n *Node) SetupBlockPropagation() error {
+	if err := n.PubSub.RegisterTopicValidator(n.Params.BlockTopic(), n.validateBlock); err != nil {
+		return fmt.Errorf("failed to register validator: %w", err)
+	}
+
 	// Join the topic
-	topic, err := n.PubSub.Join(BlockTopic)
+	topic, err := n.PubSub.Join(n.Params.BlockTopic())
 	if err != nil {
 		return fmt.Errorf("failed to join topic: %w", err)
 	}
@@ -31,7 +37,7 @@ func (n *Node) SetupBlockPropagation() error {
 
 	n.BlockTopic = topic
 
-	log.Printf("[P2P] Listening for blocks on %s", BlockTopic)
+	log.Printf("[P2P] Listening for blocks on %s", n.Params.BlockTopic())
 	return nil
 }
 
@@ -41,10 +47,34 @@ func (n *Node) BroadcastBlock(b *blockchain.Block) error {
 		return fmt.Errorf("block topic not joined")
 	}
 
-	data := b.Serialize() // Using Gob serialization we made
+	data := b.Serialize() // Canonical binary encoding
 	return n.BlockTopic.Publish(n.Ctx, data)
 }
 
+// validateBlock runs the checks that need no chain state: the header's hash
+// and Proof of Work, and the Merkle root over the transactions. Blocks that
+// fail them are never relayed and penalize the sender; whether a block fits
+// our chain is left to ProcessBlock in listenForBlocks.
+func (n *Node) validateBlock(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if from == n.Host.ID() {
+		return pubsub.ValidationAccept
+	}
+
+	block, err := blockchain.DeserializeBlock(msg.Data)
+	if err != nil {
+		return pubsub.ValidationReject
+	}
+	if err := blockchain.CheckHeader(&block.BlockHeader, n.Params); err != nil {
+		log.Printf("[P2P] Rejected block header %s from %s: %v", block.Hash, from, err)
+		return pubsub.ValidationReject
+	}
+	if err := blockchain.CheckMerkleRoot(block); err != nil {
+		log.Printf("[P2P] Rejected block body from %s: %v", from, err)
+		return pubsub.ValidationReject
+	}
+	return pubsub.ValidationAccept
+}
+
 // listenForBlocks processes incoming block messages.
 func (n *Node) listenForBlocks(sub *pubsub.Subscription) {
 	for {
@@ -61,26 +91,30 @@ func (n *Node) listenForBlocks(sub *pubsub.Subscription) {
 			continue
 		}
 
-		// Deserialize
-		block := blockchain.DeserializeBlock(msg.Data)
+		// Deserialize (untrusted input: malformed data is dropped, not fatal)
+		block, err := blockchain.DeserializeBlock(msg.Data)
+		if err != nil {
+			log.Printf("[P2P] Dropped malformed block from %s: %v", msg.ReceivedFrom, err)
+			continue
+		}
 		log.Printf("[P2P] Received new block: %s from %s", block.Hash, msg.ReceivedFrom)
 
 		// Verification and Add to Chain
-		// Note: AddBlock typically does validation inside.
-		// But since we are using BadgerDB, AddBlock needs to check if it already exists/etc.
-		// For MVP, we trust AddBlock logic to reject duplicates or invalid PoW.
 		if n.Chain != nil {
-			// We might want to run this in a goroutine if AddBlock is slow,
-			// but sequential is safer for DB consistency for now.
-			n.Chain.AddBlock([]*blockchain.Transaction{})
-			// WAIT. AddBlock MINES a new block in my current implementation.
-			// I need a method to Insert *existing* block.
-
-			// Refactoring Alert: chain.AddBlock() currently MINES.
-			// I need `chain.ProcessBlock(b *Block)` which validates and inserts.
-
-			// I will implement ProcessBlock later. For now, let's log.
-			log.Printf("TODO: Insert Block %d into DB (Logic pending)", block.Index)
+			// Sequential processing keeps DB writes ordered.
+			if err := n.Chain.ProcessBlock(block); err != nil {
+				switch {
+				case errors.Is(err, blockchain.ErrBlockKnown):
+				case errors.Is(err, blockchain.ErrOrphanBlock):
+					// We are missing history; fetch it from the sender
+					log.Printf("[P2P] Orphan block #%d from %s. Syncing...", block.Index, msg.ReceivedFrom)
+					go n.SyncWithPeer(n.Ctx, msg.ReceivedFrom)
+				default:
+					log.Printf("[P2P] Rejected block #%d %s: %v", block.Index, block.Hash, err)
+				}
+				continue
+			}
+			log.Printf("[P2P] Accepted block #%d into chain", block.Index)
 		}
 	}
 }
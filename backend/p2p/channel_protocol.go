@@ -0,0 +1,218 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"decentralized-net/blockchain"
+)
+
+const (
+	// MinChannelDisputeWindow is the shortest dispute window a worker
+	// accepts, leaving time to answer a payer's close with our latest update.
+	MinChannelDisputeWindow = 6
+	// ChannelWatchInterval is how often we look for channels being closed
+	// by their payer.
+	ChannelWatchInterval = 10 * time.Second
+	// maxChannelFieldSize caps the channel ID and signature of an update.
+	maxChannelFieldSize = 256
+)
+
+// channelProtocol is the stream protocol ID, on our network, for compute
+// jobs paid by off-chain payment channel updates instead of one on-chain
+// payment per job.
+func (n *Node) channelProtocol() protocol.ID {
+	return protocol.ID(n.Params.ChannelProtocol())
+}
+
+// HandleChannelStream accepts compute jobs paid through a payment channel.
+// Protocol:
+// 0. Read ChannelID + Paid (8) + Signature: the payer's balance update
+// 1. Read WasmSize + WasmBytes
+// 2. Read InputSize + InputBytes
+// 3. Accept the update and execute VM
+// 4. Send OutputSize + OutputBytes
+//
+// Paid is cumulative, so each update must raise it by at least
+// MinJobPayment over the last one we accepted on that channel.
+func (n *Node) HandleChannelStream(vm VMInterface) {
+	n.Host.SetStreamHandler(n.channelProtocol(), func(s network.Stream) {
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(ComputeTimeout))
+		reader := bufio.NewReader(s)
+		writer := bufio.NewWriter(s)
+
+		log.Printf("[Channel] Receiving job from %s", s.Conn().RemotePeer())
+
+		// 0. Read the balance update
+		update, err := readChannelUpdate(reader)
+		if err != nil {
+			log.Printf("[Channel] Error reading update: %v", err)
+			return
+		}
+
+		// 1-2. Read Wasm and Input
+		wasmCode, inputData, err := readJob(reader)
+		if err != nil {
+			log.Printf("[Channel] Error reading job: %v", err)
+			return
+		}
+
+		// PAYMENT VERIFICATION
+		if n.Chain != nil {
+			increment, err := n.Chain.AcceptChannelPayment(update, n.Address, MinJobPayment, MinChannelDisputeWindow)
+			if err != nil {
+				log.Printf("[Channel] REJECTED: %v", err)
+				writeComputeResult(writer, []byte(fmt.Sprintf("ERROR: payment rejected: %v", err)))
+				return
+			}
+			log.Printf("[Channel] Payment Accepted! Channel: %s (+%d, %d total)", update.ChannelID, increment, update.Paid)
+		}
+
+		// 3-4. Execute and send the response
+		runJob(writer, vm, wasmCode, inputData)
+	})
+}
+
+// SendChannelComputeReq sends a job paid by a channel update and waits for
+// the result. The update must raise the channel's total by the job's price.
+func (n *Node) SendChannelComputeReq(ctx context.Context, p peer.ID, wasm []byte, input []byte, update *blockchain.ChannelUpdate) ([]byte, error) {
+	s, err := n.Host.NewStream(ctx, p, n.channelProtocol())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(ComputeTimeout))
+
+	writer := bufio.NewWriter(s)
+	reader := bufio.NewReader(s)
+
+	// 0. Write the balance update
+	if err := writeString(writer, update.ChannelID); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(writer, binary.BigEndian, uint64(update.Paid)); err != nil {
+		return nil, err
+	}
+	if err := writeString(writer, update.Signature); err != nil {
+		return nil, err
+	}
+
+	// 1-2. Write Wasm and Input
+	if err := writeJob(writer, wasm, input); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush request: %w", err)
+	}
+
+	// 3. Read Result
+	return readComputeResult(reader)
+}
+
+// readChannelUpdate reads ChannelID + Paid + Signature
+func readChannelUpdate(reader *bufio.Reader) (*blockchain.ChannelUpdate, error) {
+	channelID, err := readString(reader, maxChannelFieldSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading channel id: %w", err)
+	}
+	var paid uint64
+	if err := binary.Read(reader, binary.BigEndian, &paid); err != nil {
+		return nil, fmt.Errorf("reading paid amount: %w", err)
+	}
+	sig, err := readString(reader, maxChannelFieldSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading signature: %w", err)
+	}
+	return &blockchain.ChannelUpdate{ChannelID: channelID, Paid: int(paid), Signature: sig}, nil
+}
+
+// CloseChannel closes a channel that pays us with the latest update we
+// accepted, and gossips the close. The payout is immediate.
+func (n *Node) CloseChannel(channelID string) (*blockchain.Transaction, error) {
+	if n.Chain == nil {
+		return nil, fmt.Errorf("blockchain not initialized")
+	}
+	if n.Wallet == nil {
+		return nil, fmt.Errorf("no wallet to sign the close")
+	}
+	ch, err := n.Chain.GetChannel(channelID)
+	if err != nil {
+		return nil, err
+	}
+	if ch.To != n.Address {
+		return nil, fmt.Errorf("channel %s pays %s, not us", channelID, ch.To)
+	}
+	update, err := n.Chain.LatestChannelPayment(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := blockchain.ChannelClosePayload(update)
+	tx, err := n.Chain.CreateTypedTransaction(n.Address, n.Address, ch.Deposit, 0, blockchain.TxChannelClose, payload, n.Wallet)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.Chain.AddTransaction(tx); err != nil {
+		return nil, err
+	}
+	if err := n.BroadcastTransaction(tx); err != nil {
+		log.Printf("[Channel] Failed to broadcast close %s: %v", tx.ID, err)
+	}
+	log.Printf("[Channel] Closing channel %s for %d coins. Close Tx: %s", channelID, update.Paid, tx.ID)
+	return tx, nil
+}
+
+// StartChannelWatcher periodically checks the channels we were paid through
+// and answers a payer's unilateral close with our latest update before its
+// dispute window ends.
+func (n *Node) StartChannelWatcher(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(ChannelWatchInterval)
+		defer ticker.Stop()
+		submitted := make(map[string]string) // Channel ID -> our pending close
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n.watchChannels(submitted)
+			}
+		}
+	}()
+}
+
+func (n *Node) watchChannels(submitted map[string]string) {
+	if n.Chain == nil {
+		return
+	}
+	updates, err := n.Chain.ChannelPayments()
+	if err != nil {
+		log.Printf("[Channel] Failed to read channel payments: %v", err)
+		return
+	}
+	for _, update := range updates {
+		ch, err := n.Chain.GetChannel(update.ChannelID)
+		if err != nil || !ch.Closing() {
+			continue // Settled, or still open
+		}
+		if txID, ok := submitted[ch.ID]; ok && n.Chain.Mempool.Has(txID) {
+			continue
+		}
+		log.Printf("[Channel] Payer closed channel %s claiming %d; we hold %d", ch.ID, ch.Paid, update.Paid)
+		tx, err := n.CloseChannel(ch.ID)
+		if err != nil {
+			log.Printf("[Channel] Failed to close channel %s: %v", ch.ID, err)
+			continue
+		}
+		submitted[ch.ID] = tx.ID
+	}
+}
@@ -2,8 +2,11 @@ package p2p
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -12,13 +15,32 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"decentralized-net/blockchain"
 )
 
 const (
-	ComputeProtocol = protocol.ID("/decentralized-net/compute/1.0.0")
-	ComputeTimeout  = 30 * time.Second // Allow 30s for job execution
+	ComputeTimeout = 30 * time.Second // Allow 30s for job execution
+	MinJobPayment  = 5                // Coins a worker requires per job
+	// MinEscrowWindow is how many blocks an escrow must stay claimable for
+	// the worker to accept it, leaving time to get the claim mined.
+	MinEscrowWindow = 6
+	// maxPreimageSize caps the escrow preimage a worker reveals.
+	maxPreimageSize = 256
+	// maxTxIDSize caps the payment tx ID (a hex SHA-256).
+	maxTxIDSize = 64
+	// MaxJobWasmSize and MaxJobInputSize cap a job's module and input, and
+	// MaxJobOutputSize its result, checked before anything is allocated.
+	MaxJobWasmSize   = 4 << 20
+	MaxJobInputSize  = 1 << 20
+	MaxJobOutputSize = 4 << 20
 )
 
+// computeProtocol is the compute stream protocol ID of our network.
+func (n *Node) computeProtocol() protocol.ID {
+	return protocol.ID(n.Params.ComputeProtocol())
+}
+
 // VMInterface defines what the P2P layer needs from the Compute Engine
 type VMInterface interface {
 	Run(wasmCode []byte, input []byte) ([]byte, error)
@@ -26,12 +48,19 @@ type VMInterface interface {
 
 // HandleComputeStream accepts incoming compute jobs.
 // Protocol:
+// 0. Read TxIDSize + TxID (job payment or escrow lock)
 // 1. Read WasmSize + WasmBytes
 // 2. Read InputSize + InputBytes
-// 3. Execute VM
-// 4. Send OutputSize + OutputBytes
+// 3. Redeem the payment and execute VM
+// 4. Send OutputSize + OutputBytes (escrow: sealed under the preimage)
+// 5. Escrow only: claim the escrow, then send PreimageSize + Preimage
+//
+// The payment must be a confirmed TxJobPayment, or an open escrow, to this
+// node's Address for exactly this wasm and input; each is redeemed only once.
+// An empty TxID asks for a quote instead: nothing runs, and we send our
+// Address and the hash lock to escrow the job under (see sendQuote).
 func (n *Node) HandleComputeStream(vm VMInterface) {
-	n.Host.SetStreamHandler(ComputeProtocol, func(s network.Stream) {
+	n.Host.SetStreamHandler(n.computeProtocol(), func(s network.Stream) {
 		defer s.Close()
 		s.SetDeadline(time.Now().Add(ComputeTimeout))
 		reader := bufio.NewReader(s)
@@ -40,136 +69,333 @@ func (n *Node) HandleComputeStream(vm VMInterface) {
 		log.Printf("[Compute] Receiving job from %s", s.Conn().RemotePeer())
 
 		// 0. Read TxID (Payment)
-		var txIDLen uint32
-		if err := binary.Read(reader, binary.BigEndian, &txIDLen); err != nil {
-			log.Printf("[Compute] Error reading TxID length: %v", err)
+		txID, err := readString(reader, maxTxIDSize)
+		if err != nil {
+			log.Printf("[Compute] Error reading TxID: %v", err)
 			return
 		}
-		txIDBytes := make([]byte, txIDLen)
-		if _, err := io.ReadFull(reader, txIDBytes); err != nil {
-			log.Printf("[Compute] Error reading TxID: %v", err)
+
+		// 1-2. Read Wasm and Input
+		wasmCode, inputData, err := readJob(reader)
+		if err != nil {
+			log.Printf("[Compute] Error reading job: %v", err)
+			return
+		}
+		if txID == "" {
+			n.sendQuote(writer, blockchain.JobHash(wasmCode, inputData))
 			return
 		}
-		txID := string(txIDBytes)
 
-		// PAYMENT VERIFICATION
+		// PAYMENT VERIFICATION (needs the job to compute its hash)
+		var escrow *blockchain.Escrow
 		if n.Chain != nil {
-			// Bypass for testing
-			tx, err := n.Chain.FindTransaction(txID)
+			escrow, err = n.acceptPayment(txID, blockchain.JobHash(wasmCode, inputData))
 			if err != nil {
-				log.Printf("[Compute] REJECTED: Payment Tx %s not found. Error: %v", txID, err)
-				// We should send error back, but for now just return/close
-				return
-			}
-
-			// Check Amount
-			if tx.Amount < 5 {
-				log.Printf("[Compute] REJECTED: Insufficient payment. Got %d, need 5.", tx.Amount)
+				log.Printf("[Compute] REJECTED: %v", err)
+				writeComputeResult(writer, []byte(fmt.Sprintf("ERROR: payment rejected: %v", err)))
 				return
 			}
-			log.Printf("[Compute] Payment Verified! Tx: %s (%d coins)", txID, tx.Amount)
 		}
 
-		// 1. Read Wasm
-		var wasmLen uint32
-		if err := binary.Read(reader, binary.BigEndian, &wasmLen); err != nil {
-			log.Printf("[Compute] Error reading Wasm length: %v", err)
-			return
-		}
-		wasmCode := make([]byte, wasmLen)
-		if _, err := io.ReadFull(reader, wasmCode); err != nil {
-			log.Printf("[Compute] Error reading Wasm code: %v", err)
+		// 3-5. Execute and send the response
+		if escrow != nil {
+			n.runEscrowedJob(writer, vm, escrow, wasmCode, inputData)
 			return
 		}
+		runJob(writer, vm, wasmCode, inputData)
+	})
+}
 
-		// 2. Read Input
-		var inputLen uint32
-		if err := binary.Read(reader, binary.BigEndian, &inputLen); err != nil {
-			log.Printf("[Compute] Error reading Input length: %v", err)
-			return
+// sendQuote sends our Address and the hex hash lock of EscrowPreimage for
+// the job. A node without a wallet can't claim escrows and sends nothing.
+func (n *Node) sendQuote(writer *bufio.Writer, jobHash []byte) {
+	if n.Wallet == nil {
+		log.Printf("[Compute] Quote refused: no wallet to claim escrows")
+		return
+	}
+	hashLock := sha256.Sum256(blockchain.EscrowPreimage(n.Wallet, jobHash))
+	if err := writeString(writer, n.Address); err != nil {
+		return
+	}
+	if err := writeString(writer, hex.EncodeToString(hashLock[:])); err != nil {
+		return
+	}
+	if err := writer.Flush(); err != nil {
+		log.Printf("[Compute] Failed to send quote: %v", err)
+	}
+}
+
+// acceptPayment redeems the payment for a job: an open escrow under our hash
+// lock for it (returned, to be claimed after delivery) or a confirmed job
+// payment (returns nil).
+func (n *Node) acceptPayment(txID string, jobHash []byte) (*blockchain.Escrow, error) {
+	if escrow, err := n.Chain.GetEscrow(txID); err == nil {
+		// Check the lock before redeeming: we could never claim another one
+		if n.Wallet == nil {
+			return nil, fmt.Errorf("no wallet to claim escrow %s", txID)
 		}
-		inputData := make([]byte, inputLen)
-		if _, err := io.ReadFull(reader, inputData); err != nil {
-			log.Printf("[Compute] Error reading Input data: %v", err)
-			return
+		hashLock := sha256.Sum256(blockchain.EscrowPreimage(n.Wallet, jobHash))
+		if !bytes.Equal(escrow.HashLock, hashLock[:]) {
+			return nil, fmt.Errorf("escrow %s is not locked under our hash lock for this job", txID)
 		}
-
-		// 3. Execute
-		log.Printf("[Compute] Executing WASM (%d bytes)...", wasmLen)
-		output, err := vm.Run(wasmCode, inputData)
-
-		// 4. Send Response
+		escrow, err = n.Chain.AcceptEscrowForJob(txID, n.Address, jobHash, MinJobPayment, MinEscrowWindow)
 		if err != nil {
-			// In a real protocol, we'd send an Error flag.
-			// For MVP, we send empty output and log the error.
-			log.Printf("[Compute] Execution failed: %v", err)
-			output = []byte(fmt.Sprintf("ERROR: %v", err))
+			return nil, err
 		}
+		log.Printf("[Compute] Escrow Accepted! Lock: %s (%d coins)", txID, escrow.Amount)
+		return escrow, nil
+	}
 
-		// Write Output Length
-		if err := binary.Write(writer, binary.BigEndian, uint32(len(output))); err != nil {
-			log.Printf("[Compute] Failed to write result length: %v", err)
-			return
-		}
-		// Write Output
-		if _, err := writer.Write(output); err != nil {
-			log.Printf("[Compute] Failed to write result: %v", err)
-			return
-		}
-		writer.Flush()
-		log.Printf("[Compute] Job complete. Sent %d bytes result.", len(output))
-	})
+	tx, err := n.Chain.RedeemJobPayment(txID, n.Address, jobHash, MinJobPayment)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Compute] Payment Verified! Tx: %s (%d coins)", txID, tx.Amount)
+	return nil, nil
 }
 
-// SendComputeReq sends a job to a peer and waits for the result.
-func (n *Node) SendComputeReq(ctx context.Context, p peer.ID, wasm []byte, input []byte, txID string) ([]byte, error) {
-	s, err := n.Host.NewStream(ctx, p, ComputeProtocol)
+// runEscrowedJob executes a job paid through escrow and sends the result
+// sealed under the escrow preimage. Only once it is delivered do we claim,
+// which reveals the preimage on chain; we then send it to the client too.
+// A failed run is reported in the clear and not claimed, so the client gets
+// a refund at the timeout.
+func (n *Node) runEscrowedJob(writer *bufio.Writer, vm VMInterface, escrow *blockchain.Escrow, wasmCode, inputData []byte) {
+	preimage := blockchain.EscrowPreimage(n.Wallet, escrow.JobHash)
+	output, err := execute(vm, wasmCode, inputData)
+	if err == nil {
+		output, err = blockchain.SealResult(preimage, output)
+	}
+	if err == nil && len(output) > MaxJobOutputSize {
+		err = fmt.Errorf("sealed result too large (%d bytes)", len(output))
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to open stream: %w", err)
+		log.Printf("[Compute] Execution failed, escrow %s left to refund: %v", escrow.ID, err)
+		writeComputeResult(writer, []byte(fmt.Sprintf("ERROR: %v", err)))
+		return
+	}
+	if err := writeComputeResult(writer, output); err != nil {
+		log.Printf("[Compute] Failed to write result, escrow %s not claimed: %v", escrow.ID, err)
+		return
 	}
-	defer s.Close()
-	s.SetDeadline(time.Now().Add(ComputeTimeout))
 
-	writer := bufio.NewWriter(s)
-	reader := bufio.NewReader(s)
+	if err := n.claimEscrow(escrow, preimage); err != nil {
+		log.Printf("[Compute] Failed to claim escrow %s: %v", escrow.ID, err)
+		return
+	}
+	if err := writeString(writer, string(preimage)); err != nil {
+		return
+	}
+	if err := writer.Flush(); err != nil {
+		log.Printf("[Compute] Failed to send preimage for escrow %s: %v", escrow.ID, err)
+	}
+}
 
-	// 0. Write TxID
-	if err := binary.Write(writer, binary.BigEndian, uint32(len(txID))); err != nil {
-		return nil, err
+// claimEscrow submits and gossips the transaction that pays an escrow to us.
+func (n *Node) claimEscrow(escrow *blockchain.Escrow, preimage []byte) error {
+	payload := blockchain.HTLCClaimPayload(escrow.ID, preimage)
+	claim, err := n.Chain.CreateTypedTransaction(n.Address, n.Address, escrow.Amount, 0, blockchain.TxHTLCClaim, payload, n.Wallet)
+	if err != nil {
+		return err
 	}
-	if _, err := writer.Write([]byte(txID)); err != nil {
-		return nil, err
+	if err := n.Chain.AddTransaction(claim); err != nil {
+		return err
+	}
+	if err := n.BroadcastTransaction(claim); err != nil {
+		log.Printf("[Compute] Failed to broadcast claim %s: %v", claim.ID, err)
+	}
+	log.Printf("[Compute] Escrow %s claimed. Claim Tx: %s", escrow.ID, claim.ID)
+	return nil
+}
+
+// readJob reads WasmSize + WasmBytes and InputSize + InputBytes
+func readJob(reader *bufio.Reader) ([]byte, []byte, error) {
+	var wasmLen uint32
+	if err := binary.Read(reader, binary.BigEndian, &wasmLen); err != nil {
+		return nil, nil, fmt.Errorf("reading wasm length: %w", err)
+	}
+	if wasmLen > MaxJobWasmSize {
+		return nil, nil, fmt.Errorf("wasm code too large (%d bytes)", wasmLen)
+	}
+	wasmCode := make([]byte, wasmLen)
+	if _, err := io.ReadFull(reader, wasmCode); err != nil {
+		return nil, nil, fmt.Errorf("reading wasm code: %w", err)
 	}
 
-	// 1. Write Wasm
+	var inputLen uint32
+	if err := binary.Read(reader, binary.BigEndian, &inputLen); err != nil {
+		return nil, nil, fmt.Errorf("reading input length: %w", err)
+	}
+	if inputLen > MaxJobInputSize {
+		return nil, nil, fmt.Errorf("input too large (%d bytes)", inputLen)
+	}
+	inputData := make([]byte, inputLen)
+	if _, err := io.ReadFull(reader, inputData); err != nil {
+		return nil, nil, fmt.Errorf("reading input data: %w", err)
+	}
+	return wasmCode, inputData, nil
+}
+
+// writeJob sends WasmSize + WasmBytes and InputSize + InputBytes
+func writeJob(writer *bufio.Writer, wasm, input []byte) error {
 	if err := binary.Write(writer, binary.BigEndian, uint32(len(wasm))); err != nil {
-		return nil, err
+		return err
 	}
 	if _, err := writer.Write(wasm); err != nil {
-		return nil, err
+		return err
 	}
-
-	// 2. Write Input
 	if err := binary.Write(writer, binary.BigEndian, uint32(len(input))); err != nil {
-		return nil, err
+		return err
 	}
-	if _, err := writer.Write(input); err != nil {
+	_, err := writer.Write(input)
+	return err
+}
+
+// execute runs a job, capping the size of its output.
+func execute(vm VMInterface, wasmCode, inputData []byte) ([]byte, error) {
+	log.Printf("[Compute] Executing WASM (%d bytes)...", len(wasmCode))
+	output, err := vm.Run(wasmCode, inputData)
+	if err != nil {
 		return nil, err
 	}
+	if len(output) > MaxJobOutputSize {
+		return nil, fmt.Errorf("result too large (%d bytes)", len(output))
+	}
+	return output, nil
+}
 
-	if err := writer.Flush(); err != nil {
-		return nil, fmt.Errorf("failed to flush request: %w", err)
+// runJob executes a paid job and sends its output (or the error) back.
+func runJob(writer *bufio.Writer, vm VMInterface, wasmCode, inputData []byte) {
+	output, err := execute(vm, wasmCode, inputData)
+	if err != nil {
+		// In a real protocol, we'd send an Error flag.
+		// For MVP, we send the error as the output.
+		log.Printf("[Compute] Execution failed: %v", err)
+		output = []byte(fmt.Sprintf("ERROR: %v", err))
 	}
 
-	// 3. Read Result
+	if err := writeComputeResult(writer, output); err != nil {
+		log.Printf("[Compute] Failed to write result: %v", err)
+		return
+	}
+	log.Printf("[Compute] Job complete. Sent %d bytes result.", len(output))
+}
+
+// readComputeResult reads OutputSize + OutputBytes
+func readComputeResult(reader *bufio.Reader) ([]byte, error) {
 	var outLen uint32
 	if err := binary.Read(reader, binary.BigEndian, &outLen); err != nil {
 		return nil, fmt.Errorf("failed to read result length: %w", err)
 	}
+	if outLen > MaxJobOutputSize {
+		return nil, fmt.Errorf("result too large (%d bytes)", outLen)
+	}
 	output := make([]byte, outLen)
 	if _, err := io.ReadFull(reader, output); err != nil {
 		return nil, fmt.Errorf("failed to read result data: %w", err)
 	}
-
 	return output, nil
 }
+
+// writeComputeResult sends OutputSize + OutputBytes
+func writeComputeResult(writer *bufio.Writer, output []byte) error {
+	if err := binary.Write(writer, binary.BigEndian, uint32(len(output))); err != nil {
+		return err
+	}
+	if _, err := writer.Write(output); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// SendComputeReq sends a job to a peer and waits for the result.
+func (n *Node) SendComputeReq(ctx context.Context, p peer.ID, wasm []byte, input []byte, txID string) ([]byte, error) {
+	s, reader, err := n.openComputeStream(ctx, p, txID, wasm, input)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	// 3. Read Result
+	return readComputeResult(reader)
+}
+
+// RequestEscrowQuote asks a worker for its address and the hash lock to
+// escrow the payment for a job under (see pay --escrow).
+func (n *Node) RequestEscrowQuote(ctx context.Context, p peer.ID, wasm []byte, input []byte) (string, []byte, error) {
+	s, reader, err := n.openComputeStream(ctx, p, "", wasm, input)
+	if err != nil {
+		return "", nil, err
+	}
+	defer s.Close()
+
+	address, err := readString(reader, 2*sha256.Size)
+	if err != nil {
+		return "", nil, fmt.Errorf("worker sent no quote: %w", err)
+	}
+	lockHex, err := readString(reader, 2*sha256.Size)
+	if err != nil {
+		return "", nil, fmt.Errorf("worker sent no hash lock: %w", err)
+	}
+	hashLock, err := hex.DecodeString(lockHex)
+	if err != nil || len(hashLock) != sha256.Size {
+		return "", nil, fmt.Errorf("worker sent an invalid hash lock %q", lockHex)
+	}
+	return address, hashLock, nil
+}
+
+// SendEscrowedComputeReq sends a job paid through the escrow lockID, whose
+// hash lock the worker quoted. The result arrives sealed; the worker sends
+// the preimage that opens it after claiming the escrow, and the same
+// preimage is in its claim transaction.
+func (n *Node) SendEscrowedComputeReq(ctx context.Context, p peer.ID, wasm []byte, input []byte, lockID string, hashLock []byte) ([]byte, error) {
+	s, reader, err := n.openComputeStream(ctx, p, lockID, wasm, input)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	// 3. Read the sealed result, then the preimage once the worker claimed
+	sealed, err := readComputeResult(reader)
+	if err != nil {
+		return nil, err
+	}
+	preimage, err := readString(reader, maxPreimageSize)
+	if err != nil {
+		// A failed run or rejected payment comes back in the clear, unclaimed
+		return nil, fmt.Errorf("worker did not claim escrow %s (%v): %.200q", lockID, err, sealed)
+	}
+	if sum := sha256.Sum256([]byte(preimage)); !bytes.Equal(sum[:], hashLock) {
+		return nil, fmt.Errorf("worker sent a preimage that does not match escrow %s", lockID)
+	}
+	return blockchain.OpenResult([]byte(preimage), sealed)
+}
+
+// openComputeStream opens a compute stream and sends the request: the
+// payment's TxID and the job.
+func (n *Node) openComputeStream(ctx context.Context, p peer.ID, txID string, wasm []byte, input []byte) (network.Stream, *bufio.Reader, error) {
+	s, err := n.Host.NewStream(ctx, p, n.computeProtocol())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	s.SetDeadline(time.Now().Add(ComputeTimeout))
+
+	writer := bufio.NewWriter(s)
+
+	// 0. Write TxID
+	if err := writeString(writer, txID); err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	// 1-2. Write Wasm and Input
+	if err := writeJob(writer, wasm, input); err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	if err := writer.Flush(); err != nil {
+		s.Close()
+		return nil, nil, fmt.Errorf("failed to flush request: %w", err)
+	}
+	return s, bufio.NewReader(s), nil
+}
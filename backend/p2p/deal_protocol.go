@@ -0,0 +1,337 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"decentralized-net/blockchain"
+	"decentralized-net/storage"
+	"decentralized-net/wallet"
+)
+
+const (
+	// MinDealPricePerBlock is the least a provider accepts per shard and block.
+	MinDealPricePerBlock = 1
+	// MaxDealShardSize caps a shard stored under a deal.
+	MaxDealShardSize = 64 << 20
+	// DealProveInterval is how often providers answer their deals' storage
+	// challenges and claim what the proofs released. It must be well under a
+	// DealProofPeriod worth of block time.
+	DealProveInterval = 10 * time.Second
+	// MinDealClaim is the least a provider claims at once before a deal is
+	// fully proven, so small deals aren't drained in fee-sized steps.
+	MinDealClaim = 10
+	// maxDealFieldSize caps the key, address and error strings of the protocol.
+	maxDealFieldSize = 1024
+)
+
+// dealProtocol is the stream protocol ID, on our network, for storing a
+// shard under a storage deal: the provider keeps it and signs the terms,
+// which the client then records on chain.
+func (n *Node) dealProtocol() protocol.ID {
+	return protocol.ID(n.Params.DealProtocol())
+}
+
+// HandleDealStream accepts shards offered under a storage deal.
+// Protocol Format:
+// [ShardKey] [Client] [Duration (8)] [Price (8)] [DataLength (4 bytes)] [Data Bytes]
+// Response:
+// [Status (1 byte)] then [PublicKey] [Signature] on success (0),
+// or [Error] on rejection (1)
+//
+// The signature accepts the DealProposal for the ShardRoot and size of Data.
+func (n *Node) HandleDealStream(v storage.VaultInterface) {
+	n.Host.SetStreamHandler(n.dealProtocol(), func(s network.Stream) {
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(StreamTimeout))
+
+		reader := bufio.NewReader(s)
+		writer := bufio.NewWriter(s)
+
+		proposal, data, err := readDealRequest(reader)
+		if err != nil {
+			log.Printf("[Deal] Protocol Error: %v", err)
+			return
+		}
+		log.Printf("[Deal] Offered shard %s (%d bytes, %d blocks, %d coins) by %s", proposal.ShardKey, proposal.Size, proposal.Duration, proposal.Price, proposal.Client)
+
+		providerKey, sig, err := n.acceptDeal(v, proposal, data)
+		if err != nil {
+			log.Printf("[Deal] REJECTED: %v", err)
+			writer.WriteByte(1)
+			writeString(writer, err.Error())
+			writer.Flush()
+			return
+		}
+
+		writer.WriteByte(0)
+		writeString(writer, providerKey)
+		writeString(writer, sig)
+		if err := writer.Flush(); err != nil {
+			log.Printf("[Deal] Failed to send acceptance: %v", err)
+		}
+	})
+}
+
+// readDealRequest reads the deal terms and shard, filling in the shard's
+// root and size.
+func readDealRequest(reader *bufio.Reader) (*blockchain.DealProposal, []byte, error) {
+	key, err := readString(reader, maxDealFieldSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading shard key: %w", err)
+	}
+	client, err := readString(reader, maxDealFieldSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading client: %w", err)
+	}
+	var duration, price uint64
+	if err := binary.Read(reader, binary.BigEndian, &duration); err != nil {
+		return nil, nil, fmt.Errorf("reading duration: %w", err)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &price); err != nil {
+		return nil, nil, fmt.Errorf("reading price: %w", err)
+	}
+	var dataLen uint32
+	if err := binary.Read(reader, binary.BigEndian, &dataLen); err != nil {
+		return nil, nil, fmt.Errorf("reading data length: %w", err)
+	}
+	if dataLen > MaxDealShardSize {
+		return nil, nil, fmt.Errorf("shard too large (%d bytes)", dataLen)
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, nil, fmt.Errorf("reading data: %w", err)
+	}
+
+	proposal := &blockchain.DealProposal{
+		Client:    client,
+		ShardKey:  key,
+		ShardRoot: blockchain.ShardRoot(data),
+		Size:      len(data),
+		Duration:  int(min(duration, blockchain.MaxDealDuration+1)),
+		Price:     int(min(price, 1<<62)),
+	}
+	return proposal, data, nil
+}
+
+// acceptDeal checks our terms, stores the shard and signs the proposal.
+func (n *Node) acceptDeal(v storage.VaultInterface, proposal *blockchain.DealProposal, data []byte) (string, string, error) {
+	if v == nil || n.Wallet == nil {
+		return "", "", fmt.Errorf("this node does not take storage deals")
+	}
+	if proposal.ShardKey == "" || proposal.Size == 0 {
+		return "", "", fmt.Errorf("empty shard")
+	}
+	if proposal.Duration < 1 || proposal.Duration > blockchain.MaxDealDuration {
+		return "", "", fmt.Errorf("duration must be 1 to %d blocks", blockchain.MaxDealDuration)
+	}
+	if minPrice := proposal.Duration * MinDealPricePerBlock; proposal.Price < minPrice {
+		return "", "", fmt.Errorf("price %d is below %d for %d blocks", proposal.Price, minPrice, proposal.Duration)
+	}
+	proposal.Provider = n.Address
+
+	key := []byte(proposal.ShardKey)
+	if err := v.Store(key, data); err != nil {
+		return "", "", fmt.Errorf("storage failed: %w", err)
+	}
+	log.Printf("[Storage] Saved shard under deal: %s", proposal.ShardKey)
+	if n.DHT != nil {
+		go func() {
+			if err := n.DHT.Announce(proposal.ShardKey); err != nil {
+				log.Printf("[DHT] Failed to announce %s: %v", proposal.ShardKey, err)
+			}
+		}()
+	}
+
+	providerKey, err := n.Wallet.PublicKeyHex()
+	if err != nil {
+		return "", "", err
+	}
+	sig, err := n.Wallet.Sign(proposal.Hash())
+	if err != nil {
+		return "", "", err
+	}
+	return providerKey, sig, nil
+}
+
+// SendDealReq offers a shard to a peer under a storage deal for client and
+// returns the accepted proposal with the provider's key and signature, ready
+// for blockchain.StorageDealPayload.
+func (n *Node) SendDealReq(ctx context.Context, p peer.ID, client string, key []byte, data []byte, duration, price int) (*blockchain.DealProposal, string, string, error) {
+	s, err := n.Host.NewStream(ctx, p, n.dealProtocol())
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+
+	writer := bufio.NewWriter(s)
+	reader := bufio.NewReader(s)
+
+	// bufio keeps the first write error for Flush
+	writeString(writer, string(key))
+	writeString(writer, client)
+	binary.Write(writer, binary.BigEndian, uint64(duration))
+	binary.Write(writer, binary.BigEndian, uint64(price))
+	binary.Write(writer, binary.BigEndian, uint32(len(data)))
+	writer.Write(data)
+	if err := writer.Flush(); err != nil {
+		return nil, "", "", fmt.Errorf("failed to flush stream: %w", err)
+	}
+
+	status, err := reader.ReadByte()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if status != 0 {
+		reason, _ := readString(reader, maxDealFieldSize)
+		return nil, "", "", fmt.Errorf("peer rejected the deal: %s", reason)
+	}
+	providerKey, err := readString(reader, maxDealFieldSize)
+	if err != nil {
+		return nil, "", "", err
+	}
+	sig, err := readString(reader, maxDealFieldSize)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// Check the acceptance before paying for it
+	pub, err := wallet.DecodePublicKey(providerKey)
+	if err != nil {
+		return nil, "", "", err
+	}
+	proposal := &blockchain.DealProposal{
+		Client:    client,
+		Provider:  wallet.PublicKeyToAddress(pub),
+		ShardKey:  string(key),
+		ShardRoot: blockchain.ShardRoot(data),
+		Size:      len(data),
+		Duration:  duration,
+		Price:     price,
+	}
+	if !wallet.VerifySignature(pub, proposal.Hash(), sig) {
+		return nil, "", "", fmt.Errorf("provider signed different terms")
+	}
+	return proposal, providerKey, sig, nil
+}
+
+// StartDealProver periodically answers the storage challenges of the deals
+// we provide from the shards in v, and claims what the proofs released.
+func (n *Node) StartDealProver(ctx context.Context, v storage.VaultInterface) {
+	go func() {
+		ticker := time.NewTicker(DealProveInterval)
+		defer ticker.Stop()
+		pending := make(map[string]string) // Deal ID (claims) or deal ID/period (proofs) -> our pending tx
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n.proveDeals(v, pending)
+			}
+		}
+	}()
+}
+
+func (n *Node) proveDeals(v storage.VaultInterface, pending map[string]string) {
+	if n.Chain == nil || n.Wallet == nil || v == nil {
+		return
+	}
+	deals, err := n.Chain.GetDeals(n.Address)
+	if err != nil {
+		log.Printf("[Deal] Failed to read deals: %v", err)
+		return
+	}
+	height, _, err := n.Chain.GetTip()
+	if err != nil {
+		return
+	}
+	for key, txID := range pending {
+		if !n.Chain.Mempool.Has(txID) {
+			delete(pending, key) // Mined, or dropped
+		}
+	}
+	for _, deal := range deals {
+		if deal.Provider != n.Address {
+			continue
+		}
+
+		// Answer the challenge the next block falls in
+		period := deal.PeriodAt(height + 1)
+		proofKey := fmt.Sprintf("%s/%d", deal.ID, period)
+		if _, ok := pending[proofKey]; !ok && period >= deal.Settled() && period < deal.Periods() {
+			if txID, err := n.proveDeal(v, deal, period); err != nil {
+				log.Printf("[Deal] Failed to prove deal %s: %v", deal.ID, err)
+			} else {
+				pending[proofKey] = txID
+			}
+		}
+
+		if _, ok := pending[deal.ID]; ok {
+			continue
+		}
+		amount := deal.Claimable()
+		if amount <= 0 || (amount < MinDealClaim && deal.Settled() < deal.Periods()) {
+			continue
+		}
+		payload := blockchain.DealClaimPayload(deal.ID)
+		tx, err := n.submitDealTx(amount, blockchain.TxDealClaim, payload)
+		if err != nil {
+			log.Printf("[Deal] Claim for %s failed: %v", deal.ID, err)
+			continue
+		}
+		pending[deal.ID] = tx.ID
+		log.Printf("[Deal] Claimed %d coins from deal %s. Claim Tx: %s", amount, deal.ID, tx.ID)
+	}
+}
+
+// proveDeal submits the storage proof for a deal's period and returns its
+// transaction ID.
+func (n *Node) proveDeal(v storage.VaultInterface, deal *blockchain.StorageDeal, period int) (string, error) {
+	data, err := v.Get([]byte(deal.ShardKey))
+	if err != nil {
+		return "", fmt.Errorf("shard %s unavailable: %w", deal.ShardKey, err)
+	}
+	seed, err := n.Chain.GetBlockHashByHeight(deal.ChallengeHeight(period))
+	if err != nil {
+		return "", err
+	}
+	index := blockchain.ChallengeIndex(seed, deal.ID, period, blockchain.ShardChunkCount(deal.Size))
+	proof, err := blockchain.NewStorageProof(data, index)
+	if err != nil {
+		return "", err
+	}
+
+	payload := blockchain.StorageProofPayload(deal.ID, period, proof)
+	tx, err := n.submitDealTx(deal.Price, blockchain.TxStorageProof, payload)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("[Deal] Proved chunk %d of %s for deal %s period %d. Proof Tx: %s", index, deal.ShardKey, deal.ID, period, tx.ID)
+	return tx.ID, nil
+}
+
+// submitDealTx signs, queues and gossips a deal transaction to ourselves.
+func (n *Node) submitDealTx(amount int, txType blockchain.TxType, payload []byte) (*blockchain.Transaction, error) {
+	tx, err := n.Chain.CreateTypedTransaction(n.Address, n.Address, amount, 0, txType, payload, n.Wallet)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.Chain.AddTransaction(tx); err != nil {
+		return nil, err
+	}
+	if err := n.BroadcastTransaction(tx); err != nil {
+		log.Printf("[Deal] Failed to broadcast %s %s: %v", txType, tx.ID, err)
+	}
+	return tx, nil
+}
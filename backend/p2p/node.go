@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync/atomic"
 
 	"github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
@@ -16,6 +17,7 @@ import (
 	"github.com/multiformats/go-multiaddr"
 
 	"decentralized-net/blockchain"
+	"decentralized-net/wallet"
 )
 
 // Node represents a P2P node in the network.
@@ -24,13 +26,20 @@ type Node struct {
 	DHT        *DHTWrapper
 	Ctx        context.Context
 	Chain      *blockchain.Blockchain
+	Params     *blockchain.NetworkParams // Network whose topics and protocols we speak
+	Address    string                    // Wallet address that job payments must be sent to
+	Wallet     *wallet.Wallet            // Signs escrow claims for jobs we run
 	PubSub     *pubsub.PubSub
 	BlockTopic *pubsub.Topic
+	TxTopic    *pubsub.Topic
+
+	syncing atomic.Bool // Set while SyncWithPeer is running
 }
 
 // NewNode creates a new libp2p Host with a generated identity.
 // listenPort: 0 for random port, or specific port (e.g., 3000).
-func NewNode(ctx context.Context, listenPort int) (*Node, error) {
+// params selects the network (topic names and chain protocols).
+func NewNode(ctx context.Context, listenPort int, params *blockchain.NetworkParams) (*Node, error) {
 	// 1. Generate an Ed25519 key pair for the node's identity.
 	// In a real app, you'd save this private key to disk (Vault) to persist identity.
 	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
@@ -75,6 +84,7 @@ func NewNode(ctx context.Context, listenPort int) (*Node, error) {
 	n := &Node{
 		Host:   h,
 		Ctx:    ctx,
+		Params: params,
 		PubSub: ps,
 	}
 
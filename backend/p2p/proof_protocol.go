@@ -0,0 +1,196 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"decentralized-net/blockchain"
+	"decentralized-net/storage"
+)
+
+const (
+	// MaxAuditSamples caps the chunks asked for in one audit.
+	MaxAuditSamples = 16
+	// maxProofSiblings bounds the Merkle path of an audited chunk.
+	maxProofSiblings = 32
+)
+
+// proofProtocol is the stream protocol ID, on our network, for auditing a
+// stored shard off-chain: the provider opens the requested chunks against
+// the shard's Merkle root.
+func (n *Node) proofProtocol() protocol.ID {
+	return protocol.ID(n.Params.ProofProtocol())
+}
+
+// HandleProofStream answers storage audits for the shards in v.
+// Protocol Format:
+// [ShardKey] [Count (4 bytes)] then [Index (8)] per chunk
+// Response:
+// [Status (1 byte)] then per chunk [Chunk] [SiblingCount (4)] [Sibling]...
+// on success (0), or [Error] on failure (1)
+func (n *Node) HandleProofStream(v storage.VaultInterface) {
+	n.Host.SetStreamHandler(n.proofProtocol(), func(s network.Stream) {
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(StreamTimeout))
+
+		reader := bufio.NewReader(s)
+		writer := bufio.NewWriter(s)
+
+		key, indices, err := readAuditRequest(reader)
+		if err != nil {
+			log.Printf("[Proof] Protocol Error: %v", err)
+			return
+		}
+		log.Printf("[Proof] Audit of %s (%d chunks) by %s", key, len(indices), s.Conn().RemotePeer())
+
+		proofs, err := openChunks(v, key, indices)
+		if err != nil {
+			log.Printf("[Proof] Audit of %s failed: %v", key, err)
+			writer.WriteByte(1)
+			writeString(writer, err.Error())
+			writer.Flush()
+			return
+		}
+
+		// bufio keeps the first write error for Flush
+		writer.WriteByte(0)
+		for _, proof := range proofs {
+			writeString(writer, string(proof.Chunk))
+			binary.Write(writer, binary.BigEndian, uint32(len(proof.Siblings)))
+			for _, sibling := range proof.Siblings {
+				writeString(writer, string(sibling))
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			log.Printf("[Proof] Failed to send audit response: %v", err)
+		}
+	})
+}
+
+// readAuditRequest reads the shard key and the chunk indices to open.
+func readAuditRequest(reader *bufio.Reader) (string, []int, error) {
+	key, err := readString(reader, maxDealFieldSize)
+	if err != nil {
+		return "", nil, fmt.Errorf("reading shard key: %w", err)
+	}
+	var count uint32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return "", nil, fmt.Errorf("reading chunk count: %w", err)
+	}
+	if count > MaxAuditSamples {
+		return "", nil, fmt.Errorf("too many chunks requested (%d)", count)
+	}
+	indices := make([]int, count)
+	for i := range indices {
+		var index uint64
+		if err := binary.Read(reader, binary.BigEndian, &index); err != nil {
+			return "", nil, fmt.Errorf("reading chunk index: %w", err)
+		}
+		indices[i] = int(min(index, 1<<62))
+	}
+	return key, indices, nil
+}
+
+// openChunks builds the storage proofs for chunks of a shard we hold.
+func openChunks(v storage.VaultInterface, key string, indices []int) ([]*blockchain.StorageProof, error) {
+	if v == nil {
+		return nil, fmt.Errorf("this node does not store shards")
+	}
+	data, err := v.Get([]byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("shard not found")
+	}
+	proofs := make([]*blockchain.StorageProof, 0, len(indices))
+	for _, index := range indices {
+		proof, err := blockchain.NewStorageProof(data, index)
+		if err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, proof)
+	}
+	return proofs, nil
+}
+
+// AuditDeal asks a deal's provider for samples random chunks of its shard
+// and checks each against the ShardRoot the deal committed to. It returns
+// nil only if every chunk was proven.
+func (n *Node) AuditDeal(ctx context.Context, p peer.ID, deal *blockchain.StorageDeal, samples int) error {
+	samples = min(max(samples, 1), MaxAuditSamples)
+	chunks := blockchain.ShardChunkCount(deal.Size)
+	indices := make([]int, samples)
+	for i := range indices {
+		indices[i] = rand.Intn(chunks)
+	}
+
+	s, err := n.Host.NewStream(ctx, p, n.proofProtocol())
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+
+	writer := bufio.NewWriter(s)
+	reader := bufio.NewReader(s)
+
+	writeString(writer, deal.ShardKey)
+	binary.Write(writer, binary.BigEndian, uint32(len(indices)))
+	for _, index := range indices {
+		binary.Write(writer, binary.BigEndian, uint64(index))
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush stream: %w", err)
+	}
+
+	status, err := reader.ReadByte()
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if status != 0 {
+		reason, _ := readString(reader, maxDealFieldSize)
+		return fmt.Errorf("provider failed the audit: %s", reason)
+	}
+	for _, index := range indices {
+		proof, err := readStorageProof(reader, index)
+		if err != nil {
+			return err
+		}
+		if !proof.Verify(deal.ShardRoot, deal.Size) {
+			return fmt.Errorf("chunk %d does not match the shard root", index)
+		}
+	}
+	return nil
+}
+
+// readStorageProof reads [Chunk] [SiblingCount] [Sibling]... for a chunk.
+func readStorageProof(reader *bufio.Reader, index int) (*blockchain.StorageProof, error) {
+	chunk, err := readString(reader, blockchain.ShardChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading chunk %d: %w", index, err)
+	}
+	var count uint32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("reading sibling count: %w", err)
+	}
+	if count > maxProofSiblings {
+		return nil, fmt.Errorf("merkle path too long (%d)", count)
+	}
+	proof := &blockchain.StorageProof{Index: index, Chunk: []byte(chunk)}
+	for i := uint32(0); i < count; i++ {
+		sibling, err := readString(reader, sha256.Size)
+		if err != nil {
+			return nil, fmt.Errorf("reading sibling: %w", err)
+		}
+		proof.Siblings = append(proof.Siblings, []byte(sibling))
+	}
+	return proof, nil
+}
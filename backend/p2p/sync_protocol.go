@@ -0,0 +1,455 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"time"
+
+	"decentralized-net/blockchain"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// MaxHeadersPerRequest caps how many headers a peer may ask for at once.
+	MaxHeadersPerRequest = 500
+	// MaxSyncHeaderSize caps the size of a single block header on the wire.
+	MaxSyncHeaderSize = 1 << 10
+	// MaxSyncBlockSize caps the size of a single block body on the wire.
+	MaxSyncBlockSize = blockchain.MaxBlockSize
+	// SyncInterval is how often the background loop polls peers for new tips.
+	SyncInterval = 30 * time.Second
+	// maxWorkSize caps the cumulative work field of a tip (a 256-bit value
+	// summed over many blocks still fits easily).
+	maxWorkSize = 64
+)
+
+// Sync request types (first byte of every request)
+const (
+	syncMsgTip     byte = 0x01
+	syncMsgHeaders byte = 0x02
+	syncMsgBlock   byte = 0x03
+)
+
+// HandleSyncStream serves chain history to peers.
+// Protocol (one request per stream):
+// Tip:     [0x01]                       -> [Height (4 bytes)] [HashLen] [Hash] [WorkLen] [Work] [Pruned (4)]
+// Headers: [0x02] [Start (4)] [Count (4)] -> [N (4 bytes)] N x ([HeaderLen] [BlockHeader])
+// Block:   [0x03] [HashLen] [Hash]        -> [Status (1 byte)] [DataLen] [Data]
+func (n *Node) HandleSyncStream() {
+	n.Host.SetStreamHandler(n.syncProtocol(), func(s network.Stream) {
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(StreamTimeout))
+
+		reader := bufio.NewReader(s)
+		writer := bufio.NewWriter(s)
+		defer writer.Flush()
+
+		if n.Chain == nil {
+			s.Reset()
+			return
+		}
+
+		msgType, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+
+		switch msgType {
+		case syncMsgTip:
+			height, hash, err := n.Chain.GetTip()
+			if err != nil {
+				log.Printf("[Sync] Failed to read tip: %v", err)
+				s.Reset()
+				return
+			}
+			work, err := n.Chain.GetWork(hash)
+			if err != nil {
+				log.Printf("[Sync] Failed to read tip work: %v", err)
+				s.Reset()
+				return
+			}
+			pruned, err := n.Chain.PrunedHeight()
+			if err != nil {
+				log.Printf("[Sync] Failed to read pruned height: %v", err)
+				s.Reset()
+				return
+			}
+			binary.Write(writer, binary.BigEndian, uint32(height))
+			writeString(writer, hash)
+			writeString(writer, string(work.Bytes()))
+			binary.Write(writer, binary.BigEndian, uint32(pruned))
+
+		case syncMsgHeaders:
+			var start, count uint32
+			if err := binary.Read(reader, binary.BigEndian, &start); err != nil {
+				return
+			}
+			if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+				return
+			}
+			if count > MaxHeadersPerRequest {
+				count = MaxHeadersPerRequest
+			}
+
+			var headers [][]byte
+			for h := int(start); h < int(start)+int(count); h++ {
+				hash, err := n.Chain.GetBlockHashByHeight(h)
+				if err != nil {
+					break // Past our tip
+				}
+				header, err := n.Chain.GetHeader(hash)
+				if err != nil {
+					break
+				}
+				headers = append(headers, header.Serialize())
+			}
+
+			binary.Write(writer, binary.BigEndian, uint32(len(headers)))
+			for _, data := range headers {
+				binary.Write(writer, binary.BigEndian, uint32(len(data)))
+				writer.Write(data)
+			}
+
+		case syncMsgBlock:
+			hash, err := readString(reader, 256)
+			if err != nil {
+				return
+			}
+			block, err := n.Chain.GetBlock(hash)
+			if err != nil {
+				writer.WriteByte(1) // Not Found
+				return
+			}
+			data := block.Serialize()
+			writer.WriteByte(0)
+			binary.Write(writer, binary.BigEndian, uint32(len(data)))
+			writer.Write(data)
+
+		default:
+			log.Printf("[Sync] Unknown request type %d from %s", msgType, s.Conn().RemotePeer())
+		}
+	})
+}
+
+// PeerTip is the tip a peer advertises. Work is the cumulative Proof of Work
+// of its chain, which (not Height) decides whether it is worth fetching.
+// Pruned is the oldest main-chain block whose body the peer still serves.
+type PeerTip struct {
+	Height int
+	Hash   string
+	Work   *big.Int
+	Pruned int
+}
+
+// RequestTip asks a peer for its chain tip.
+func (n *Node) RequestTip(ctx context.Context, p peer.ID) (*PeerTip, error) {
+	s, err := n.openSyncStream(ctx, p, []byte{syncMsgTip})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	reader := bufio.NewReader(s)
+
+	var height uint32
+	if err := binary.Read(reader, binary.BigEndian, &height); err != nil {
+		return nil, fmt.Errorf("failed to read tip height: %w", err)
+	}
+	hash, err := readString(reader, 256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tip hash: %w", err)
+	}
+	work, err := readString(reader, maxWorkSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tip work: %w", err)
+	}
+	var pruned uint32
+	if err := binary.Read(reader, binary.BigEndian, &pruned); err != nil {
+		return nil, fmt.Errorf("failed to read pruned height: %w", err)
+	}
+	return &PeerTip{Height: int(height), Hash: hash, Work: new(big.Int).SetBytes([]byte(work)), Pruned: int(pruned)}, nil
+}
+
+// RequestHeaders asks a peer for up to count main-chain headers from start.
+// Each header's hash and Proof of Work are checked, and the headers must form
+// a chain, so bodies are only downloaded for a plausible branch.
+func (n *Node) RequestHeaders(ctx context.Context, p peer.ID, start, count int) ([]*blockchain.BlockHeader, error) {
+	req := []byte{syncMsgHeaders}
+	req = binary.BigEndian.AppendUint32(req, uint32(start))
+	req = binary.BigEndian.AppendUint32(req, uint32(count))
+
+	s, err := n.openSyncStream(ctx, p, req)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	reader := bufio.NewReader(s)
+
+	var num uint32
+	if err := binary.Read(reader, binary.BigEndian, &num); err != nil {
+		return nil, fmt.Errorf("failed to read header count: %w", err)
+	}
+	if num > MaxHeadersPerRequest {
+		return nil, fmt.Errorf("peer sent too many headers (%d)", num)
+	}
+
+	headers := make([]*blockchain.BlockHeader, 0, num)
+	for i := uint32(0); i < num; i++ {
+		var dataLen uint32
+		if err := binary.Read(reader, binary.BigEndian, &dataLen); err != nil {
+			return nil, err
+		}
+		if dataLen > MaxSyncHeaderSize {
+			return nil, fmt.Errorf("header too large (%d bytes)", dataLen)
+		}
+		data := make([]byte, dataLen)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+
+		hdr, err := blockchain.DeserializeHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := blockchain.CheckHeader(hdr, n.Params); err != nil {
+			return nil, fmt.Errorf("peer sent invalid header: %w", err)
+		}
+		if len(headers) > 0 {
+			prev := headers[len(headers)-1]
+			if hdr.PrevHash != prev.Hash || hdr.Index != prev.Index+1 {
+				return nil, fmt.Errorf("peer sent disconnected header #%d", hdr.Index)
+			}
+		}
+		headers = append(headers, hdr)
+	}
+	return headers, nil
+}
+
+// RequestBlock fetches a full block body by hash.
+func (n *Node) RequestBlock(ctx context.Context, p peer.ID, hash string) (*blockchain.Block, error) {
+	req := []byte{syncMsgBlock}
+	req = binary.BigEndian.AppendUint32(req, uint32(len(hash)))
+	req = append(req, hash...)
+
+	s, err := n.openSyncStream(ctx, p, req)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	reader := bufio.NewReader(s)
+
+	status, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("peer does not have block %s", hash)
+	}
+
+	var dataLen uint32
+	if err := binary.Read(reader, binary.BigEndian, &dataLen); err != nil {
+		return nil, err
+	}
+	if dataLen > MaxSyncBlockSize {
+		return nil, fmt.Errorf("block %s too large (%d bytes)", hash, dataLen)
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	block, err := blockchain.DeserializeBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("peer sent malformed block %s: %w", hash, err)
+	}
+	if block.Hash != hash {
+		return nil, fmt.Errorf("peer sent block %s, asked for %s", block.Hash, hash)
+	}
+	return block, nil
+}
+
+// SyncChain catches up with every connected peer that is ahead of us.
+// Run it before mining so new nodes start from the network's history.
+func (n *Node) SyncChain(ctx context.Context) {
+	for _, p := range n.Host.Network().Peers() {
+		if err := n.SyncWithPeer(ctx, p); err != nil {
+			log.Printf("[Sync] Sync with %s failed: %v", p, err)
+		}
+	}
+}
+
+// StartSyncLoop periodically re-syncs with peers in the background, which
+// also recovers from missed gossip and orphan blocks.
+func (n *Node) StartSyncLoop(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n.SyncChain(ctx)
+			}
+		}
+	}()
+}
+
+// SyncWithPeer downloads the blocks of a peer whose chain has more work than
+// ours, even if it is shorter. Headers are fetched first; if the first
+// header's parent is unknown we are on a fork, so we step back (doubling
+// each time) until we find a common block.
+func (n *Node) SyncWithPeer(ctx context.Context, p peer.ID) error {
+	if n.Chain == nil {
+		return fmt.Errorf("blockchain not initialized")
+	}
+	if !n.syncing.CompareAndSwap(false, true) {
+		return nil // Another sync is already running
+	}
+	defer n.syncing.Store(false)
+
+	tip, err := n.RequestTip(ctx, p)
+	if err != nil {
+		return err
+	}
+	ourHeight, ourHash, err := n.Chain.GetTip()
+	if err != nil {
+		return err
+	}
+	ourWork, err := n.Chain.GetWork(ourHash)
+	if err != nil {
+		return err
+	}
+	if tip.Work.Cmp(ourWork) <= 0 || n.Chain.HasBlock(tip.Hash) {
+		return nil
+	}
+	log.Printf("[Sync] Peer %s is at #%d with more work (we are at #%d). Catching up...", p, tip.Height, ourHeight)
+
+	// A heavier but shorter chain forks below our tip; fork detection
+	// below walks back from its last header
+	start := min(ourHeight+1, tip.Height)
+	step := 1
+	fetched := 0
+	for start <= tip.Height {
+		headers, err := n.RequestHeaders(ctx, p, start, MaxHeadersPerRequest)
+		if err != nil {
+			return err
+		}
+		if len(headers) == 0 {
+			break
+		}
+
+		// Fork detection
+		if !n.Chain.HasBlock(headers[0].PrevHash) {
+			if start <= 1 {
+				return fmt.Errorf("peer has a different genesis block")
+			}
+			start -= step
+			if start < 1 {
+				start = 1
+			}
+			step *= 2
+			continue
+		}
+
+		for _, hdr := range headers {
+			if n.Chain.HasBlock(hdr.Hash) {
+				continue
+			}
+			block, err := n.fetchBlock(ctx, p, hdr.Hash, hdr.Index >= tip.Pruned)
+			if err != nil {
+				return err
+			}
+			if err := n.Chain.ProcessBlock(block); err != nil && !errors.Is(err, blockchain.ErrBlockKnown) {
+				return fmt.Errorf("block #%d rejected: %w", block.Index, err)
+			}
+			fetched++
+		}
+		start = headers[len(headers)-1].Index + 1
+	}
+
+	height, _, _ := n.Chain.GetTip()
+	log.Printf("[Sync] Downloaded %d block(s) from %s. Tip is now #%d", fetched, p, height)
+	return nil
+}
+
+// fetchBlock downloads a block from p, falling back to our other peers when
+// p can't serve it (it may have pruned the body or dropped the branch).
+// p is skipped when its advertised pruned height shows it has no body.
+func (n *Node) fetchBlock(ctx context.Context, p peer.ID, hash string, askPeer bool) (*blockchain.Block, error) {
+	err := fmt.Errorf("peer %s has pruned block %s", p, hash)
+	if askPeer {
+		block, peerErr := n.RequestBlock(ctx, p, hash)
+		if peerErr == nil {
+			return block, nil
+		}
+		err = peerErr
+	}
+	for _, other := range n.Host.Network().Peers() {
+		if other == p {
+			continue
+		}
+		if block, otherErr := n.RequestBlock(ctx, other, hash); otherErr == nil {
+			log.Printf("[Sync] Fetched block %s from %s instead of %s", hash, other, p)
+			return block, nil
+		}
+	}
+	return nil, err
+}
+
+// syncProtocol is the sync stream protocol ID of our network.
+func (n *Node) syncProtocol() protocol.ID {
+	return protocol.ID(n.Params.SyncProtocol())
+}
+
+// openSyncStream opens a sync stream and sends a single request.
+func (n *Node) openSyncStream(ctx context.Context, p peer.ID, req []byte) (network.Stream, error) {
+	s, err := n.Host.NewStream(ctx, p, n.syncProtocol())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+
+	if _, err := s.Write(req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return s, nil
+}
+
+// writeString writes a length-prefixed string.
+func writeString(w io.Writer, str string) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(str))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, str)
+	return err
+}
+
+// readString reads a length-prefixed string of at most maxLen bytes.
+func readString(r io.Reader, maxLen uint32) (string, error) {
+	var strLen uint32
+	if err := binary.Read(r, binary.BigEndian, &strLen); err != nil {
+		return "", err
+	}
+	if strLen > maxLen {
+		return "", fmt.Errorf("string too long (%d bytes)", strLen)
+	}
+	buf := make([]byte, strLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
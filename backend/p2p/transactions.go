@@ -0,0 +1,92 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"decentralized-net/blockchain"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SetupTransactionPropagation joins the transaction topic. Every message goes
+// through validateTransaction before it is accepted or relayed, so the
+// validator is what fills our mempool from the network.
+func (n *Node) SetupTransactionPropagation() error {
+	if err := n.PubSub.RegisterTopicValidator(n.Params.TxTopic(), n.validateTransaction); err != nil {
+		return fmt.Errorf("failed to register validator: %w", err)
+	}
+
+	topic, err := n.PubSub.Join(n.Params.TxTopic())
+	if err != nil {
+		return fmt.Errorf("failed to join topic: %w", err)
+	}
+
+	// We must be subscribed to receive (and relay) messages; the validator
+	// does the work, so the subscription is just drained.
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	go n.drainSubscription(sub)
+
+	n.TxTopic = topic
+
+	log.Printf("[P2P] Listening for transactions on %s", n.Params.TxTopic())
+	return nil
+}
+
+// BroadcastTransaction publishes a transaction already in our mempool.
+func (n *Node) BroadcastTransaction(tx *blockchain.Transaction) error {
+	if n.TxTopic == nil {
+		return fmt.Errorf("transaction topic not joined")
+	}
+	return n.TxTopic.Publish(n.Ctx, tx.Serialize())
+}
+
+// validateTransaction adds a gossiped transaction to the mempool. Only
+// transactions we accepted are relayed further. Malformed or badly signed
+// ones penalize the sender; others (known, wrong nonce for our tip, ...) are
+// dropped without penalty since the peer may simply be ahead of or behind us.
+func (n *Node) validateTransaction(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	// Our own broadcasts were validated by AddTransaction before publishing
+	if from == n.Host.ID() {
+		return pubsub.ValidationAccept
+	}
+	if n.Chain == nil {
+		return pubsub.ValidationIgnore
+	}
+
+	tx, err := blockchain.DeserializeTransaction(msg.Data)
+	if err != nil {
+		return pubsub.ValidationReject
+	}
+	if tx.From == blockchain.CoinbaseSender || !n.Chain.VerifyTransaction(tx) {
+		return pubsub.ValidationReject
+	}
+
+	if err := n.Chain.AddTransaction(tx); err != nil {
+		if !errors.Is(err, blockchain.ErrTxKnown) {
+			log.Printf("[P2P] Dropped transaction %s from %s: %v", tx.ID, from, err)
+		}
+		return pubsub.ValidationIgnore
+	}
+
+	log.Printf("[P2P] Added transaction %s from %s to mempool", tx.ID, from)
+	return pubsub.ValidationAccept
+}
+
+// drainSubscription discards delivered messages until the node shuts down.
+func (n *Node) drainSubscription(sub *pubsub.Subscription) {
+	for {
+		if _, err := sub.Next(n.Ctx); err != nil {
+			if err != context.Canceled {
+				log.Printf("[P2P] Subscription error: %v", err)
+			}
+			return
+		}
+	}
+}
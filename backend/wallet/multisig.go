@@ -0,0 +1,167 @@
+package wallet
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// MaxMultisigKeys caps the number of keys in a multisig script, which keeps
+// a fully signed multisig transaction under the transaction size limit.
+const MaxMultisigKeys = 7
+
+// multisigMarker starts every encoded script. Hex PKIX keys start with "30",
+// so an encoded script is never mistaken for a single public key.
+const multisigMarker = 'M'
+
+// MultisigScript is an M-of-N policy: funds sent to its Address can be spent
+// by a transaction signed by any M of its N keys.
+type MultisigScript struct {
+	M          int
+	PublicKeys []string // Hex PKIX keys (see EncodePublicKey), sorted
+}
+
+// NewMultisigScript builds an M-of-N script from hex public keys. The keys
+// are sorted, so every signer derives the same address whatever the order.
+func NewMultisigScript(m int, publicKeys []string) (*MultisigScript, error) {
+	keys := make([]string, 0, len(publicKeys))
+	for _, encoded := range publicKeys {
+		pub, err := DecodePublicKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		canonical, err := EncodePublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, canonical)
+	}
+	sort.Strings(keys)
+
+	script := &MultisigScript{M: m, PublicKeys: keys}
+	if err := script.validate(); err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+func (ms *MultisigScript) validate() error {
+	n := len(ms.PublicKeys)
+	if n == 0 || n > MaxMultisigKeys {
+		return fmt.Errorf("multisig needs 1 to %d keys, got %d", MaxMultisigKeys, n)
+	}
+	if ms.M < 1 || ms.M > n {
+		return fmt.Errorf("invalid multisig threshold %d of %d", ms.M, n)
+	}
+	for i := 1; i < n; i++ {
+		if ms.PublicKeys[i] <= ms.PublicKeys[i-1] {
+			return fmt.Errorf("multisig keys must be sorted and distinct")
+		}
+	}
+	return nil
+}
+
+// bytes is the canonical encoding the address commits to:
+// [Marker] [M] [N] N x ([KeyLen (2)] [PKIX DER])
+func (ms *MultisigScript) bytes() []byte {
+	buf := []byte{multisigMarker, byte(ms.M), byte(len(ms.PublicKeys))}
+	for _, key := range ms.PublicKeys {
+		der, _ := hex.DecodeString(key)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(der)))
+		buf = append(buf, der...)
+	}
+	return buf
+}
+
+// Encode serializes the script so it can travel in a transaction's PublicKey
+func (ms *MultisigScript) Encode() string {
+	return hex.EncodeToString(ms.bytes())
+}
+
+// Address returns the multisig address (Hash of the script)
+func (ms *MultisigScript) Address() string {
+	hash := sha256.Sum256(ms.bytes())
+	return hex.EncodeToString(hash[:])
+}
+
+// IndexOf returns the position of a hex public key in the script, or -1.
+func (ms *MultisigScript) IndexOf(publicKey string) int {
+	for i, key := range ms.PublicKeys {
+		if key == publicKey {
+			return i
+		}
+	}
+	return -1
+}
+
+// IsMultisigScript reports whether an encoded key is a multisig script
+// rather than a single public key.
+func IsMultisigScript(encoded string) bool {
+	return len(encoded) >= 2 && encoded[:2] == hex.EncodeToString([]byte{multisigMarker})
+}
+
+// DecodeMultisigScript parses a script produced by Encode, rejecting any
+// non-canonical encoding.
+func DecodeMultisigScript(encoded string) (*MultisigScript, error) {
+	data, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multisig encoding: %w", err)
+	}
+	if len(data) < 3 || data[0] != multisigMarker {
+		return nil, fmt.Errorf("not a multisig script")
+	}
+
+	ms := &MultisigScript{M: int(data[1])}
+	n := int(data[2])
+	rest := data[3:]
+	for i := 0; i < n; i++ {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("truncated multisig script")
+		}
+		size := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 2+size {
+			return nil, fmt.Errorf("truncated multisig script")
+		}
+		key := hex.EncodeToString(rest[2 : 2+size])
+		if _, err := DecodePublicKey(key); err != nil {
+			return nil, err
+		}
+		ms.PublicKeys = append(ms.PublicKeys, key)
+		rest = rest[2+size:]
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing bytes after multisig script")
+	}
+	if err := ms.validate(); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// Verify checks that signatures (one slot per key, "" where a key did not
+// sign) contains at least M valid signatures of hash and no invalid ones.
+func (ms *MultisigScript) Verify(hash []byte, signatures []string) error {
+	if len(signatures) != len(ms.PublicKeys) {
+		return fmt.Errorf("got %d signature slots for %d keys", len(signatures), len(ms.PublicKeys))
+	}
+	valid := 0
+	for i, sig := range signatures {
+		if sig == "" {
+			continue
+		}
+		pub, err := DecodePublicKey(ms.PublicKeys[i])
+		if err != nil {
+			return err
+		}
+		if !VerifySignature(pub, hash, sig) {
+			return fmt.Errorf("invalid signature for key %d", i)
+		}
+		valid++
+	}
+	if valid < ms.M {
+		return fmt.Errorf("%d of %d required signatures", valid, ms.M)
+	}
+	return nil
+}
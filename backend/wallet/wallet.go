@@ -1,6 +1,7 @@
 package wallet
 
 import (
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -11,6 +12,7 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"strings"
 )
 
 // Wallet represents a user's keypair
@@ -29,6 +31,33 @@ func NewWallet() *Wallet {
 	return &Wallet{Private: private, Public: &private.PublicKey}
 }
 
+// FromSeed derives a keypair from a seed. Anyone who knows the seed holds the
+// key, so it is only for well-known test keys such as the regtest premine.
+func FromSeed(seed string) *Wallet {
+	curve := elliptic.P256()
+	// Map the hash into [1, N-1] so every seed gives a valid scalar
+	sum := sha256.Sum256([]byte(seed))
+	d := new(big.Int).SetBytes(sum[:])
+	d.Mod(d, new(big.Int).Sub(curve.Params().N, big.NewInt(1)))
+	d.Add(d, big.NewInt(1))
+
+	key, err := ecdh.P256().NewPrivateKey(d.FillBytes(make([]byte, 32)))
+	if err != nil {
+		panic("Failed to derive key: " + err.Error())
+	}
+	// Uncompressed point: 0x04 || X || Y
+	point := key.PublicKey().Bytes()
+	private := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(point[1:33]),
+			Y:     new(big.Int).SetBytes(point[33:]),
+		},
+		D: d,
+	}
+	return &Wallet{Private: private, Public: &private.PublicKey}
+}
+
 // SaveFile saves the private key to a file (PEM encoded)
 func (w *Wallet) SaveFile(filename string) error {
 	x509Encoded, err := x509.MarshalECPrivateKey(w.Private)
@@ -82,21 +111,50 @@ func (w *Wallet) Sign(dataHash []byte) (string, error) {
 
 // VerifySignature checks if a signature is valid for a given hash and public key
 func VerifySignature(pub *ecdsa.PublicKey, hash []byte, signature string) bool {
-	var r, s big.Int
 	// Parse "R|S"
-	var rHex, sHex string
-	n, _ := fmt.Sscanf(signature, "%s|%s", &rHex, &sHex) // Need to handle pipe split better maybe?
-
-	// Let's use simple string split manually to be safe
-	// But actually, Scanf with %x might work if formatted correctly?
-	// Let's implement a cleaner parsing manually in the caller or here.
+	parts := strings.Split(signature, "|")
+	if len(parts) != 2 {
+		return false
+	}
 
-	// Re-implementing parsing with fmt.Sscanf for hex directly
-	_, err := fmt.Sscanf(signature, "%x|%x", &r, &s)
-	if err != nil || n != 2 {
-		// Fallback or fail
+	var r, s big.Int
+	if _, ok := r.SetString(parts[0], 16); !ok {
+		return false
+	}
+	if _, ok := s.SetString(parts[1], 16); !ok {
 		return false
 	}
 
 	return ecdsa.Verify(pub, hash, &r, &s)
 }
+
+// PublicKeyHex returns the wallet's public key, hex encoded (PKIX DER)
+func (w *Wallet) PublicKeyHex() (string, error) {
+	return EncodePublicKey(w.Public)
+}
+
+// EncodePublicKey serializes a public key so it can travel inside a transaction
+func EncodePublicKey(pub *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(der), nil
+}
+
+// DecodePublicKey parses a key produced by EncodePublicKey
+func DecodePublicKey(encoded string) (*ecdsa.PublicKey, error) {
+	der, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not ECDSA")
+	}
+	return pub, nil
+}